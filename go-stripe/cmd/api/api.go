@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
@@ -10,7 +11,13 @@ import (
 	"time"
 
 	"github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/driver"
+	"github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/keyring"
+	"github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/lockout"
+	"github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/mailer"
+	"github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/middleware"
 	"github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/models"
+	"github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/outbox"
+	"github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/serviceauth"
 	"gorm.io/driver/mysql"
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
@@ -18,6 +25,9 @@ import (
 
 const version = "1.0.0"
 
+// totpIssuer names the application in users' authenticator apps
+const totpIssuer = "Widgets"
+
 type config struct {
 	port int
 	env  string
@@ -25,8 +35,9 @@ type config struct {
 		dsn string
 	}
 	stripe struct {
-		secret string
-		key    string
+		secret        string
+		key           string
+		webhookSecret string
 	}
 	smtp struct {
 		host     string
@@ -34,8 +45,20 @@ type config struct {
 		username string
 		password string
 	}
-	secretKey string
-	frontEnd  string
+	keys     *keyring.Keyring
+	frontEnd string
+	invoice  string
+	security struct {
+		corsOrigins   []string
+		cspReportOnly bool
+		cspReportURI  string
+		// trustedProxies may set X-Forwarded-For header with client's address
+		trustedProxies lockout.Proxies
+	}
+	passwordResetTTL time.Duration
+	renewalInterval  time.Duration
+	// serviceKeys are shared with invoicing microservice to sign requests to it
+	serviceKeys *keyring.Keyring
 }
 
 type application struct {
@@ -44,6 +67,8 @@ type application struct {
 	errorLog *log.Logger
 	version  string
 	DB       models.DBModel
+	mailer   *mailer.Mailer
+	guard    *lockout.Guard
 }
 
 func (app *application) serve() error {
@@ -65,12 +90,21 @@ func main() {
 	flag.IntVar(&cfg.port, "port", 4001, "Server port to listen on")
 	flag.StringVar(&cfg.env, "env", "development", "Application environment {development|production|maintenance}")
 	flag.StringVar(&cfg.frontEnd, "frontend", "http://localhost:4000", "URL to front-end app")
+	flag.StringVar(&cfg.invoice, "invoice", "http://localhost:5000", "URL to invoicing microservice")
+	flag.DurationVar(&cfg.passwordResetTTL, "reset-ttl", time.Hour, "Lifetime of password reset links")
+	corsOrigins := flag.String("cors-origins", "", "Comma separated origins allowed to call API besides front-end")
+	flag.BoolVar(&cfg.security.cspReportOnly, "csp-report-only", false, "Only report Content Security Policy violations instead of blocking")
+	flag.StringVar(&cfg.security.cspReportURI, "csp-report-uri", "", "URI browsers report Content Security Policy violations to")
+	flag.DurationVar(&cfg.renewalInterval, "renewal-interval", 0, "How often subscriptions are renewed by schedule instead of Stripe webhooks; 0 disables")
+	trustedProxies := flag.String("trusted-proxies", "", "Comma separated addresses and CIDR networks of reverse proxies trusted to set X-Forwarded-For header")
+	encryptPII := flag.Bool("encrypt-pii", false, "Encrypt personal data stored before field-level encryption and exit")
+	legacyCiphertext := flag.Bool("legacy-ciphertext", true, "Decrypt secrets stored in legacy unauthenticated format; turn off once -encrypt-pii has re-encrypted them")
 	flag.Parse()
 
 	cfg.stripe.key = os.Getenv("STRIPE_KEY")
 	cfg.stripe.secret = os.Getenv("STRIPE_SECRET")
+	cfg.stripe.webhookSecret = os.Getenv("STRIPE_WEBHOOK_SECRET")
 	cfg.db.dsn = os.Getenv("WIDGETS_DSN")
-	cfg.secretKey = os.Getenv("WIDGET_SECRET_KEY")
 
 	cfg.smtp.host = os.Getenv("SMTP_HOST")
 	var err error
@@ -84,6 +118,33 @@ func main() {
 	infoLog := log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime)
 	errorLog := log.New(os.Stdout, "ERROR\t", log.Ldate|log.Ltime|log.Lshortfile)
 
+	cfg.security.corsOrigins, err = middleware.Origins(cfg.frontEnd, *corsOrigins)
+	if err != nil {
+		errorLog.Fatal(err)
+	}
+	cfg.security.trustedProxies, err = lockout.ParseProxies(*trustedProxies)
+	if err != nil {
+		errorLog.Fatal(err)
+	}
+
+	// WIDGET_SECRET_KEY is still accepted for links and data made before keys got IDs
+	cfg.keys, err = keyring.Parse(os.Getenv("WIDGET_SECRET_KEYS"), os.Getenv("WIDGET_ACTIVE_KEY_ID"), os.Getenv("WIDGET_SECRET_KEY"))
+	if err != nil {
+		errorLog.Fatal(err)
+	}
+	cfg.serviceKeys, err = keyring.Parse(os.Getenv("WIDGET_SERVICE_KEYS"), os.Getenv("WIDGET_SERVICE_ACTIVE_KEY_ID"), os.Getenv("WIDGET_SERVICE_KEY"))
+	if err != nil {
+		errorLog.Fatal(err)
+	}
+	// blind index key can not be rotated, so it is configured separately from the keyring
+	indexKey := os.Getenv("WIDGET_BLIND_INDEX_KEY")
+	if indexKey == "" {
+		indexKey = os.Getenv("WIDGET_SECRET_KEY")
+	}
+	if err = models.ConfigureFieldEncryption(cfg.keys, []byte(indexKey), *legacyCiphertext); err != nil {
+		errorLog.Fatal(err)
+	}
+
 	infoLog.Printf("Trying to connect to DB with DSN: %q\n", cfg.db.dsn)
 	var conn *gorm.DB
 	if cfg.env == "development" {
@@ -111,6 +172,16 @@ func main() {
 
 	infoLog.Println("Connected to DB!")
 
+	if *encryptPII {
+		db := models.DBModel{DB: conn}
+		n, err := db.EncryptPersonalData(cfg.keys)
+		if err != nil {
+			errorLog.Fatal(err)
+		}
+		infoLog.Printf("Personal data of %d records has been encrypted\n", n)
+		return
+	}
+
 	app := &application{
 		config:   cfg,
 		infoLog:  infoLog,
@@ -118,6 +189,29 @@ func main() {
 		version:  version,
 		DB:       models.DBModel{DB: conn},
 	}
+	app.mailer = &mailer.Mailer{
+		Host:      cfg.smtp.host,
+		Port:      cfg.smtp.port,
+		Username:  cfg.smtp.username,
+		Password:  cfg.smtp.password,
+		Templates: emailTemplateFS,
+	}
+	app.guard = lockout.New(&app.DB, app.mailer, "info@widget.com", errorLog)
+
+	// invoices are delivered from the outbox, so that none of them is lost while the microservice is down;
+	// requests to it are signed with the key shared with it
+	invoiceClient := &http.Client{Transport: (&serviceauth.Signer{Keys: cfg.serviceKeys}).Transport(nil)}
+	dispatcher := outbox.New(&app.DB, map[string]outbox.Handler{
+		models.OutboxTopicInvoice:    outbox.PostJSON(invoiceClient, cfg.invoice+"/invoice/create-and-send"),
+		models.OutboxTopicCreditNote: outbox.PostJSON(invoiceClient, cfg.invoice+"/invoice/credit-note"),
+	}, infoLog, errorLog)
+	go dispatcher.Run(context.Background())
+
+	// renewals are invoiced on Stripe's invoice.paid events; where webhooks can not reach the API
+	// they are invoiced when paid period ends
+	if cfg.renewalInterval > 0 {
+		go app.runRenewals(context.Background(), cfg.renewalInterval)
+	}
 
 	err = app.serve()
 	if err != nil {
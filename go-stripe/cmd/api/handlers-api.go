@@ -1,7 +1,7 @@
 package main
 
 import (
-	"bytes"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -12,11 +12,12 @@ import (
 
 	"github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/cards"
 	common_models "github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/common"
-	"github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/encryption"
 	"github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/models"
+	"github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/totp"
 	"github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/urlsigner"
 	"github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/validator"
 	"github.com/go-chi/chi/v5"
+	"github.com/skip2/go-qrcode"
 	"github.com/stripe/stripe-go/v74"
 	"golang.org/x/crypto/bcrypt"
 )
@@ -160,6 +161,12 @@ func (app *application) CreateCustomerAndSubscribeToPlan(w http.ResponseWriter,
 			okay = false
 			goto FINISH
 		}
+		widget, err := app.DB.GetWidget(productID)
+		if err != nil {
+			app.errorLog.Println(err)
+			okay = false
+			goto FINISH
+		}
 		customerID, err := app.SaveCustomer(data.FirstName, data.LastName, data.Email)
 		if err != nil {
 			err = fmt.Errorf("error saving customer: %w", err)
@@ -189,32 +196,39 @@ func (app *application) CreateCustomerAndSubscribeToPlan(w http.ResponseWriter,
 			okay = false
 			goto FINISH
 		}
+		// renewals are invoiced when paid period ends
+		periodStart := time.Unix(subscription.CurrentPeriodStart, 0)
+		periodEnd := time.Unix(subscription.CurrentPeriodEnd, 0)
 		order := models.Order{
-			WidgetID:      productID,
-			TransactionID: txnID,
-			CustomerID:    customerID,
-			StatusID:      1,
-			Quantity:      1,
-			Amount:        amount,
+			WidgetID:         productID,
+			TransactionID:    txnID,
+			CustomerID:       customerID,
+			StatusID:         1,
+			Quantity:         1,
+			Amount:           amount,
+			CurrentPeriodEnd: &periodEnd,
+			Locale:           common_models.PreferredLocale(r.Header.Get("Accept-Language")),
 		}
-		orderID, err := app.SaveOrder(order)
-		if err != nil {
-			app.errorLog.Println(err)
-			okay = false
-			goto FINISH
-		}
-
-		inv := common_models.Order{
-			ID:        orderID,
-			Amount:    2000,
-			Product:   "Bronze plan monthly subscription",
-			Quantity:  order.Quantity,
-			FirstName: data.FirstName,
-			LastName:  data.LastName,
-			Email:     data.Email,
-			CreatedAt: time.Now(),
-		}
-		err = app.callInvoiceMicro(inv)
+		// invoice is generated and sent to customer by microservice, that gets it from the outbox
+		_, err = app.DB.InsertOrderWithMessage(order, models.OutboxTopicInvoice, func(orderID int) any {
+			return common_models.Order{
+				ID:            orderID,
+				TransactionID: order.TransactionID,
+				Amount:        order.Amount,
+				Currency:      "usd",
+				Items: []common_models.OrderItem{
+					{Product: "Bronze plan monthly subscription", Quantity: order.Quantity, UnitPrice: order.Amount},
+				},
+				FirstName:   data.FirstName,
+				LastName:    data.LastName,
+				Email:       data.Email,
+				PeriodStart: &periodStart,
+				PeriodEnd:   &periodEnd,
+				Locale:      order.Locale,
+				Brand:       widget.Brand,
+				CreatedAt:   time.Now(),
+			}
+		})
 		if err != nil {
 			app.errorLog.Println(err)
 			okay = false
@@ -297,6 +311,8 @@ func (app *application) CreateAuthToken(w http.ResponseWriter, r *http.Request)
 	var userInput struct {
 		Email    string `json:"email"`
 		Password string `json:"password"`
+		Device   string `json:"device"`
+		Code     string `json:"code"`
 	}
 
 	err := app.readJSON(w, r, &userInput)
@@ -307,11 +323,15 @@ func (app *application) CreateAuthToken(w http.ResponseWriter, r *http.Request)
 		}
 		return
 	}
+	if !app.checkThrottle(w, r, models.ThrottleLogin, userInput.Email) {
+		return
+	}
 
 	// get user from the database by email; send error if invalid email
 	user, err := app.DB.GetUserByEmail(userInput.Email)
 	if err != nil {
 		app.errorLog.Println(err)
+		app.throttleFailure(r, models.ThrottleLogin, userInput.Email)
 		app.invalidCredentials(w)
 		return
 	}
@@ -326,10 +346,35 @@ func (app *application) CreateAuthToken(w http.ResponseWriter, r *http.Request)
 	}
 	if !passwordMatches {
 		app.infoLog.Printf("Incorrect credentials entered by: %s\n", userInput.Email)
+		app.throttleFailure(r, models.ThrottleLogin, userInput.Email)
 		app.invalidCredentials(w)
 		return
 	}
 
+	// check the second factor if user has enabled it
+	if user.TOTPEnabled {
+		if userInput.Code == "" {
+			app.twoFactorRequired(w, "two-factor authentication code required")
+			return
+		}
+		codeMatches, err := app.DB.VerifySecondFactor(user, userInput.Code, app.config.keys)
+		if err != nil {
+			app.errorLog.Println(err)
+			app.internalError(w)
+			return
+		}
+		if !codeMatches {
+			app.infoLog.Printf("Incorrect two-factor code entered by: %s\n", userInput.Email)
+			app.throttleFailure(r, models.ThrottleLogin, userInput.Email)
+			app.twoFactorRequired(w, "invalid two-factor authentication code")
+			return
+		}
+	}
+
+	if err = app.guard.Succeed(models.ThrottleLogin, userInput.Email); err != nil {
+		app.errorLog.Println(err)
+	}
+
 	// generate the token
 	token, err := models.GenerateToken(user.ID, 12*time.Hour, models.ScopeAuthentication)
 	if err != nil {
@@ -339,7 +384,14 @@ func (app *application) CreateAuthToken(w http.ResponseWriter, r *http.Request)
 	}
 
 	// save token to the database
-	_, err = app.DB.InsertToken(token, user)
+	device := userInput.Device
+	if device == "" {
+		device = r.UserAgent()
+	}
+	if len(device) > 255 {
+		device = device[:255]
+	}
+	_, err = app.DB.InsertToken(token, user, device)
 	if err != nil {
 		app.errorLog.Println(err)
 		app.internalError(w)
@@ -361,7 +413,7 @@ func (app *application) CreateAuthToken(w http.ResponseWriter, r *http.Request)
 
 func (app *application) CheckAuthentication(w http.ResponseWriter, r *http.Request) {
 	// validate the token and get associated user
-	user, err := app.authenticateToken(r)
+	user, _, err := app.authenticateToken(r)
 	//	sent back "invalid credentials" if token is not validated
 	if err != nil {
 		app.errorLog.Println(err)
@@ -382,26 +434,390 @@ func (app *application) CheckAuthentication(w http.ResponseWriter, r *http.Reque
 	}
 }
 
-func (app *application) authenticateToken(r *http.Request) (*models.User, error) {
-	// get and parse authorization header
+// bearerToken extracts plain text token from authorization header
+func bearerToken(r *http.Request) (string, error) {
 	authorizationHeader := r.Header.Get("Authorization")
 	if authorizationHeader == "" {
-		return nil, errors.New("authorization error; no authorization header in the request")
+		return "", errors.New("authorization error; no authorization header in the request")
 	}
 	headerParts := strings.Split(authorizationHeader, " ")
 	if len(headerParts) != 2 || headerParts[0] != "Bearer" {
-		return nil, errors.New("bad authorization header's format")
+		return "", errors.New("bad authorization header's format")
 	}
 	token := headerParts[1]
 	if len(token) != 26 {
-		return nil, errors.New("wrong size of an authentication token")
+		return "", errors.New("wrong size of an authentication token")
+	}
+	return token, nil
+}
+
+func (app *application) authenticateToken(r *http.Request) (*models.User, *models.Token, error) {
+	// get and parse authorization header
+	token, err := bearerToken(r)
+	if err != nil {
+		return nil, nil, err
 	}
 	// get the user from the tokens table
-	user, err := app.DB.GetUserForToken(token)
+	user, t, err := app.DB.GetUserForToken(token)
+	if err != nil {
+		return nil, nil, errors.New("no matching user found")
+	}
+	return user, t, nil
+}
+
+// Logout revokes the token used to authenticate the request
+func (app *application) Logout(w http.ResponseWriter, r *http.Request) {
+	token, err := bearerToken(r)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.invalidCredentials(w)
+		return
+	}
+	if err = app.DB.DeleteToken(token); err != nil {
+		app.errorLog.Println(err)
+		app.internalError(w)
+		return
+	}
+	app.writeJson(w, http.StatusOK, responsePayload{Error: false, Message: "Logged out"})
+}
+
+// AllTokens lists valid tokens of the authenticated user, one per device
+func (app *application) AllTokens(w http.ResponseWriter, r *http.Request) {
+	user := app.authenticatedUser(r)
+	token, _ := bearerToken(r)
+	tokens, err := app.DB.GetTokensForUser(user.ID, token)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.internalError(w)
+		return
+	}
+	app.writeJson(w, http.StatusOK, tokens)
+}
+
+// IssueToken issues token with limited scopes to the authenticated user, i.e. for integrations
+func (app *application) IssueToken(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Device string   `json:"device"`
+		Scopes []string `json:"scopes"`
+		Days   int      `json:"days"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.BadRequest(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(len(input.Device) > 2, "device", "must be at least 3 characters long")
+	v.Check(len(input.Device) <= 255, "device", "must be at most 255 characters long")
+	v.Check(input.Days > 0 && input.Days <= 90, "days", "must be between 1 and 90")
+	v.Check(len(input.Scopes) > 0, "scopes", "at least one scope must be selected")
+	for _, scope := range input.Scopes {
+		v.Check(models.IsIssuableScope(scope), "scopes", fmt.Sprintf("unknown scope %q", scope))
+	}
+	if !v.Valid() {
+		app.failedValidation(w, r, v.Errors)
+		return
+	}
+
+	user := app.authenticatedUser(r)
+	token, err := models.GenerateToken(user.ID, time.Duration(input.Days)*24*time.Hour, strings.Join(input.Scopes, " "))
+	if err != nil {
+		app.errorLog.Println(err)
+		app.internalError(w)
+		return
+	}
+	_, err = app.DB.InsertToken(token, *user, input.Device)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.internalError(w)
+		return
+	}
+
+	app.writeJson(w, http.StatusCreated, authJsonPayload{
+		Error:   false,
+		Message: fmt.Sprintf("Token for %q created.", input.Device),
+		Token:   *token,
+	})
+}
+
+// RevokeToken revokes one of the authenticated user's tokens
+func (app *application) RevokeToken(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	tokenID, err := strconv.Atoi(id)
+	if err != nil {
+		e := fmt.Errorf("error converting token id to int: %w", err)
+		app.errorLog.Println(e)
+		app.BadRequest(w, r, e)
+		return
+	}
+	user := app.authenticatedUser(r)
+	err = app.DB.DeleteTokenForUser(user.ID, tokenID)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.BadRequest(w, r, errors.New("token not found"))
+		return
+	}
+	app.writeJson(w, http.StatusOK, responsePayload{Error: false, Message: "Token revoked"})
+}
+
+// apiKeyFromRequest returns API key passed in X-API-Key header or as a bearer token
+func apiKeyFromRequest(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	headerParts := strings.Split(r.Header.Get("Authorization"), " ")
+	if len(headerParts) == 2 && headerParts[0] == "Bearer" && models.IsAPIKey(headerParts[1]) {
+		return headerParts[1]
+	}
+	return ""
+}
+
+func (app *application) authenticateAPIKey(r *http.Request, plainText string) (*models.User, *models.APIKey, error) {
+	user, key, err := app.DB.GetUserForAPIKey(plainText)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = app.checkAPIKeyIP(r, key); err != nil {
+		return nil, nil, err
+	}
+	return user, key, nil
+}
+
+// checkAPIKeyIP returns an error if the key may not be used from client's address. The address
+// only comes from X-Forwarded-For behind trusted proxies, otherwise anyone could pass the allow-list
+func (app *application) checkAPIKeyIP(r *http.Request, key *models.APIKey) error {
+	if ip := app.clientIP(r); !key.AllowsIP(ip) {
+		return fmt.Errorf("API key %q is not allowed from %s", key.Name, ip)
+	}
+	return nil
+}
+
+// AllAPIKeys lists API keys of all integrations
+func (app *application) AllAPIKeys(w http.ResponseWriter, r *http.Request) {
+	keys, err := app.DB.GetAllAPIKeys()
+	if err != nil {
+		app.errorLog.Println(err)
+		app.internalError(w)
+		return
+	}
+	app.writeJson(w, http.StatusOK, keys)
+}
+
+// CreateAPIKey creates API key acting on behalf of the user with given scopes
+func (app *application) CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name       string   `json:"name"`
+		UserID     int      `json:"user_id"`
+		Scopes     []string `json:"scopes"`
+		Days       int      `json:"days"`
+		AllowedIPs string   `json:"allowed_ips"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.BadRequest(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(len(input.Name) > 2, "name", "must be at least 3 characters long")
+	v.Check(len(input.Name) <= 255, "name", "must be at most 255 characters long")
+	v.Check(input.Days >= 0, "days", "must not be negative")
+	v.Check(len(input.Scopes) > 0, "scopes", "at least one scope must be selected")
+	for _, scope := range input.Scopes {
+		v.Check(models.IsIssuableScope(scope), "scopes", fmt.Sprintf("unknown scope %q", scope))
+	}
+	if err := models.ValidateAllowedIPs(input.AllowedIPs); err != nil {
+		v.AddError("allowed_ips", err.Error())
+	}
+	if input.UserID == 0 {
+		input.UserID = app.authenticatedUser(r).ID
+	}
+	if _, err := app.DB.GetUserByID(input.UserID); err != nil {
+		v.AddError("user_id", "user not found")
+	}
+	if !v.Valid() {
+		app.failedValidation(w, r, v.Errors)
+		return
+	}
+
+	var expiry *time.Time
+	if input.Days > 0 {
+		e := time.Now().Add(time.Duration(input.Days) * 24 * time.Hour)
+		expiry = &e
+	}
+	plainText, key, err := models.GenerateAPIKey(input.UserID, input.Name, strings.Join(input.Scopes, " "), expiry, input.AllowedIPs)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.internalError(w)
+		return
+	}
+	key.ID, err = app.DB.InsertAPIKey(*key)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.internalError(w)
+		return
+	}
+	app.audit(r, models.AuditCreateAPIKey, models.AuditEntityKey, key.ID, nil, key)
+
+	app.writeJson(w, http.StatusCreated, struct {
+		responsePayload
+		Key string `json:"key"`
+	}{
+		responsePayload: responsePayload{Error: false, Message: fmt.Sprintf("API key %q created.", input.Name)},
+		Key:             plainText,
+	})
+}
+
+// RevokeAPIKey deletes API key, so that it can not be used anymore
+func (app *application) RevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	keyID, err := strconv.Atoi(id)
+	if err != nil {
+		e := fmt.Errorf("error converting API key id to int: %w", err)
+		app.errorLog.Println(e)
+		app.BadRequest(w, r, e)
+		return
+	}
+	before, err := app.DB.GetAPIKey(keyID)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.BadRequest(w, r, errors.New("API key not found"))
+		return
+	}
+	if err = app.DB.DeleteAPIKey(keyID); err != nil {
+		app.errorLog.Println(err)
+		app.internalError(w)
+		return
+	}
+	app.audit(r, models.AuditRevokeAPIKey, models.AuditEntityKey, keyID, before, nil)
+	app.writeJson(w, http.StatusOK, responsePayload{Error: false, Message: "API key revoked"})
+}
+
+// AllSessions returns active web sessions of all users
+func (app *application) AllSessions(w http.ResponseWriter, r *http.Request) {
+	sessions, err := app.DB.GetActiveUserSessions()
+	if err != nil {
+		app.errorLog.Println(err)
+		app.internalError(w)
+		return
+	}
+	app.writeJson(w, http.StatusOK, sessions)
+}
+
+// RevokeSession destroys web session, so that its user gets logged out
+func (app *application) RevokeSession(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	sessionID, err := strconv.Atoi(id)
+	if err != nil {
+		e := fmt.Errorf("error converting session id to int: %w", err)
+		app.errorLog.Println(e)
+		app.BadRequest(w, r, e)
+		return
+	}
+	before, err := app.DB.GetUserSession(sessionID)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.BadRequest(w, r, errors.New("session not found"))
+		return
+	}
+	if err = app.DB.RevokeUserSession(sessionID); err != nil {
+		app.errorLog.Println(err)
+		app.internalError(w)
+		return
+	}
+	app.audit(r, models.AuditRevokeSession, models.AuditEntitySession, sessionID, before, nil)
+	app.writeJson(w, http.StatusOK, responsePayload{Error: false, Message: "session revoked"})
+}
+
+// AllOutboxMessages returns messages to other services that have not been delivered yet
+func (app *application) AllOutboxMessages(w http.ResponseWriter, r *http.Request) {
+	msgs, err := app.DB.GetUndeliveredOutboxMessages()
+	if err != nil {
+		app.errorLog.Println(err)
+		app.internalError(w)
+		return
+	}
+	app.writeJson(w, http.StatusOK, msgs)
+}
+
+// RetryOutboxMessage makes undelivered message due for delivery right away
+func (app *application) RetryOutboxMessage(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	msgID, err := strconv.Atoi(id)
+	if err != nil {
+		e := fmt.Errorf("error converting message id to int: %w", err)
+		app.errorLog.Println(e)
+		app.BadRequest(w, r, e)
+		return
+	}
+	before, err := app.DB.GetOutboxMessage(msgID)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.BadRequest(w, r, errors.New("message not found"))
+		return
+	}
+	if before.DeliveredAt != nil {
+		app.BadRequest(w, r, errors.New("message has already been delivered"))
+		return
+	}
+	if err = app.DB.RetryOutboxMessage(msgID); err != nil {
+		app.errorLog.Println(err)
+		app.internalError(w)
+		return
+	}
+	after, err := app.DB.GetOutboxMessage(msgID)
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+	app.audit(r, models.AuditRetryOutbox, models.AuditEntityOutbox, msgID, before, after)
+	app.writeJson(w, http.StatusOK, responsePayload{Error: false, Message: "message will be delivered shortly"})
+}
+
+// AllFailedInvoiceJobs lists invoice jobs the microservice has given up on
+func (app *application) AllFailedInvoiceJobs(w http.ResponseWriter, r *http.Request) {
+	jobs, err := app.DB.GetFailedInvoiceJobs()
+	if err != nil {
+		app.errorLog.Println(err)
+		app.internalError(w)
+		return
+	}
+	app.writeJson(w, http.StatusOK, jobs)
+}
+
+// RetryInvoiceJob queues failed invoice job again
+func (app *application) RetryInvoiceJob(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	jobID, err := strconv.Atoi(id)
+	if err != nil {
+		e := fmt.Errorf("error converting job id to int: %w", err)
+		app.errorLog.Println(e)
+		app.BadRequest(w, r, e)
+		return
+	}
+	before, err := app.DB.GetInvoiceJob(jobID)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.BadRequest(w, r, errors.New("job not found"))
+		return
+	}
+	if before.Status != models.InvoiceJobFailed {
+		app.BadRequest(w, r, fmt.Errorf("only failed jobs can be retried, the job is %s", before.Status))
+		return
+	}
+	if err = app.DB.RetryInvoiceJob(jobID); err != nil {
+		app.errorLog.Println(err)
+		app.internalError(w)
+		return
+	}
+	after, err := app.DB.GetInvoiceJob(jobID)
 	if err != nil {
-		return nil, errors.New("no matching user found")
+		app.errorLog.Println(err)
 	}
-	return user, nil
+	app.audit(r, models.AuditRetryInvoiceJob, models.AuditEntityJob, jobID, before, after)
+	app.writeJson(w, http.StatusOK, responsePayload{Error: false, Message: "job will be run shortly"})
 }
 
 func (app *application) SendPasswordResetEmail(w http.ResponseWriter, r *http.Request) {
@@ -416,6 +832,12 @@ func (app *application) SendPasswordResetEmail(w http.ResponseWriter, r *http.Re
 		return
 	}
 
+	// every request counts, as each of them sends an email
+	if !app.checkThrottle(w, r, models.ThrottlePasswordReset, payload.Email) {
+		return
+	}
+	app.throttleFailure(r, models.ThrottlePasswordReset, payload.Email)
+
 	// prepare successful response
 	response := struct {
 		Error   bool   `json:"error"`
@@ -423,7 +845,7 @@ func (app *application) SendPasswordResetEmail(w http.ResponseWriter, r *http.Re
 	}{false, "If your email exists in our DB, then password reset link was successfully sent! Check your inbox!"}
 
 	// verify that user with entered email exists in DB
-	_, err = app.DB.GetUserByEmail(payload.Email)
+	user, err := app.DB.GetUserByEmail(payload.Email)
 	if err != nil {
 		// print error to log because email is not found
 		app.errorLog.Println(err)
@@ -432,16 +854,25 @@ func (app *application) SendPasswordResetEmail(w http.ResponseWriter, r *http.Re
 		return
 	}
 
-	link := fmt.Sprintf("%s/reset-password?email=%s", app.config.frontEnd, payload.Email)
+	// link carries one-time token bound to the user instead of the email
+	resetToken, err := app.DB.CreatePasswordReset(user.ID, app.config.passwordResetTTL)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.internalError(w)
+		return
+	}
+	link := fmt.Sprintf("%s/reset-password?token=%s", app.config.frontEnd, resetToken)
 	sign := urlsigner.Signer{
-		Secret: []byte(app.config.secretKey),
+		Keys: app.config.keys,
 	}
 	signedLink := sign.GenerateTokenFromString(link)
 
 	var data = struct {
-		Link string
+		Link    string
+		Minutes int
 	}{
 		signedLink,
+		int(app.config.passwordResetTTL.Minutes()),
 	}
 
 	// send email
@@ -457,7 +888,7 @@ func (app *application) SendPasswordResetEmail(w http.ResponseWriter, r *http.Re
 
 func (app *application) ResetPassword(w http.ResponseWriter, r *http.Request) {
 	var payload struct {
-		Email    string `json:"email"`
+		Token    string `json:"token"`
 		Password string `json:"password"`
 	}
 
@@ -468,19 +899,15 @@ func (app *application) ResetPassword(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	encryptor := encryption.Encryption{
-		Key: []byte(app.config.secretKey),
-	}
-	decryptedEmail, err := encryptor.Decrypt(payload.Email)
-	if err != nil {
-		app.errorLog.Println(err)
-		app.BadRequest(w, r, errors.New("wrong email data"))
+	// token is checked before the password is hashed, so that bogus tokens cost no hashing
+	_, err = app.DB.GetUserForPasswordReset(payload.Token)
+	if errors.Is(err, models.ErrInvalidResetToken) {
+		app.BadRequest(w, r, err)
+		return
 	}
-
-	user, err := app.DB.GetUserByEmail(decryptedEmail)
 	if err != nil {
 		app.errorLog.Println(err)
-		app.BadRequest(w, r, err)
+		app.internalError(w)
 		return
 	}
 
@@ -491,18 +918,27 @@ func (app *application) ResetPassword(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = app.DB.UpdatePasswordForUser(user, string(newHash))
+	// token is checked again and used up together with password change
+	user, err := app.DB.ResetPassword(payload.Token, string(newHash))
+	if errors.Is(err, models.ErrInvalidResetToken) {
+		app.BadRequest(w, r, err)
+		return
+	}
 	if err != nil {
 		app.errorLog.Println(err)
 		app.internalError(w)
 		return
 	}
+	// the owner of the mailbox has proven the identity, so lockout is not needed anymore
+	if err = app.guard.Unlock(user.Email); err != nil {
+		app.errorLog.Println(err)
+	}
 
 	response := struct {
 		Error   bool   `json:"error"`
 		Message string `json:"message"`
-	}{false, fmt.Sprintf("Password has been successfully changed for user %q", decryptedEmail)}
-	app.infoLog.Printf("Password has been changed for %q user", decryptedEmail)
+	}{false, fmt.Sprintf("Password has been successfully changed for user %q", user.Email)}
+	app.infoLog.Printf("Password has been changed for %q user", user.Email)
 	app.writeJson(w, http.StatusOK, response)
 }
 
@@ -627,12 +1063,28 @@ func (app *application) RefundCharge(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = app.DB.UpdateOrderStatus(chargeToRefund.ID, 2)
+	before, err := app.DB.GetOrder(chargeToRefund.ID)
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+	// credit note for the amount refunded is issued and sent to customer by microservice
+	err = app.DB.UpdateOrderStatusWithMessage(chargeToRefund.ID, 2, models.OutboxTopicCreditNote, common_models.CreditNote{
+		OrderID:       chargeToRefund.ID,
+		TransactionID: trx.ID,
+		Amount:        chargeToRefund.Amount,
+		Reason:        common_models.CreditNoteReasonRefund,
+		FirstName:     before.Customer.FirstName,
+		LastName:      before.Customer.LastName,
+		Email:         before.Customer.Email,
+	})
 	if err != nil {
 		app.errorLog.Println(err)
 		app.BadRequest(w, r, errors.New("the charge was refunded, but the database could not be updated; please call support"))
 		return
 	}
+	after := before
+	after.StatusID = 2
+	app.audit(r, models.AuditRefund, models.AuditEntityOrder, chargeToRefund.ID, before, after)
 
 	resp := responsePayload{
 		Error:   false,
@@ -673,12 +1125,20 @@ func (app *application) CancelSubscription(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	before, err := app.DB.GetOrder(subToCancel.ID)
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+	// subscription ends with the period paid for and nothing is returned, so there is nothing to credit
 	err = app.DB.UpdateOrderStatus(subToCancel.ID, 3)
 	if err != nil {
 		app.errorLog.Println(err)
 		app.BadRequest(w, r, errors.New("the subscription was cancelled, but the database could not be updated; please call support"))
 		return
 	}
+	after := before
+	after.StatusID = 3
+	app.audit(r, models.AuditCancelSubscription, models.AuditEntityOrder, subToCancel.ID, before, after)
 
 	resp := responsePayload{
 		Error:   false,
@@ -726,7 +1186,14 @@ func (app *application) OneUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	user.Password = ""
-	app.writeJson(w, http.StatusOK, user)
+	lockedUntil, err := app.guard.LockedUntil(user.Email)
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+	app.writeJson(w, http.StatusOK, struct {
+		models.User
+		LockedUntil *time.Time `json:"locked_until"`
+	}{user, lockedUntil})
 }
 
 func (app *application) EditUser(w http.ResponseWriter, r *http.Request) {
@@ -747,11 +1214,22 @@ func (app *application) EditUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	v := validator.New()
+	v.Check(user.RoleID > 0, "role_id", "must be selected")
+	if !v.Valid() {
+		app.failedValidation(w, r, v.Errors)
+		return
+	}
+
 	//	Save user
 	var status int
+	var before *models.User
 	if userID > 0 { // update existing
 		status = http.StatusOK
 		user.ID = userID
+		if oldUser, err := app.DB.GetUserByID(userID); err == nil {
+			before = &oldUser
+		}
 		err = app.DB.UpdateUser(user)
 	} else { // create new
 		newHash, err := bcrypt.GenerateFromPassword([]byte(user.Password), 12)
@@ -761,6 +1239,9 @@ func (app *application) EditUser(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		user.Password = string(newHash)
+		// new users enroll into two-factor authentication themselves
+		user.TOTPSecret = ""
+		user.TOTPEnabled = false
 		user.ID, err = app.DB.InsertUser(user)
 		status = http.StatusCreated
 	}
@@ -786,6 +1267,16 @@ func (app *application) EditUser(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	if userID > 0 {
+		after, err := app.DB.GetUserByID(userID)
+		if err != nil {
+			app.errorLog.Println(err)
+		}
+		app.audit(r, models.AuditEditUser, models.AuditEntityUser, userID, before, after)
+	} else {
+		app.audit(r, models.AuditCreateUser, models.AuditEntityUser, user.ID, nil, user)
+	}
+
 	//	write response
 	app.writeJson(w, status, responsePayload{
 		Error:   false,
@@ -802,32 +1293,209 @@ func (app *application) DeleteUser(w http.ResponseWriter, r *http.Request) {
 		app.BadRequest(w, r, e)
 		return
 	}
+	before, err := app.DB.GetUserByID(userID)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.BadRequest(w, r, errors.New("user not found"))
+		return
+	}
 	err = app.DB.DeleteUser(models.User{DBEntity: models.DBEntity{ID: userID}})
 	if err != nil {
 		app.errorLog.Println(err)
 		app.BadRequest(w, r, errors.New("user not found"))
 		return
 	}
+	app.audit(r, models.AuditDeleteUser, models.AuditEntityUser, userID, before, nil)
 	app.writeJson(w, http.StatusOK, responsePayload{Error: false, Message: "User deleted successfully"})
 }
 
+// UnlockUser lifts lockout imposed on the user after too many failed login attempts
+func (app *application) UnlockUser(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	userID, err := strconv.Atoi(id)
+	if err != nil {
+		e := fmt.Errorf("error converting user id to int: %w", err)
+		app.errorLog.Println(e)
+		app.BadRequest(w, r, e)
+		return
+	}
+	user, err := app.DB.GetUserByID(userID)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.BadRequest(w, r, errors.New("user not found"))
+		return
+	}
+	lockedUntil, err := app.guard.LockedUntil(user.Email)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.internalError(w)
+		return
+	}
+	if err = app.guard.Unlock(user.Email); err != nil {
+		app.errorLog.Println(err)
+		app.internalError(w)
+		return
+	}
+	app.audit(r, models.AuditUnlockUser, models.AuditEntityUser, userID,
+		map[string]any{"locked_until": lockedUntil}, map[string]any{"locked_until": nil})
+	app.writeJson(w, http.StatusOK, responsePayload{Error: false, Message: "User unlocked"})
+}
+
+// SetupTwoFactor starts two-factor authentication enrollment of the current user and returns
+// the secret and provisioning URI to be added to authenticator app, the latter also as QR code
+// image, so that the secret is not handed to scripts making QR codes in the browser
+func (app *application) SetupTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user := app.authenticatedUser(r)
+	secret, err := app.DB.StartTwoFactorEnrollment(*user, app.config.keys)
+	if errors.Is(err, models.ErrTwoFactorEnabled) {
+		app.BadRequest(w, r, err)
+		return
+	}
+	if err != nil {
+		app.errorLog.Println(err)
+		app.internalError(w)
+		return
+	}
+	uri := totp.ProvisioningURI(secret, totpIssuer, user.Email)
+	image, err := qrcode.Encode(uri, qrcode.Medium, 192)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.internalError(w)
+		return
+	}
+
+	app.writeJson(w, http.StatusOK, struct {
+		responsePayload
+		Secret string `json:"secret"`
+		URI    string `json:"uri"`
+		QRCode string `json:"qr_code"`
+	}{
+		responsePayload: responsePayload{Error: false, Message: "Scan the code with your authenticator app"},
+		Secret:          secret,
+		URI:             uri,
+		QRCode:          "data:image/png;base64," + base64.StdEncoding.EncodeToString(image),
+	})
+}
+
+// EnableTwoFactor finishes enrollment of the current user once the user confirms it with a valid code
+// and returns recovery codes to be shown only once
+func (app *application) EnableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Code string `json:"code"`
+	}
+	if err := app.readJSON(w, r, &payload); err != nil {
+		app.errorLog.Println(err)
+		app.BadRequest(w, r, err)
+		return
+	}
+
+	// re-read the user to get the secret saved on setup
+	user, err := app.DB.GetUserByID(app.authenticatedUser(r).ID)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.internalError(w)
+		return
+	}
+	codes, ok, err := app.DB.EnableTwoFactor(user, payload.Code, app.config.keys)
+	if errors.Is(err, models.ErrTwoFactorEnabled) || errors.Is(err, models.ErrTwoFactorNotStarted) {
+		app.BadRequest(w, r, err)
+		return
+	}
+	if err != nil {
+		app.errorLog.Println(err)
+		app.internalError(w)
+		return
+	}
+	if !ok {
+		app.BadRequest(w, r, errors.New("invalid two-factor authentication code"))
+		return
+	}
+
+	app.writeJson(w, http.StatusOK, struct {
+		responsePayload
+		RecoveryCodes []string `json:"recovery_codes"`
+	}{
+		responsePayload: responsePayload{Error: false, Message: "Two-factor authentication enabled"},
+		RecoveryCodes:   codes,
+	})
+}
+
+// ResetTwoFactor disables two-factor authentication of a user who lost access to authenticator app
+func (app *application) ResetTwoFactor(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	userID, err := strconv.Atoi(id)
+	if err != nil {
+		e := fmt.Errorf("error converting user id to int: %w", err)
+		app.errorLog.Println(e)
+		app.BadRequest(w, r, e)
+		return
+	}
+	before, err := app.DB.GetUserByID(userID)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.BadRequest(w, r, errors.New("user not found"))
+		return
+	}
+	if err = app.DB.ResetTwoFactor(userID); err != nil {
+		app.errorLog.Println(err)
+		app.internalError(w)
+		return
+	}
+	after := before
+	after.TOTPEnabled = false
+	app.audit(r, models.AuditResetTwoFactor, models.AuditEntityUser, userID, before, after)
+	app.writeJson(w, http.StatusOK, responsePayload{Error: false, Message: "Two-factor authentication reset"})
+}
+
+func (app *application) AllRoles(w http.ResponseWriter, r *http.Request) {
+	roles, err := app.DB.GetAllRoles()
+	if err != nil {
+		app.errorLog.Println(err)
+		app.internalError(w)
+		return
+	}
+	app.writeJson(w, http.StatusOK, roles)
+}
+
+func (app *application) AllAuditEvents(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		paginationRequest
+		models.AuditFilter
+	}
+	err := app.readJSON(w, r, &req)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.BadRequest(w, r, fmt.Errorf("incorrect search data; %w", err))
+		return
+	}
+	events, count, err := app.DB.SearchAuditEvents(req.AuditFilter, req.PageSize, req.CurrentPage)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.internalError(w)
+		return
+	}
+	resp := paginatedResponse[models.AuditEvent]{
+		paginationRequest: req.paginationRequest,
+		LastPage:          lastPageNo(count, req.PageSize),
+		TotalRecords:      count,
+		PageData:          events,
+	}
+	app.writeJson(w, http.StatusOK, resp)
+}
+
 func (app *application) SaveCustomer(firstName, lastName, email string) (int, error) {
 	customer := models.Customer{
 		FirstName: firstName,
 		LastName:  lastName,
 		Email:     email,
 	}
-	return app.DB.InsertCustomer(customer)
+	return app.DB.FindOrInsertCustomer(customer)
 }
 
 func (app *application) SaveTransaction(txn models.Transaction) (int, error) {
 	return app.DB.InsertTransaction(txn)
 }
 
-func (app *application) SaveOrder(order models.Order) (int, error) {
-	return app.DB.InsertOrder(order)
-}
-
 func lastPageNo(recordCount, pageSize int) int {
 	lastNo := recordCount / pageSize
 	if recordCount%pageSize > 0 {
@@ -835,24 +1503,3 @@ func lastPageNo(recordCount, pageSize int) int {
 	}
 	return lastNo
 }
-
-func (app *application) callInvoiceMicro(inv common_models.Order) error {
-	url := "http://localhost:5000/invoice/create-and-send"
-	out, err := json.MarshalIndent(inv, "", "  ")
-	if err != nil {
-		return fmt.Errorf("error marshalling invoice: %w", err)
-	}
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(out))
-	if err != nil {
-		return fmt.Errorf("error creating request: %w", err)
-	}
-	req.Header.Set("Content-Type", "application/json")
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return fmt.Errorf("error calling invoice microservice: %w", err)
-	}
-	defer resp.Body.Close()
-	app.infoLog.Println(resp.Body)
-	return nil
-}
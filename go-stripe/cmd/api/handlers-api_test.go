@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/lockout"
+	"github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/models"
+)
+
+func Test_CheckAPIKeyIP(t *testing.T) {
+	proxies, err := lockout.ParseProxies("10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var app application
+	app.config.security.trustedProxies = proxies
+	key := &models.APIKey{Name: "erp", AllowedIPs: "203.0.113.7"}
+
+	tests := []struct {
+		name, remoteAddr, forwardedFor string
+		allowed                        bool
+	}{
+		{"allowed client", "203.0.113.7:51000", "", true},
+		{"other client", "198.51.100.1:51000", "", false},
+		{"other client spoofing header", "198.51.100.1:51000", "203.0.113.7", false},
+		{"allowed client behind proxy", "10.0.0.1:443", "203.0.113.7", true},
+		{"other client spoofing header behind proxy", "10.0.0.1:443", "203.0.113.7, 198.51.100.1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/api/admin/all-sales", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.forwardedFor != "" {
+				r.Header.Set("X-Forwarded-For", tt.forwardedFor)
+			}
+			if err := app.checkAPIKeyIP(r, key); (err == nil) != tt.allowed {
+				t.Errorf("expected allowed to be %v but got error %v", tt.allowed, err)
+			}
+		})
+	}
+}
@@ -5,8 +5,11 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
+	"strconv"
 
+	"github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/lockout"
 	"github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/models"
 	"golang.org/x/crypto/bcrypt"
 )
@@ -96,6 +99,68 @@ func (app *application) invalidCredentials(w http.ResponseWriter) error {
 	return app.writeJson(w, http.StatusUnauthorized, payload)
 }
 
+func (app *application) twoFactorRequired(w http.ResponseWriter, message string) error {
+	var payload struct {
+		responsePayload
+		TwoFactorRequired bool `json:"two_factor_required"`
+	}
+	payload.Error = true
+	payload.Message = message
+	payload.TwoFactorRequired = true
+
+	return app.writeJson(w, http.StatusUnauthorized, payload)
+}
+
+func (app *application) tooManyRequests(w http.ResponseWriter, err *lockout.ThrottledError) error {
+	payload := responsePayload{
+		Error:   true,
+		Message: err.Error(),
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(err.RetryAfter.Seconds()))))
+	return app.writeJson(w, http.StatusTooManyRequests, payload)
+}
+
+// clientIP returns address of the client, taken from X-Forwarded-For header only behind trusted proxies
+func (app *application) clientIP(r *http.Request) string {
+	return app.config.security.trustedProxies.ClientIP(r)
+}
+
+// checkThrottle writes an error response and returns false if the action is not allowed
+// for the account or from client's address yet
+func (app *application) checkThrottle(w http.ResponseWriter, r *http.Request, action, email string) bool {
+	ip := app.clientIP(r)
+	err := app.guard.Check(action, email, ip)
+	var throttled *lockout.ThrottledError
+	if errors.As(err, &throttled) {
+		app.infoLog.Printf("Throttled %s attempt for %q from %s\n", action, email, ip)
+		app.tooManyRequests(w, throttled)
+		return false
+	}
+	if err != nil {
+		app.errorLog.Println(err)
+		app.internalError(w)
+		return false
+	}
+	return true
+}
+
+// throttleFailure counts failed attempt of the action for the account and client's address
+func (app *application) throttleFailure(r *http.Request, action, email string) {
+	if err := app.guard.Fail(action, email, app.clientIP(r)); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+func (app *application) forbidden(w http.ResponseWriter) error {
+	payload := responsePayload{
+		Error:   true,
+		Message: "you do not have permission to perform this action",
+	}
+
+	return app.writeJson(w, http.StatusForbidden, payload)
+}
+
 func (app *application) internalError(w http.ResponseWriter) error {
 	payload := responsePayload{
 		Error:   true,
@@ -124,3 +189,29 @@ func (app *application) failedValidation(w http.ResponseWriter, r *http.Request,
 	}
 	app.writeJson(w, http.StatusUnprocessableEntity, payload)
 }
+
+// authenticatedUser returns user put into request's context by Auth middleware
+func (app *application) authenticatedUser(r *http.Request) *models.User {
+	user, ok := r.Context().Value(userContextKey).(*models.User)
+	if !ok {
+		return nil
+	}
+	return user
+}
+
+// audit writes privileged action performed by authenticated user to the audit log.
+// Errors are only logged because the action itself has already been performed by then
+func (app *application) audit(r *http.Request, action, entity string, entityID int, before, after any) {
+	userID := 0
+	if user := app.authenticatedUser(r); user != nil {
+		userID = user.ID
+	}
+	event, err := models.NewAuditEvent(userID, action, entity, entityID, before, after, app.clientIP(r))
+	if err != nil {
+		app.errorLog.Println(err)
+		return
+	}
+	if _, err = app.DB.InsertAuditEvent(event); err != nil {
+		app.errorLog.Println(err)
+	}
+}
@@ -1,72 +1,14 @@
 package main
 
 import (
-	"bytes"
 	"embed"
-	"fmt"
-	"html/template"
-	"strings"
-	"time"
-
-	mail "github.com/xhit/go-simple-mail/v2"
 )
 
 //go:embed templates
 var emailTemplateFS embed.FS
 
 func (app *application) SendMail(from, to, subject, tmpl string, data any) error {
-	templateToRender := fmt.Sprintf("templates/%s.html.tmpl", tmpl)
-
-	t, err := template.New("email-html").ParseFS(emailTemplateFS, templateToRender)
-	if err != nil {
-		app.errorLog.Println(err)
-		return err
-	}
-
-	var tpl bytes.Buffer
-	if err = t.ExecuteTemplate(&tpl, "body", data); err != nil {
-		app.errorLog.Println(err)
-		return err
-	}
-
-	formattedMessage := tpl.String()
-
-	templateToRender = fmt.Sprintf("templates/%s.plain.tmpl", tmpl)
-	t, err = template.New("email-plain").ParseFS(emailTemplateFS, templateToRender)
-	if err != nil {
-		app.errorLog.Println(err)
-		return err
-	}
-	if err = t.ExecuteTemplate(&tpl, "body", data); err != nil {
-		app.errorLog.Println(err)
-		return err
-	}
-
-	plainMessage := tpl.String()
-
-	// send the mail
-	server := mail.NewSMTPClient()
-	server.Host = app.config.smtp.host
-	server.Port = app.config.smtp.port
-	if len(strings.Replace(app.config.smtp.username, " ", "", -1)) > 0 {
-		server.Username = app.config.smtp.username
-		server.Password = app.config.smtp.password
-	}
-	server.Encryption = mail.EncryptionTLS
-	server.KeepAlive = false
-	server.ConnectTimeout = 10 * time.Second
-	server.SendTimeout = 10 * time.Second
-	smtpClient, err := server.Connect()
-	if err != nil {
-		app.errorLog.Println(err)
-		return err
-	}
-	email := mail.NewMSG()
-	email.SetFrom(from).AddTo(to).SetSubject(subject).
-		SetBody(mail.TextHTML, formattedMessage).
-		AddAlternative(mail.TextPlain, plainMessage)
-
-	err = email.Send(smtpClient)
+	err := app.mailer.Send(from, to, subject, tmpl, data)
 	if err != nil {
 		app.errorLog.Println(err)
 		return err
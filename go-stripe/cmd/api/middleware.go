@@ -1,14 +1,96 @@
 package main
 
-import "net/http"
+import (
+	"context"
+	"net/http"
 
+	"github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/models"
+)
+
+type contextKey string
+
+const (
+	userContextKey   = contextKey("user")
+	tokenContextKey  = contextKey("token")
+	apiKeyContextKey = contextKey("api-key")
+)
+
+// Auth allows requests authenticated by tokens obtained by logging in
 func (app *application) Auth(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		_, err := app.authenticateToken(r)
-		if err != nil {
-			app.invalidCredentials(w)
-			return
+	return app.AuthWithScope()(next)
+}
+
+// AuthWithScope allows requests authenticated by tokens obtained by logging in
+// as well as by tokens and API keys having any of the scopes
+func (app *application) AuthWithScope(scopes ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var user *models.User
+			var credential interface{ HasScope(string) bool }
+			ctx := r.Context()
+			if key := apiKeyFromRequest(r); key != "" {
+				u, apiKey, err := app.authenticateAPIKey(r, key)
+				if err != nil {
+					app.errorLog.Println(err)
+					app.invalidCredentials(w)
+					return
+				}
+				user, credential = u, apiKey
+				ctx = context.WithValue(ctx, apiKeyContextKey, apiKey)
+			} else {
+				u, token, err := app.authenticateToken(r)
+				if err != nil {
+					app.invalidCredentials(w)
+					return
+				}
+				user, credential = u, token
+				ctx = context.WithValue(ctx, tokenContextKey, token)
+			}
+
+			if !scopeAllowed(credential, scopes) {
+				app.forbidden(w)
+				return
+			}
+			ctx = context.WithValue(ctx, userContextKey, user)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// scopeAllowed checks if the credential has authentication scope or any of the scopes
+func scopeAllowed(credential interface{ HasScope(string) bool }, scopes []string) bool {
+	if credential.HasScope(models.ScopeAuthentication) {
+		return true
+	}
+	for _, scope := range scopes {
+		if credential.HasScope(scope) {
+			return true
 		}
-		next.ServeHTTP(w, r)
-	})
+	}
+	return false
+}
+
+// RequirePermission allows request only if authenticated user's role grants the permission.
+// It must be used after Auth middleware
+func (app *application) RequirePermission(permission string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user := app.authenticatedUser(r)
+			if user == nil {
+				app.invalidCredentials(w)
+				return
+			}
+			allowed, err := app.DB.HasPermission(user.ID, permission)
+			if err != nil {
+				app.errorLog.Println(err)
+				app.internalError(w)
+				return
+			}
+			if !allowed {
+				app.forbidden(w)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
 }
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/models"
+)
+
+func Test_ScopeAllowed(t *testing.T) {
+	reporting := []string{models.ScopeReporting}
+	refunds := []string{models.ScopeRefunds}
+
+	tests := []struct {
+		name       string
+		credential interface{ HasScope(string) bool }
+		scopes     []string
+		allowed    bool
+	}{
+		{"authentication token on authenticated route", &models.Token{Scope: models.ScopeAuthentication}, nil, true},
+		{"authentication token on reporting route", &models.Token{Scope: models.ScopeAuthentication}, reporting, true},
+		{"authentication token on refunds route", &models.Token{Scope: models.ScopeAuthentication}, refunds, true},
+		{"reporting token on reporting route", &models.Token{Scope: models.ScopeReporting}, reporting, true},
+		{"reporting token on refunds route", &models.Token{Scope: models.ScopeReporting}, refunds, false},
+		{"reporting token on authenticated route", &models.Token{Scope: models.ScopeReporting}, nil, false},
+		{"token with both scopes on refunds route", &models.Token{Scope: "reporting refunds"}, refunds, true},
+		{"reporting API key on reporting route", &models.APIKey{Scope: models.ScopeReporting}, reporting, true},
+		{"reporting API key on refunds route", &models.APIKey{Scope: models.ScopeReporting}, refunds, false},
+		{"API key with both scopes on refunds route", &models.APIKey{Scope: "reporting refunds"}, refunds, true},
+		{"API key on authenticated route", &models.APIKey{Scope: "reporting refunds"}, nil, false},
+		{"API key without scopes", &models.APIKey{}, reporting, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if allowed := scopeAllowed(tt.credential, tt.scopes); allowed != tt.allowed {
+				t.Errorf("expected allowed to be %v but got %v", tt.allowed, allowed)
+			}
+		})
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/cards"
+	common_models "github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/common"
+	"github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/models"
+	"github.com/stripe/stripe-go/v74"
+	"github.com/stripe/stripe-go/v74/webhook"
+	"gorm.io/gorm"
+)
+
+// maxWebhookBytes limits size of Stripe events
+const maxWebhookBytes = 65536
+
+// StripeWebhook records subscription renewals reported by Stripe's invoice.paid events. Events must
+// be signed with webhook's secret; other events are acknowledged and ignored. Errors make Stripe
+// send the event again
+func (app *application) StripeWebhook(w http.ResponseWriter, r *http.Request) {
+	if app.config.stripe.webhookSecret == "" {
+		app.writeJson(w, http.StatusNotFound, responsePayload{Error: true, Message: "Stripe webhooks are not configured."})
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookBytes))
+	if err != nil {
+		app.BadRequest(w, r, fmt.Errorf("error reading Stripe event: %w", err))
+		return
+	}
+	event, err := webhook.ConstructEventWithOptions(body, r.Header.Get("Stripe-Signature"), app.config.stripe.webhookSecret,
+		webhook.ConstructEventOptions{IgnoreAPIVersionMismatch: true})
+	if err != nil {
+		app.errorLog.Println(fmt.Errorf("error verifying Stripe event: %w", err))
+		app.BadRequest(w, r, errors.New("invalid Stripe event signature"))
+		return
+	}
+	ack := responsePayload{Error: false, Message: "Event received."}
+	if event.Type != "invoice.paid" {
+		app.writeJson(w, http.StatusOK, ack)
+		return
+	}
+
+	var inv stripe.Invoice
+	if err = json.Unmarshal(event.Data.Raw, &inv); err != nil {
+		app.BadRequest(w, r, fmt.Errorf("error decoding Stripe invoice: %w", err))
+		return
+	}
+	// the first charge is invoiced when subscription is created
+	if inv.BillingReason != stripe.InvoiceBillingReasonSubscriptionCycle || inv.Subscription == nil {
+		app.writeJson(w, http.StatusOK, ack)
+		return
+	}
+	start, end, ok := subscriptionPeriod(&inv)
+	if !ok {
+		app.BadRequest(w, r, fmt.Errorf("Stripe invoice %s has no billing period", inv.ID))
+		return
+	}
+	order, err := app.DB.GetOrderBySubscription(inv.Subscription.ID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		app.infoLog.Printf("Ignored Stripe invoice %s of unknown subscription %s\n", inv.ID, inv.Subscription.ID)
+		app.writeJson(w, http.StatusOK, ack)
+		return
+	}
+	if err != nil {
+		app.errorLog.Println(err)
+		app.internalError(w)
+		return
+	}
+	err = app.renewSubscription(order, &inv, start, end)
+	if err != nil && !errors.Is(err, models.ErrRenewalRecorded) {
+		app.errorLog.Println(err)
+		app.internalError(w)
+		return
+	}
+	app.writeJson(w, http.StatusOK, ack)
+}
+
+// subscriptionPeriod returns period paid by Stripe invoice, which is the period of its subscription line
+func subscriptionPeriod(inv *stripe.Invoice) (time.Time, time.Time, bool) {
+	if inv.Lines == nil {
+		return time.Time{}, time.Time{}, false
+	}
+	for _, line := range inv.Lines.Data {
+		if line.Period != nil && line.Period.End > line.Period.Start {
+			return time.Unix(line.Period.Start, 0), time.Unix(line.Period.End, 0), true
+		}
+	}
+	return time.Time{}, time.Time{}, false
+}
+
+// runRenewals renews subscriptions whose paid period has ended, until the context is done. It is
+// used where Stripe webhooks can not reach the API; plans are billed monthly
+func (app *application) runRenewals(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		app.renewDueSubscriptions()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// renewDueSubscriptions renews each due subscription for the period paid by its latest Stripe
+// invoice. Subscriptions whose latest invoice is not paid yet, or has been recorded already, are
+// tried again on the next runs
+func (app *application) renewDueSubscriptions() {
+	ids, err := app.DB.GetDueSubscriptions(time.Now())
+	if err != nil {
+		app.errorLog.Println(err)
+		return
+	}
+	card := cards.Card{Secret: app.config.stripe.secret}
+	for _, id := range ids {
+		order, err := app.DB.GetOrder(id)
+		if err != nil {
+			app.errorLog.Println(err)
+			continue
+		}
+		// subscription id is kept as payment intent of order's first transaction
+		inv, err := card.GetLatestInvoice(order.Transaction.PaymentIntent)
+		if err != nil {
+			app.errorLog.Println(err)
+			continue
+		}
+		if inv.Status != stripe.InvoiceStatusPaid {
+			app.infoLog.Printf("Subscription of order %d is due, but its Stripe invoice %s is %s\n", order.ID, inv.ID, inv.Status)
+			continue
+		}
+		start, end, ok := subscriptionPeriod(inv)
+		if !ok {
+			app.errorLog.Printf("Stripe invoice %s has no billing period\n", inv.ID)
+			continue
+		}
+		err = app.renewSubscription(order, inv, start, end)
+		if err != nil && !errors.Is(err, models.ErrRenewalRecorded) {
+			app.errorLog.Println(err)
+		}
+	}
+}
+
+// renewSubscription records charge of Stripe invoice renewing subscription of the order for the period
+// and has it invoiced by microservice
+func (app *application) renewSubscription(order models.Order, inv *stripe.Invoice, start, end time.Time) error {
+	txn := renewalTransaction(order, inv, start, end)
+	_, err := app.DB.InsertRenewal(order.ID, txn, models.OutboxTopicInvoice, func(txnID int) any {
+		return renewalInvoiceRequest(order, txn, txnID)
+	})
+	if err != nil {
+		return err
+	}
+	app.infoLog.Printf("Renewed subscription of order %d for %s - %s\n", order.ID, start.Format("2006-01-02"), end.Format("2006-01-02"))
+	return nil
+}
+
+// renewalTransaction makes charge of the amount paid by Stripe invoice for the period. Card details
+// are those of the first charge of the order
+func renewalTransaction(order models.Order, inv *stripe.Invoice, start, end time.Time) models.Transaction {
+	stripeInvoiceID := inv.ID
+	return models.Transaction{
+		Amount:              int(inv.AmountPaid),
+		Currency:            string(inv.Currency),
+		LastFour:            order.Transaction.LastFour,
+		ExpiryMonth:         order.Transaction.ExpiryMonth,
+		ExpiryYear:          order.Transaction.ExpiryYear,
+		PaymentIntent:       order.Transaction.PaymentIntent,
+		PaymentMethod:       order.Transaction.PaymentMethod,
+		TransactionStatusID: 2,
+		StripeInvoiceID:     &stripeInvoiceID,
+		PeriodStart:         &start,
+		PeriodEnd:           &end,
+	}
+}
+
+// renewalInvoiceRequest makes request to invoice the renewal charge recorded with the id
+func renewalInvoiceRequest(order models.Order, txn models.Transaction, txnID int) common_models.Order {
+	return common_models.Order{
+		ID:            order.ID,
+		TransactionID: txnID,
+		Amount:        txn.Amount,
+		Currency:      txn.Currency,
+		Items: []common_models.OrderItem{
+			{Product: fmt.Sprintf("%s subscription", order.Widget.Name), Quantity: 1, UnitPrice: txn.Amount},
+		},
+		FirstName:   order.Customer.FirstName,
+		LastName:    order.Customer.LastName,
+		Email:       order.Customer.Email,
+		PeriodStart: txn.PeriodStart,
+		PeriodEnd:   txn.PeriodEnd,
+		Locale:      order.Locale,
+		Brand:       order.Widget.Brand,
+		CreatedAt:   time.Now(),
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/models"
+	"github.com/stripe/stripe-go/v74"
+	"github.com/stripe/stripe-go/v74/webhook"
+)
+
+const testWebhookSecret = "whsec_test"
+
+// paidInvoice returns paid Stripe invoice renewing subscription for a month from the start
+func paidInvoice(id string, start time.Time, amount int64) *stripe.Invoice {
+	return &stripe.Invoice{
+		ID:            id,
+		Status:        stripe.InvoiceStatusPaid,
+		BillingReason: stripe.InvoiceBillingReasonSubscriptionCycle,
+		Subscription:  &stripe.Subscription{ID: "sub_1"},
+		AmountPaid:    amount,
+		Currency:      "usd",
+		Lines: &stripe.InvoiceLineItemList{Data: []*stripe.InvoiceLineItem{
+			{Period: &stripe.Period{Start: start.Unix(), End: start.AddDate(0, 1, 0).Unix()}},
+		}},
+	}
+}
+
+// eventBody returns Stripe event of the type carrying the invoice, as it is sent to webhooks
+func eventBody(eventType string, inv *stripe.Invoice) []byte {
+	lines := ""
+	for i, l := range inv.Lines.Data {
+		if i > 0 {
+			lines += ","
+		}
+		lines += fmt.Sprintf(`{"object":"line_item","period":{"start":%d,"end":%d}}`, l.Period.Start, l.Period.End)
+	}
+	return []byte(fmt.Sprintf(`{"id":"evt_1","object":"event","api_version":"2020-08-27","type":%q,"data":{"object":`+
+		`{"id":%q,"object":"invoice","status":%q,"billing_reason":%q,"subscription":%q,"amount_paid":%d,"currency":%q,`+
+		`"lines":{"object":"list","data":[%s]}}}}`,
+		eventType, inv.ID, inv.Status, inv.BillingReason, inv.Subscription.ID, inv.AmountPaid, inv.Currency, lines))
+}
+
+// postEvent posts the body to the webhook signed with the secret and returns response status
+func postEvent(app *application, body []byte, secret string) int {
+	now := time.Now()
+	signature := hex.EncodeToString(webhook.ComputeSignature(now, body, secret))
+	r := httptest.NewRequest("POST", "/api/webhooks/stripe", bytes.NewReader(body))
+	r.Header.Set("Stripe-Signature", fmt.Sprintf("t=%d,v1=%s", now.Unix(), signature))
+	w := httptest.NewRecorder()
+	app.StripeWebhook(w, r)
+	return w.Code
+}
+
+// Test_StripeWebhook covers events that are answered before any order is looked up; recording
+// renewals is tested with DB in models
+func Test_StripeWebhook(t *testing.T) {
+	app := &application{
+		infoLog:  log.New(io.Discard, "", 0),
+		errorLog: log.New(io.Discard, "", 0),
+	}
+	app.config.stripe.webhookSecret = testWebhookSecret
+	periodEnd := time.Date(2023, 5, 1, 0, 0, 0, 0, time.UTC)
+
+	firstCharge := paidInvoice("in_1", periodEnd, 1000)
+	firstCharge.BillingReason = stripe.InvoiceBillingReasonSubscriptionCreate
+	noPeriod := paidInvoice("in_2", periodEnd, 1200)
+	noPeriod.Lines.Data[0].Period.End = noPeriod.Lines.Data[0].Period.Start
+
+	tests := []struct {
+		name   string
+		body   []byte
+		secret string
+		status int
+	}{
+		{"invalid signature", eventBody("invoice.paid", paidInvoice("in_2", periodEnd, 1200)), "whsec_other", http.StatusBadRequest},
+		{"other event", eventBody("invoice.finalized", paidInvoice("in_2", periodEnd, 1200)), testWebhookSecret, http.StatusOK},
+		{"first charge", eventBody("invoice.paid", firstCharge), testWebhookSecret, http.StatusOK},
+		{"no billing period", eventBody("invoice.paid", noPeriod), testWebhookSecret, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code := postEvent(app, tt.body, tt.secret); code != tt.status {
+				t.Errorf("expected status %d but got %d", tt.status, code)
+			}
+		})
+	}
+}
+
+func Test_RenewalTransaction(t *testing.T) {
+	periodEnd := time.Date(2023, 5, 1, 0, 0, 0, 0, time.UTC)
+	order := models.Order{
+		DBEntity:    models.DBEntity{ID: 7},
+		Amount:      1000,
+		Widget:      models.Widget{Name: "Bronze Plan"},
+		Transaction: models.Transaction{PaymentIntent: "sub_1", Currency: "usd", LastFour: "4242"},
+		Customer:    models.Customer{FirstName: "Jane", LastName: "Doe", Email: "jane@example.com"},
+	}
+	inv := paidInvoice("in_2", periodEnd, 1200)
+	start, end, ok := subscriptionPeriod(inv)
+	if !ok {
+		t.Fatal("expected Stripe invoice to have billing period")
+	}
+
+	// amount and period are the ones of Stripe invoice, not of the order
+	txn := renewalTransaction(order, inv, start, end)
+	if *txn.StripeInvoiceID != "in_2" || txn.Amount != 1200 || txn.LastFour != "4242" ||
+		!txn.PeriodStart.Equal(periodEnd) || !txn.PeriodEnd.Equal(periodEnd.AddDate(0, 1, 0)) {
+		t.Errorf("unexpected renewal %+v", txn)
+	}
+	p := renewalInvoiceRequest(order, txn, 100)
+	if p.ID != 7 || p.TransactionID != 100 || p.Amount != 1200 || p.Email != "jane@example.com" ||
+		len(p.Items) != 1 || p.Items[0].Product != "Bronze Plan subscription" ||
+		p.PeriodStart == nil || !p.PeriodStart.Equal(periodEnd) {
+		t.Errorf("unexpected invoice request %+v", p)
+	}
+}
@@ -3,44 +3,83 @@ package main
 import (
 	"net/http"
 
+	"github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/middleware"
+	"github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/models"
 	"github.com/go-chi/chi/v5"
-	"github.com/go-chi/cors"
 )
 
 func (app *application) routes() http.Handler {
 	mux := chi.NewRouter()
 
-	mux.Use(cors.Handler(cors.Options{
-		AllowedOrigins:   []string{"https://*", "http://*"},
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
-		AllowCredentials: false,
-		MaxAge:           300,
+	mux.Use(middleware.SecurityHeaders(middleware.Options{
+		Policy:     middleware.APIPolicy(),
+		ReportOnly: app.config.security.cspReportOnly,
+		ReportURI:  app.config.security.cspReportURI,
+		HSTS:       app.config.env == "production",
 	}))
+	mux.Use(middleware.CORS(app.config.security.corsOrigins))
 
 	mux.Post("/api/payment-intent", app.GetPaymentIntent)
 	mux.Get("/api/widget/{id}", app.GetWidgetById)
 	mux.Post("/create-customer-and-subscribe-to-plan", app.CreateCustomerAndSubscribeToPlan)
+	mux.Post("/api/webhooks/stripe", app.StripeWebhook)
 
 	mux.Post("/api/authenticate", app.CreateAuthToken)
 	mux.Post("/api/is-authenticated", app.CheckAuthentication)
+	mux.With(app.Auth).Post("/api/logout", app.Logout)
 	mux.Post("/api/forgot-password", app.SendPasswordResetEmail)
 	mux.Post("/api/reset-password", app.ResetPassword)
 
 	mux.Route("/api/admin", func(mux chi.Router) {
-		mux.Use(app.Auth)
-
-		mux.Post("/virtual-terminal-succeeded", app.VitrualTerminalPaymentSucceeded)
-		mux.Post("/all-sales", app.AllSales)
-		mux.Post("/all-subscriptions", app.AllSubscriptions)
-		mux.Post("/get-sale/{id}", app.GetSale)
-		mux.Post("/refund", app.RefundCharge)
-		mux.Post("/cancel-subscription", app.CancelSubscription)
-
-		mux.Post("/all-users", app.AllUsers)
-		mux.Post("/all-users/{id}", app.OneUser)
-		mux.Post("/all-users/edit/{id}", app.EditUser)
-		mux.Post("/all-users/delete/{id}", app.DeleteUser)
+		// routes available to tokens issued for reporting
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.AuthWithScope(models.ScopeReporting))
+
+			mux.With(app.RequirePermission(models.PermViewSales)).Post("/all-sales", app.AllSales)
+			mux.With(app.RequirePermission(models.PermViewSales)).Post("/all-subscriptions", app.AllSubscriptions)
+			mux.With(app.RequirePermission(models.PermViewSales)).Post("/get-sale/{id}", app.GetSale)
+		})
+
+		// routes available to tokens issued for refunds
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.AuthWithScope(models.ScopeRefunds))
+
+			mux.With(app.RequirePermission(models.PermRefund)).Post("/refund", app.RefundCharge)
+			mux.With(app.RequirePermission(models.PermCancelSubscription)).Post("/cancel-subscription", app.CancelSubscription)
+		})
+
+		// routes available only to tokens obtained by logging in
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.Auth)
+
+			mux.Post("/tokens", app.AllTokens)
+			mux.Post("/tokens/issue", app.IssueToken)
+			mux.Post("/tokens/revoke/{id}", app.RevokeToken)
+			mux.Post("/2fa/setup", app.SetupTwoFactor)
+			mux.Post("/2fa/enable", app.EnableTwoFactor)
+
+			mux.With(app.RequirePermission(models.PermVirtualTerminal)).Post("/virtual-terminal-succeeded", app.VitrualTerminalPaymentSucceeded)
+
+			mux.With(app.RequirePermission(models.PermViewUsers)).Post("/all-users", app.AllUsers)
+			mux.With(app.RequirePermission(models.PermViewUsers)).Post("/all-users/{id}", app.OneUser)
+			mux.With(app.RequirePermission(models.PermManageUsers)).Post("/all-users/edit/{id}", app.EditUser)
+			mux.With(app.RequirePermission(models.PermManageUsers)).Post("/all-users/delete/{id}", app.DeleteUser)
+			mux.With(app.RequirePermission(models.PermManageUsers)).Post("/all-users/reset-2fa/{id}", app.ResetTwoFactor)
+			mux.With(app.RequirePermission(models.PermManageUsers)).Post("/all-users/unlock/{id}", app.UnlockUser)
+			mux.With(app.RequirePermission(models.PermViewUsers)).Post("/roles", app.AllRoles)
+
+			mux.With(app.RequirePermission(models.PermViewAuditLog)).Post("/audit-events", app.AllAuditEvents)
+
+			mux.With(app.RequirePermission(models.PermManageAPIKeys)).Post("/api-keys", app.AllAPIKeys)
+			mux.With(app.RequirePermission(models.PermManageAPIKeys)).Post("/api-keys/create", app.CreateAPIKey)
+			mux.With(app.RequirePermission(models.PermManageAPIKeys)).Post("/api-keys/revoke/{id}", app.RevokeAPIKey)
+			mux.With(app.RequirePermission(models.PermManageSessions)).Post("/sessions", app.AllSessions)
+			mux.With(app.RequirePermission(models.PermManageSessions)).Post("/sessions/revoke/{id}", app.RevokeSession)
+			mux.With(app.RequirePermission(models.PermManageOutbox)).Post("/outbox", app.AllOutboxMessages)
+			mux.With(app.RequirePermission(models.PermManageOutbox)).Post("/outbox/retry/{id}", app.RetryOutboxMessage)
+			mux.With(app.RequirePermission(models.PermManageOutbox)).Post("/invoice-jobs", app.AllFailedInvoiceJobs)
+			mux.With(app.RequirePermission(models.PermManageOutbox)).Post("/invoice-jobs/retry/{id}", app.RetryInvoiceJob)
+		})
 	})
 
 	return mux
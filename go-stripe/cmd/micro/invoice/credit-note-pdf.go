@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+
+	common_models "github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/common"
+	"github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/models"
+	"github.com/phpdave11/gofpdf"
+)
+
+// creditNoteLayout renders credit note as a single negative line of the amount credited;
+// customer block and table are printed the same way as on invoices
+type creditNoteLayout struct {
+	*invoiceLayout
+	note models.CreditNote
+}
+
+func (app *application) createCreditNotePDF(tpl *invoiceTemplate, req common_models.CreditNote, note models.CreditNote, invoice models.Invoice) ([]byte, error) {
+	pdf := gofpdf.New("P", "mm", "Letter", "")
+	pdf.SetMargins(marginX, marginTop, marginX)
+	pdf.SetAutoPageBreak(false, 0)
+	pdf.AliasNbPages("")
+
+	l := &creditNoteLayout{
+		invoiceLayout: &invoiceLayout{
+			pdf: pdf,
+			tr:  pdf.UnicodeTranslatorFromDescriptor(""),
+			tpl: tpl,
+			order: common_models.Order{
+				ID:        note.OrderID,
+				Currency:  note.Currency,
+				FirstName: req.FirstName,
+				LastName:  req.LastName,
+				Email:     req.Email,
+			},
+			invoice: invoice,
+		},
+		note: note,
+	}
+	pdf.SetFooterFunc(l.footer)
+
+	description := tpl.text("refund_of_invoice", "number", invoice.Number)
+
+	pdf.AddPage()
+	l.header()
+	l.billTo()
+	l.tableHeader()
+	l.item(common_models.OrderItem{Product: description, Quantity: 1, UnitPrice: -note.Amount})
+	l.totals()
+
+	var buf bytes.Buffer
+	if err := pdf.Output(&buf); err != nil {
+		return nil, fmt.Errorf("error rendering credit note %s: %w", note.Number, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// header prints seller, credit note number and the invoice it credits
+func (l *creditNoteLayout) header() {
+	l.title(l.tpl.text("credit_note_title"))
+	l.details([][2]string{
+		{l.tpl.text("credit_note_number"), l.note.Number},
+		{l.tpl.text("issue_date"), l.tpl.formatDate(l.note.IssuedAt)},
+		{l.tpl.text("credits_invoice"), l.invoice.Number},
+		{l.tpl.text("invoice_date"), l.tpl.formatDate(l.invoice.IssuedAt)},
+		{l.tpl.text("order"), fmt.Sprintf("%d", l.note.OrderID)},
+	})
+}
+
+// totals prints the amount credited
+func (l *creditNoteLayout) totals() {
+	pdf := l.pdf
+	h := lineHeight + 2*rowPadding
+	l.ensureSpace(h, false)
+
+	l.font("B", l.tpl.Layout.TextSize)
+	pdf.SetX(marginX + colProduct + colQuantity)
+	pdf.CellFormat(colPrice, h, l.tr(l.tpl.text("total_credit")), "1", 0, "L", false, 0, "")
+	pdf.CellFormat(colAmount, h, l.money(-l.note.Amount), "1", 1, "R", false, 0, "")
+	l.font("", l.tpl.Layout.TextSize)
+}
+
+func (l *creditNoteLayout) footer() {
+	l.pageFooter(l.tpl.text("credit_note_footer", "number", l.note.Number))
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	common_models "github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/common"
+	"github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/models"
+)
+
+func Test_CreateCreditNotePDF(t *testing.T) {
+	app := &application{}
+	tpl := testTemplates(t).get("widgets", "en")
+	issued := time.Date(2023, 5, 19, 10, 0, 0, 0, time.UTC)
+	invoice := models.Invoice{OrderID: 42, Number: "2023-000007", Currency: "usd", Total: 21235, IssuedAt: issued}
+	// amount returned is credited, not the total of the invoice
+	note := models.CreditNote{InvoiceID: invoice.ID, OrderID: 42, Number: "CN-2023-000001", Reason: common_models.CreditNoteReasonRefund,
+		Currency: "usd", Amount: 19999, IssuedAt: issued.AddDate(0, 0, 3)}
+	req := common_models.CreditNote{OrderID: 42, TransactionID: 7, Amount: 19999, FirstName: "Jane", LastName: "Doe", Email: "jane@example.com"}
+
+	doc, err := app.createCreditNotePDF(tpl, req, note, invoice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pages, text := pdfText(t, doc)
+	if pages != 1 {
+		t.Errorf("expected 1 page but got %d", pages)
+	}
+	for _, want := range []string{"(CN-2023-000001)", "(Refund of invoice 2023-000007)", "(-$199.99)"} {
+		if !strings.Contains(text, want) {
+			t.Errorf("expected %s in the document", want)
+		}
+	}
+	if strings.Contains(text, "($212.35)") || strings.Contains(text, "(-$212.35)") {
+		t.Error("expected total of the invoice not to be credited")
+	}
+}
@@ -6,7 +6,6 @@ import (
 	"fmt"
 	"io"
 	"net/http"
-	"os"
 )
 
 type responsePayload struct {
@@ -68,14 +67,3 @@ func (app *application) internalError(w http.ResponseWriter) error {
 	}
 	return app.writeJson(w, http.StatusInternalServerError, payload)
 }
-
-func (app *application) CreateDirIfNotExists(path string) error {
-	const mode = 0755
-	if _, err := os.Stat(path); os.IsNotExist(err) {
-		err := os.Mkdir(path, mode)
-		if err != nil {
-			return err
-		}
-	}
-	return nil
-}
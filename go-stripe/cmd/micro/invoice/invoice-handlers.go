@@ -1,16 +1,33 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
 
 	common_models "github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/common"
-	"github.com/phpdave11/gofpdf"
-	"github.com/phpdave11/gofpdf/contrib/gofpdi"
+	"github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/models"
+	"github.com/go-chi/chi/v5"
+	"gorm.io/gorm"
 )
 
+// maxBatchSize is the most invoices accepted by one batch request
+const maxBatchSize = 100
+
+type jobPayload struct {
+	responsePayload
+	JobID int `json:"job_id"`
+}
+
+type batchPayload struct {
+	responsePayload
+	JobIDs []int `json:"job_ids"`
+}
+
+// CreateAndSendInvoice accepts job to issue invoice for the order and send it to customer.
+// Responds with 202 and the job's id; the job's outcome is reported by GetJob
 func (app *application) CreateAndSendInvoice(w http.ResponseWriter, r *http.Request) {
-	// receive json
 	var order common_models.Order
 	err := app.readJSON(w, r, &order)
 	if err != nil {
@@ -18,61 +35,136 @@ func (app *application) CreateAndSendInvoice(w http.ResponseWriter, r *http.Requ
 		app.BadRequest(w, r, err)
 		return
 	}
-	// generate a pdf invoice
-	err = app.createInvoicePDF(order)
+	job, err := invoiceJob(order)
 	if err != nil {
-		app.errorLog.Println(err)
 		app.BadRequest(w, r, err)
 		return
 	}
-	// create mail
-	attachments := []string{fmt.Sprintf("./invoices/%d.pdf", order.ID)}
-	// send the mail with an attachment
-	err = app.SendMail("info@widgets.com", order.Email, "Your invoice", "invoice", attachments, nil)
+	app.acceptJob(w, job)
+}
+
+// CreateAndSendCreditNote accepts job to issue credit note for money returned on the charge
+// and send it to customer
+func (app *application) CreateAndSendCreditNote(w http.ResponseWriter, r *http.Request) {
+	var req common_models.CreditNote
+	err := app.readJSON(w, r, &req)
 	if err != nil {
 		app.errorLog.Println(err)
 		app.BadRequest(w, r, err)
 		return
 	}
-	// send response
-	resp := responsePayload{
-		Error:   false,
-		Message: fmt.Sprintf("Invoice %d.pdf has been created and sent to %s.", order.ID, order.Email),
+	if req.Reason != common_models.CreditNoteReasonRefund {
+		app.BadRequest(w, r, fmt.Errorf("unknown reason to credit invoice: %q", req.Reason))
+		return
+	}
+	if req.OrderID == 0 || req.TransactionID == 0 || req.Email == "" {
+		app.BadRequest(w, r, errors.New("order id, transaction id and customer's email are required"))
+		return
+	}
+	if req.Amount <= 0 {
+		app.BadRequest(w, r, fmt.Errorf("amount credited must be positive, got %d", req.Amount))
+		return
 	}
-	err = app.writeJson(w, http.StatusOK, resp)
+	job, err := models.NewInvoiceJob(models.InvoiceJobKindCreditNote, fmt.Sprintf("%s:%d", models.AuditEntityOrder, req.OrderID), req)
 	if err != nil {
 		app.errorLog.Println(err)
+		app.internalError(w)
+		return
 	}
+	app.acceptJob(w, job)
 }
 
-func (app *application) createInvoicePDF(order common_models.Order) error {
-	pdf := gofpdf.New("P", "mm", "Letter", "")
-	pdf.SetMargins(10, 13, 10)
-	pdf.SetAutoPageBreak(true, 0)
+// CreateAndSendInvoices accepts batch of invoice jobs; either all of them are accepted or none
+func (app *application) CreateAndSendInvoices(w http.ResponseWriter, r *http.Request) {
+	var batch struct {
+		Orders []common_models.Order `json:"orders"`
+	}
+	err := app.readJSON(w, r, &batch)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.BadRequest(w, r, err)
+		return
+	}
+	if len(batch.Orders) == 0 || len(batch.Orders) > maxBatchSize {
+		app.BadRequest(w, r, fmt.Errorf("batch must have from 1 to %d orders", maxBatchSize))
+		return
+	}
+	jobs := make([]models.InvoiceJob, 0, len(batch.Orders))
+	for i, order := range batch.Orders {
+		job, err := invoiceJob(order)
+		if err != nil {
+			app.BadRequest(w, r, fmt.Errorf("order %d of the batch: %w", i+1, err))
+			return
+		}
+		jobs = append(jobs, job)
+	}
+	ids, err := app.DB.InsertInvoiceJobs(jobs)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.internalError(w)
+		return
+	}
+	app.wakeJobs()
+	resp := batchPayload{
+		responsePayload: responsePayload{
+			Error:   false,
+			Message: fmt.Sprintf("%d invoices have been accepted.", len(ids)),
+		},
+		JobIDs: ids,
+	}
+	if err = app.writeJson(w, http.StatusAccepted, resp); err != nil {
+		app.errorLog.Println(err)
+	}
+}
 
-	importer := gofpdi.NewImporter()
-	t := importer.ImportPage(pdf, "./pdf-templates/invoice.pdf", 1, "/MediaBox")
-	pdf.AddPage()
-	importer.UseImportedTemplate(pdf, t, 0, 0, 215.9, 0)
-	// write info
-	pdf.SetY(50)
-	pdf.SetX(10)
-	pdf.SetFont("Times", "", 11)
-	pdf.CellFormat(97, 8, fmt.Sprintf("Attention: %s %s", order.FirstName, order.LastName), "", 0, "L", false, 0, "")
-	pdf.Ln(5)
-	pdf.CellFormat(97, 8, order.Email, "", 0, "L", false, 0, "")
-	pdf.Ln(5)
-	pdf.CellFormat(97, 8, order.CreatedAt.Format("2006-01-02"), "", 0, "L", false, 0, "")
+// GetJob reports status of the job, result of it once it has succeeded and the last error
+func (app *application) GetJob(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.BadRequest(w, r, fmt.Errorf("invalid job id: %w", err))
+		return
+	}
+	job, err := app.DB.GetInvoiceJob(id)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		app.writeJson(w, http.StatusNotFound, responsePayload{Error: true, Message: fmt.Sprintf("Job %d is not found.", id)})
+		return
+	}
+	if err != nil {
+		app.errorLog.Println(err)
+		app.internalError(w)
+		return
+	}
+	if err = app.writeJson(w, http.StatusOK, job); err != nil {
+		app.errorLog.Println(err)
+	}
+}
 
-	pdf.SetY(93)
-	pdf.SetX(58)
-	pdf.CellFormat(155, 8, order.Product, "", 0, "L", false, 0, "")
-	pdf.SetX(166)
-	pdf.CellFormat(20, 8, fmt.Sprintf("%d", order.Quantity), "", 0, "C", false, 0, "")
-	pdf.SetX(185)
-	pdf.CellFormat(20, 8, fmt.Sprintf("$%.2f", float32(order.Amount/100.0)), "", 0, "R", false, 0, "")
+// invoiceJob validates the order and makes job to invoice it
+func invoiceJob(order common_models.Order) (models.InvoiceJob, error) {
+	if order.ID == 0 || order.Email == "" {
+		return models.InvoiceJob{}, errors.New("order id and customer's email are required")
+	}
+	return models.NewInvoiceJob(models.InvoiceJobKindInvoice, fmt.Sprintf("%s:%d", models.AuditEntityOrder, order.ID), order)
+}
 
-	invoicePath := fmt.Sprintf("./invoices/%d.pdf", order.ID)
-	err := pdf.OutputFileAndClose(invoicePath)
-	return err
+// acceptJob queues the job and responds with 202 and the job's id
+func (app *application) acceptJob(w http.ResponseWriter, job models.InvoiceJob) {
+	ids, err := app.DB.InsertInvoiceJobs([]models.InvoiceJob{job})
+	if err != nil {
+		app.errorLog.Println(err)
+		app.internalError(w)
+		return
+	}
+	app.wakeJobs()
+	resp := jobPayload{
+		responsePayload: responsePayload{
+			Error:   false,
+			Message: fmt.Sprintf("The %s job has been accepted.", job.Kind),
+		},
+		JobID: ids[0],
+	}
+	headers := http.Header{"Location": {fmt.Sprintf("/invoice/jobs/%d", ids[0])}}
+	if err = app.writeJson(w, http.StatusAccepted, resp, headers); err != nil {
+		app.errorLog.Println(err)
+	}
 }
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	common_models "github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/common"
+	"github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/einvoice"
+	"github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/models"
+	"github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/outbox"
+	"github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/urlsigner"
+	mail "github.com/xhit/go-simple-mail/v2"
+	"gorm.io/gorm"
+)
+
+// Polling and retrying of invoice jobs
+const (
+	jobPollInterval = 5 * time.Second
+	jobRetryBase    = 30 * time.Second
+	jobRetryMax     = 30 * time.Minute
+	jobWaitInterval = time.Minute
+)
+
+// permanentError marks job failures retrying can not fix
+type permanentError struct {
+	error
+}
+
+func (e permanentError) Unwrap() error {
+	return e.error
+}
+
+// waitingError marks job failures caused by other job not finished yet; they do not use up attempts
+type waitingError struct {
+	error
+}
+
+func (e waitingError) Unwrap() error {
+	return e.error
+}
+
+// runJobs claims due jobs whenever a worker is free, until the context is done. Workers are
+// bounded by capacity of jobSlots; finished worker and newly accepted jobs wake the loop up
+func (app *application) runJobs(ctx context.Context) {
+	ticker := time.NewTicker(jobPollInterval)
+	defer ticker.Stop()
+	for {
+		app.claimJobs(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-app.jobWake:
+		}
+	}
+}
+
+// wakeJobs makes job loop claim jobs right away; it never blocks
+func (app *application) wakeJobs() {
+	select {
+	case app.jobWake <- struct{}{}:
+	default:
+	}
+}
+
+// claimJobs starts a worker per claimed job; no more jobs are claimed than there are free workers,
+// so taking a slot never blocks
+func (app *application) claimJobs(ctx context.Context) {
+	free := cap(app.jobSlots) - len(app.jobSlots)
+	if free == 0 {
+		return
+	}
+	jobs, err := app.DB.ClaimInvoiceJobs(free, 2*app.config.jobs.timeout)
+	if err != nil {
+		app.errorLog.Println(err)
+		return
+	}
+	for _, job := range jobs {
+		app.jobSlots <- struct{}{}
+		go func(job *models.InvoiceJob) {
+			defer func() {
+				<-app.jobSlots
+				app.wakeJobs()
+			}()
+			app.runJob(ctx, job)
+		}(job)
+	}
+}
+
+// runJob runs the job and records the outcome as nextAttempt decides it. Jobs failed for good
+// are listed in admin's outbox view, where they can be retried
+func (app *application) runJob(ctx context.Context, job *models.InvoiceJob) {
+	ctx, cancel := context.WithTimeout(ctx, app.config.jobs.timeout)
+	defer cancel()
+
+	result, err := app.performJob(ctx, job)
+	if err != nil {
+		next, postponed := nextAttempt(job, err, app.config.jobs.attempts, time.Now())
+		switch {
+		case postponed:
+			app.infoLog.Printf("Postponed %s job %d until %s: %s\n", job.Kind, job.ID, next.Format(time.RFC3339), err)
+			err = app.DB.PostponeInvoiceJob(job.ID, err, *next)
+		case next != nil:
+			app.errorLog.Printf("error running %s job %d (attempt %d), next attempt at %s: %s\n",
+				job.Kind, job.ID, job.Attempts+1, next.Format(time.RFC3339), err)
+			err = app.DB.FailInvoiceJob(job.ID, err, next)
+		default:
+			app.errorLog.Printf("%s job %d (%s) failed after %d attempts: %s\n", job.Kind, job.ID, job.Reference, job.Attempts+1, err)
+			err = app.DB.FailInvoiceJob(job.ID, err, nil)
+		}
+		if err != nil {
+			app.errorLog.Println(err)
+		}
+		return
+	}
+	app.infoLog.Printf("Finished %s job %d: %s\n", job.Kind, job.ID, result)
+	if err = app.DB.CompleteInvoiceJob(job.ID, result); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// nextAttempt returns when the job that failed with the error runs again. Job waiting for other one
+// is postponed without using up an attempt; other failures are retried with backoff until the job
+// runs out of attempts, while permanent ones are not. Nil is returned for job that has failed for good
+func nextAttempt(job *models.InvoiceJob, err error, attempts int, now time.Time) (*time.Time, bool) {
+	var waiting waitingError
+	if errors.As(err, &waiting) {
+		next := now.Add(jobWaitInterval)
+		return &next, true
+	}
+	attempt := job.Attempts + 1
+	var permanent permanentError
+	if attempt >= attempts || errors.As(err, &permanent) {
+		return nil, false
+	}
+	next := now.Add(outbox.Backoff(attempt, jobRetryBase, jobRetryMax))
+	return &next, false
+}
+
+func (app *application) performJob(ctx context.Context, job *models.InvoiceJob) (string, error) {
+	switch job.Kind {
+	case models.InvoiceJobKindInvoice:
+		var order common_models.Order
+		if err := json.Unmarshal([]byte(job.Payload), &order); err != nil {
+			return "", permanentError{fmt.Errorf("error decoding order: %w", err)}
+		}
+		return app.sendInvoice(ctx, order)
+	case models.InvoiceJobKindCreditNote:
+		var req common_models.CreditNote
+		if err := json.Unmarshal([]byte(job.Payload), &req); err != nil {
+			return "", permanentError{fmt.Errorf("error decoding credit note request: %w", err)}
+		}
+		return app.sendCreditNote(ctx, req)
+	default:
+		return "", permanentError{fmt.Errorf("unknown job kind %q", job.Kind)}
+	}
+}
+
+// sendInvoice issues invoice for the order and sends it to customer. It is idempotent:
+// invoice is issued once per order, and is not sent again once it has been sent
+func (app *application) sendInvoice(ctx context.Context, order common_models.Order) (string, error) {
+	if order.Currency == "" {
+		order.Currency = "usd"
+	}
+	// issue invoice with the next number or get one issued by previous attempt
+	tpl := app.templates.get(order.Brand, order.Locale)
+	issuedAt := time.Now()
+	dueAt := order.DueDate
+	if dueAt.IsZero() {
+		dueAt = issuedAt.AddDate(0, 0, app.config.paymentTermDays)
+	}
+	var transactionID *int
+	if order.TransactionID != 0 {
+		transactionID = &order.TransactionID
+	}
+	invoice, created, err := app.DB.FindOrCreateInvoice(models.Invoice{
+		OrderID:       order.ID,
+		TransactionID: transactionID,
+		Currency:      order.Currency,
+		Subtotal:      order.Subtotal(),
+		Discount:      order.Discount,
+		Tax:           order.Tax,
+		Total:         order.Total(),
+		IssuedAt:      issuedAt,
+		DueAt:         &dueAt,
+		PeriodStart:   order.PeriodStart,
+		PeriodEnd:     order.PeriodEnd,
+		Brand:         tpl.Brand,
+		Locale:        tpl.Locale,
+	})
+	if err != nil {
+		return "", err
+	}
+	if !created && invoice.SentAt != nil {
+		return fmt.Sprintf("Invoice %s has already been sent.", invoice.Number), nil
+	}
+	// invoice issued by previous attempt is rendered with the template it has been issued with
+	tpl = app.templates.get(invoice.Brand, invoice.Locale)
+	// generate a pdf invoice and keep it where the web app can serve it from
+	pdf, err := app.createInvoicePDF(tpl, order, invoice)
+	if err != nil {
+		return "", err
+	}
+	key := models.InvoiceDocumentKey(invoice.Number)
+	if err = app.storage.Put(ctx, key, pdf, "application/pdf"); err != nil {
+		return "", err
+	}
+	if err = app.DB.SetInvoicePDF(invoice.ID, key); err != nil {
+		return "", err
+	}
+	// UBL e-invoice is made from the same invoice; one failing the check against the UBL subset
+	// is not offered to customer, but it does not hold the PDF invoice back
+	seller := einvoice.Party{
+		Name:    tpl.Layout.Seller,
+		Email:   tpl.Layout.SenderEmail,
+		Address: common_models.Address{Country: app.config.einvoice.country},
+	}
+	ubl, err := einvoice.Invoice(invoice, order, seller)
+	if err != nil {
+		app.errorLog.Println(err)
+	} else {
+		key := models.InvoiceXMLKey(invoice.Number)
+		if err = app.storage.Put(ctx, key, ubl, einvoice.ContentType); err != nil {
+			return "", err
+		}
+		if err = app.DB.SetInvoiceXML(invoice.ID, key); err != nil {
+			return "", err
+		}
+	}
+	// send the mail with an attachment and a link to download the invoice later
+	attachments := []*mail.File{{
+		Name:     fmt.Sprintf("%s.pdf", invoice.Number),
+		MimeType: "application/pdf",
+		Data:     pdf,
+	}}
+	data := map[string]any{
+		"Text":   tpl.texts("email_", "number", invoice.Number),
+		"Seller": tpl.Layout.Seller,
+		"Link":   app.invoiceLink(invoice.Number, ""),
+	}
+	if ubl != nil {
+		data["XMLLink"] = app.invoiceLink(invoice.Number, "xml")
+		if app.config.einvoice.attach {
+			attachments = append(attachments, &mail.File{
+				Name:     fmt.Sprintf("%s.xml", invoice.Number),
+				MimeType: einvoice.ContentType,
+				Data:     ubl,
+			})
+		}
+	}
+	err = app.SendMail(tpl.Layout.SenderEmail, order.Email, tpl.text("invoice_subject", "number", invoice.Number), "invoice", attachments, data)
+	if err != nil {
+		return "", err
+	}
+	if err = app.DB.MarkInvoiceSent(invoice.ID); err != nil {
+		app.errorLog.Println(err)
+	}
+	return fmt.Sprintf("Invoice %s has been created and sent to %s.", invoice.Number, order.Email), nil
+}
+
+// invoiceLink returns signed link customers download the invoice by from the web app;
+// format "xml" links its UBL e-invoice instead of the PDF
+func (app *application) invoiceLink(number, format string) string {
+	signer := urlsigner.Signer{
+		Keys: app.config.keys,
+	}
+	link := fmt.Sprintf("%s/invoice?number=%s", app.config.frontEnd, url.QueryEscape(number))
+	if format != "" {
+		link += "&format=" + url.QueryEscape(format)
+	}
+	return signer.GenerateTokenFromString(link)
+}
+
+// sendCreditNote issues credit note for the amount returned on the charge, referencing invoice
+// of that charge, and sends it to customer. Like invoices, credit note is issued once per order
+// and sent once
+func (app *application) sendCreditNote(ctx context.Context, req common_models.CreditNote) (string, error) {
+	// invoice may still be waiting in the outbox or job queue; the job is retried until it is issued
+	invoice, err := app.DB.GetInvoiceByTransactionID(req.TransactionID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return "", waitingError{fmt.Errorf("invoice of transaction %d has not been issued yet", req.TransactionID)}
+	}
+	if err != nil {
+		return "", err
+	}
+	if req.Amount > invoice.Total {
+		return "", permanentError{fmt.Errorf("amount credited %d exceeds total %d of invoice %s", req.Amount, invoice.Total, invoice.Number)}
+	}
+	note, created, err := app.DB.FindOrCreateCreditNote(models.CreditNote{
+		InvoiceID: invoice.ID,
+		OrderID:   req.OrderID,
+		Reason:    req.Reason,
+		Currency:  invoice.Currency,
+		Amount:    req.Amount,
+		IssuedAt:  time.Now(),
+	})
+	if err != nil {
+		return "", err
+	}
+	if !created && note.SentAt != nil {
+		return fmt.Sprintf("Credit note %s has already been sent.", note.Number), nil
+	}
+	// credit note is rendered with template of the invoice it reverses
+	tpl := app.templates.get(invoice.Brand, invoice.Locale)
+	// generate a pdf credit note and keep it next to invoices
+	pdf, err := app.createCreditNotePDF(tpl, req, note, invoice)
+	if err != nil {
+		return "", err
+	}
+	key := models.CreditNoteDocumentKey(note.Number)
+	if err = app.storage.Put(ctx, key, pdf, "application/pdf"); err != nil {
+		return "", err
+	}
+	if err = app.DB.SetCreditNotePDF(note.ID, key); err != nil {
+		return "", err
+	}
+	attachments := []*mail.File{{
+		Name:     fmt.Sprintf("%s.pdf", note.Number),
+		MimeType: "application/pdf",
+		Data:     pdf,
+	}}
+	data := map[string]any{
+		"Text":   tpl.texts("email_", "number", note.Number, "invoice", invoice.Number),
+		"Seller": tpl.Layout.Seller,
+	}
+	subject := tpl.text("credit_note_subject", "number", note.Number, "invoice", invoice.Number)
+	err = app.SendMail(tpl.Layout.SenderEmail, req.Email, subject, "credit-note", attachments, data)
+	if err != nil {
+		return "", err
+	}
+	if err = app.DB.MarkCreditNoteSent(note.ID); err != nil {
+		app.errorLog.Println(err)
+	}
+	return fmt.Sprintf("Credit note %s has been created and sent to %s.", note.Number, req.Email), nil
+}
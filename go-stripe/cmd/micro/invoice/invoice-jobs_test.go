@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/models"
+)
+
+func Test_NextAttempt(t *testing.T) {
+	now := time.Date(2023, 5, 20, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name      string
+		attempts  int
+		err       error
+		delay     time.Duration
+		postponed bool
+	}{
+		{"transient error", 0, errors.New("mail server is down"), jobRetryBase, false},
+		{"transient error of the third attempt", 2, errors.New("mail server is down"), 4 * jobRetryBase, false},
+		{"transient error of the last attempt", 4, errors.New("mail server is down"), 0, false},
+		{"permanent error", 0, permanentError{errors.New("unknown job kind")}, 0, false},
+		// waiting does not use up attempts, so the job never fails while waiting
+		{"waiting for other job", 4, waitingError{errors.New("invoice has not been issued yet")}, jobWaitInterval, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			job := &models.InvoiceJob{ID: 1, Kind: models.InvoiceJobKindInvoice, Attempts: tt.attempts}
+			next, postponed := nextAttempt(job, tt.err, 5, now)
+			if postponed != tt.postponed {
+				t.Errorf("expected postponed %v but got %v", tt.postponed, postponed)
+			}
+			if tt.delay == 0 {
+				if next != nil {
+					t.Errorf("expected job to fail for good but it is run again at %s", next)
+				}
+				return
+			}
+			if next == nil || !next.Equal(now.Add(tt.delay)) {
+				t.Errorf("expected next attempt at %s but got %v", now.Add(tt.delay), next)
+			}
+		})
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	common_models "github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/common"
+	"github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/models"
+	"github.com/phpdave11/gofpdf"
+)
+
+// Invoice layout on Letter paper, in millimetres
+const (
+	pageHeight   = 279.4
+	marginX      = 15.0
+	marginTop    = 15.0
+	footerHeight = 20.0
+	lineHeight   = 5.0
+	rowPadding   = 1.5
+
+	colProduct  = 110.0
+	colQuantity = 20.0
+	colPrice    = 28.0
+	colAmount   = 27.9
+	tableWidth  = colProduct + colQuantity + colPrice + colAmount
+)
+
+// invoiceLayout renders invoice of any number of lines, breaking pages as needed and
+// repeating the table header on every page. Texts, fonts and formats are those of the template
+type invoiceLayout struct {
+	pdf     *gofpdf.Fpdf
+	tr      func(string) string
+	tpl     *invoiceTemplate
+	order   common_models.Order
+	invoice models.Invoice
+}
+
+func (app *application) createInvoicePDF(tpl *invoiceTemplate, order common_models.Order, invoice models.Invoice) ([]byte, error) {
+	pdf := gofpdf.New("P", "mm", "Letter", "")
+	pdf.SetMargins(marginX, marginTop, marginX)
+	// pages are broken by the layout, so that rows are not split between pages
+	pdf.SetAutoPageBreak(false, 0)
+	pdf.AliasNbPages("")
+
+	l := &invoiceLayout{
+		pdf:     pdf,
+		tr:      pdf.UnicodeTranslatorFromDescriptor(""),
+		tpl:     tpl,
+		order:   order,
+		invoice: invoice,
+	}
+	pdf.SetFooterFunc(l.footer)
+
+	pdf.AddPage()
+	l.header()
+	l.billTo()
+	l.tableHeader()
+	for _, item := range order.LineItems() {
+		l.item(item)
+	}
+	l.totals()
+
+	var buf bytes.Buffer
+	if err := pdf.Output(&buf); err != nil {
+		return nil, fmt.Errorf("error rendering invoice %s: %w", invoice.Number, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// header prints seller, invoice number and dates
+func (l *invoiceLayout) header() {
+	l.title(l.tpl.text("invoice_title"))
+	rows := [][2]string{
+		{l.tpl.text("invoice_number"), l.invoice.Number},
+		{l.tpl.text("issue_date"), l.tpl.formatDate(l.invoice.IssuedAt)},
+	}
+	if l.invoice.DueAt != nil {
+		rows = append(rows, [2]string{l.tpl.text("due_date"), l.tpl.formatDate(*l.invoice.DueAt)})
+	}
+	if l.invoice.PeriodStart != nil && l.invoice.PeriodEnd != nil {
+		rows = append(rows, [2]string{l.tpl.text("billing_period"), fmt.Sprintf("%s - %s",
+			l.tpl.formatDate(*l.invoice.PeriodStart), l.tpl.formatDate(*l.invoice.PeriodEnd))})
+	}
+	rows = append(rows, [2]string{l.tpl.text("order"), fmt.Sprintf("%d", l.order.ID)})
+	l.details(rows)
+}
+
+// title prints seller and title of the document
+func (l *invoiceLayout) title(title string) {
+	l.font("B", l.tpl.Layout.TitleSize)
+	l.pdf.CellFormat(90, 10, l.tr(l.tpl.Layout.Seller), "", 0, "L", false, 0, "")
+	l.pdf.CellFormat(0, 10, l.tr(title), "", 1, "R", false, 0, "")
+	l.font("", l.tpl.Layout.TextSize)
+}
+
+// details prints labelled numbers and dates of the document aligned to the right edge of the
+// table; labels column is widened to fit the longest label of the locale
+func (l *invoiceLayout) details(rows [][2]string) {
+	pdf := l.pdf
+	labelWidth := 35.0
+	for i := range rows {
+		rows[i][0], rows[i][1] = l.tr(rows[i][0]), l.tr(rows[i][1])
+		if w := pdf.GetStringWidth(rows[i][0]) + 2; w > labelWidth {
+			labelWidth = w
+		}
+	}
+	for _, row := range rows {
+		pdf.SetX(marginX + tableWidth - labelWidth - 45)
+		pdf.CellFormat(labelWidth, lineHeight, row[0], "", 0, "L", false, 0, "")
+		pdf.CellFormat(45, lineHeight, row[1], "", 1, "R", false, 0, "")
+	}
+	pdf.Ln(lineHeight)
+}
+
+// font sets font of the template
+func (l *invoiceLayout) font(style string, size float64) {
+	l.pdf.SetFont(l.tpl.Layout.Font, style, size)
+}
+
+// billTo prints customer's name, email and billing address
+func (l *invoiceLayout) billTo() {
+	pdf := l.pdf
+	l.font("B", l.tpl.Layout.TextSize)
+	pdf.CellFormat(0, lineHeight, l.tr(l.tpl.text("bill_to")), "", 1, "L", false, 0, "")
+	l.font("", l.tpl.Layout.TextSize)
+	lines := append([]string{fmt.Sprintf("%s %s", l.order.FirstName, l.order.LastName)}, l.order.BillingAddress.Lines()...)
+	lines = append(lines, l.order.Email)
+	for _, line := range lines {
+		pdf.CellFormat(0, lineHeight, l.tr(line), "", 1, "L", false, 0, "")
+	}
+	pdf.Ln(lineHeight)
+}
+
+func (l *invoiceLayout) tableHeader() {
+	pdf := l.pdf
+	l.font("B", l.tpl.Layout.TextSize)
+	fill := l.tpl.Layout.HeaderFill
+	pdf.SetFillColor(fill[0], fill[1], fill[2])
+	h := lineHeight + 2*rowPadding
+	pdf.CellFormat(colProduct, h, l.tr(l.tpl.text("product")), "1", 0, "L", true, 0, "")
+	pdf.CellFormat(colQuantity, h, l.tr(l.tpl.text("quantity")), "1", 0, "C", true, 0, "")
+	pdf.CellFormat(colPrice, h, l.tr(l.tpl.text("unit_price")), "1", 0, "R", true, 0, "")
+	pdf.CellFormat(colAmount, h, l.tr(l.tpl.text("amount")), "1", 1, "R", true, 0, "")
+	l.font("", l.tpl.Layout.TextSize)
+}
+
+// ensureSpace starts new page if the next height millimetres do not fit the current one
+func (l *invoiceLayout) ensureSpace(height float64, withTableHeader bool) {
+	if l.pdf.GetY()+height <= pageHeight-footerHeight {
+		return
+	}
+	l.pdf.AddPage()
+	if withTableHeader {
+		l.tableHeader()
+	}
+}
+
+// item prints order line; long product names wrap inside the row
+func (l *invoiceLayout) item(item common_models.OrderItem) {
+	pdf := l.pdf
+	// text is split before translation, as splitting expects UTF-8
+	lines := pdf.SplitText(item.Product, colProduct-2)
+	if len(lines) == 0 {
+		lines = []string{""}
+	}
+	for i := range lines {
+		lines[i] = l.tr(lines[i])
+	}
+	h := float64(len(lines))*lineHeight + 2*rowPadding
+	l.ensureSpace(h, true)
+
+	x, y := pdf.GetXY()
+	pdf.Rect(x, y, colProduct, h, "D")
+	pdf.SetXY(x, y+rowPadding)
+	pdf.MultiCell(colProduct, lineHeight, strings.Join(lines, "\n"), "", "L", false)
+
+	price := ""
+	if item.UnitPrice != 0 {
+		price = l.money(item.UnitPrice)
+	}
+	pdf.SetXY(x+colProduct, y)
+	pdf.CellFormat(colQuantity, h, l.tr(l.tpl.formatNumber(item.Quantity)), "1", 0, "C", false, 0, "")
+	pdf.CellFormat(colPrice, h, price, "1", 0, "R", false, 0, "")
+	pdf.CellFormat(colAmount, h, l.money(item.Total()), "1", 1, "R", false, 0, "")
+}
+
+// money formats amount in cents in currency of the order, ready to be printed
+func (l *invoiceLayout) money(cents int) string {
+	return l.tr(l.tpl.formatCurrency(cents, l.order.Currency))
+}
+
+// totals prints subtotal, discount, tax and total; the block is kept on one page
+func (l *invoiceLayout) totals() {
+	pdf := l.pdf
+	rows := [][2]string{{l.tpl.text("subtotal"), l.money(l.invoice.Subtotal)}}
+	if l.invoice.Discount != 0 {
+		rows = append(rows, [2]string{l.tpl.text("discount"), l.money(-l.invoice.Discount)})
+	}
+	rows = append(rows,
+		[2]string{l.tpl.text("tax"), l.money(l.invoice.Tax)},
+		[2]string{l.tpl.text("total"), l.money(l.invoice.Total)},
+	)
+	h := lineHeight + 2*rowPadding
+	l.ensureSpace(float64(len(rows))*h, false)
+
+	for i, row := range rows {
+		if i == len(rows)-1 {
+			l.font("B", l.tpl.Layout.TextSize)
+		}
+		pdf.SetX(marginX + colProduct + colQuantity)
+		pdf.CellFormat(colPrice, h, l.tr(row[0]), "1", 0, "L", false, 0, "")
+		pdf.CellFormat(colAmount, h, row[1], "1", 1, "R", false, 0, "")
+	}
+	l.font("", l.tpl.Layout.TextSize)
+}
+
+func (l *invoiceLayout) footer() {
+	l.pageFooter(l.tpl.text("invoice_footer", "number", l.invoice.Number))
+}
+
+// pageFooter prints footer text with {page} and {pages} placeholders replaced
+func (l *invoiceLayout) pageFooter(text string) {
+	pdf := l.pdf
+	pdf.SetY(-footerHeight + 5)
+	l.font("I", l.tpl.Layout.FooterSize)
+	text = strings.NewReplacer("{page}", fmt.Sprintf("%d", pdf.PageNo()), "{pages}", "{nb}").Replace(text)
+	pdf.CellFormat(0, lineHeight, l.tr(text), "", 0, "C", false, 0, "")
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	common_models "github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/common"
+	"github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/models"
+)
+
+var (
+	pdfPage   = regexp.MustCompile(`/Type /Page[^s]`)
+	pdfStream = regexp.MustCompile(`(?s)stream\r?\n(.*?)\r?\nendstream`)
+)
+
+// pdfText returns number of pages of the document and its content streams, decompressed
+func pdfText(t *testing.T, doc []byte) (int, string) {
+	t.Helper()
+	var text strings.Builder
+	for _, m := range pdfStream.FindAllSubmatch(doc, -1) {
+		r, err := zlib.NewReader(bytes.NewReader(m[1]))
+		if err != nil {
+			// fonts and other streams are not compressed
+			continue
+		}
+		data, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		text.Write(data)
+	}
+	return len(pdfPage.FindAll(doc, -1)), text.String()
+}
+
+func Test_CreateInvoicePDF(t *testing.T) {
+	app := &application{}
+	tpl := testTemplates(t).get("widgets", "en")
+	issued := time.Date(2023, 5, 19, 10, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name            string
+		items           int
+		pages           int
+		subtotal, total string
+	}{
+		{"single page", 3, 1, "$98.91", "$212.35"},
+		// 29 rows fit pages after the first one
+		{"several pages", 120, 5, "$3,956.40", "$4,069.84"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			order := common_models.Order{ID: 42, Currency: "usd", Discount: 1001, Tax: 12345, FirstName: "Jane", LastName: "Doe",
+				Email: "jane@example.com"}
+			for i := 1; i <= tt.items; i++ {
+				order.Items = append(order.Items, common_models.OrderItem{Product: fmt.Sprintf("Widget %d", i), Quantity: 3, UnitPrice: 1099})
+			}
+			invoice := models.Invoice{OrderID: 42, Number: "2023-000007", Currency: "usd", Subtotal: order.Subtotal(),
+				Discount: order.Discount, Tax: order.Tax, Total: order.Total(), IssuedAt: issued}
+
+			doc, err := app.createInvoicePDF(tpl, order, invoice)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pages, text := pdfText(t, doc)
+			if pages != tt.pages {
+				t.Errorf("expected %d pages but got %d", tt.pages, pages)
+			}
+			if headers := strings.Count(text, "(Product)"); headers != tt.pages {
+				t.Errorf("expected table header on each of %d pages but got %d", tt.pages, headers)
+			}
+			// every line and the totals are printed, and every page has its footer
+			for _, want := range []string{
+				fmt.Sprintf("(Widget %d)", tt.items),
+				"($32.97)",
+				"(" + tt.subtotal + ")",
+				"(-$10.01)",
+				"($123.45)",
+				"(" + tt.total + ")",
+				fmt.Sprintf("(Invoice 2023-000007, page %d of %d)", tt.pages, tt.pages),
+			} {
+				if !strings.Contains(text, want) {
+					t.Errorf("expected %s in the document", want)
+				}
+			}
+		})
+	}
+
+	// totals are formatted to the cent
+	order := common_models.Order{Currency: "usd", Items: []common_models.OrderItem{{Product: "Widget", Quantity: 1, Amount: 123456789}}, Tax: 1}
+	invoice := models.Invoice{Number: "2023-000008", Subtotal: order.Subtotal(), Tax: order.Tax, Total: order.Total(), IssuedAt: issued}
+	doc, err := app.createInvoicePDF(tpl, order, invoice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, text := pdfText(t, doc)
+	for _, want := range []string{"($1,234,567.89)", "($0.01)", "($1,234,567.90)"} {
+		if !strings.Contains(text, want) {
+			t.Errorf("expected %s in the document", want)
+		}
+	}
+}
@@ -3,22 +3,26 @@ package main
 import (
 	"net/http"
 
+	"github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/middleware"
 	"github.com/go-chi/chi/v5"
-	"github.com/go-chi/cors"
 )
 
 func (app *application) routes() http.Handler {
 	mux := chi.NewRouter()
 
-	mux.Use(cors.Handler(cors.Options{
-		AllowedOrigins:   []string{"https://*", "http://*"},
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
-		AllowCredentials: false,
-		MaxAge:           300,
-	}))
+	// the service is called by other services only, never by browsers, so it allows no
+	// cross-origin requests
+	mux.Use(middleware.SecurityHeaders(middleware.Options{Policy: middleware.APIPolicy()}))
 
-	mux.Post("/invoice/create-and-send", app.CreateAndSendInvoice)
+	mux.Route("/invoice", func(mux chi.Router) {
+		// only our own services may have invoices generated and sent
+		mux.Use(app.verifier.Middleware)
+
+		mux.Post("/create-and-send", app.CreateAndSendInvoice)
+		mux.Post("/credit-note", app.CreateAndSendCreditNote)
+		mux.Post("/batch", app.CreateAndSendInvoices)
+		mux.Get("/jobs/{id}", app.GetJob)
+	})
 
 	return mux
 }
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+	"time"
+)
+
+// invoiceTemplateFS holds bundled invoice templates: a directory per brand with layout.json and
+// a text catalog per locale, i.e. en.json or de-at.json
+//
+//go:embed invoice-templates
+var invoiceTemplateFS embed.FS
+
+// layoutFile is the file of brand's directory that is not a text catalog
+const layoutFile = "layout.json"
+
+// pdfCoreFonts are the fonts every PDF viewer has; templates can not embed other ones
+var pdfCoreFonts = map[string]bool{"Times": true, "Helvetica": true, "Arial": true, "Courier": true}
+
+// requiredTexts are the keys every text catalog must have
+var requiredTexts = []string{
+	"invoice_title", "invoice_number", "issue_date", "due_date", "billing_period", "order", "bill_to",
+	"product", "quantity", "unit_price", "amount", "subtotal", "discount", "tax", "total", "invoice_footer",
+	"credit_note_title", "credit_note_number", "credits_invoice", "invoice_date", "total_credit",
+	"credit_note_footer", "refund_of_invoice",
+	"invoice_subject", "credit_note_subject", "email_greeting", "email_invoice_attached",
+	"email_invoice_link", "email_download", "email_einvoice_link", "email_einvoice_download",
+	"email_refunded", "email_credit_note_attached",
+}
+
+// brandLayout is brand's part of invoice template: the seller, address invoices are sent from,
+// default locale, font and sizes of titles, text and footers and fill colour of table header
+type brandLayout struct {
+	Seller        string  `json:"seller"`
+	SenderEmail   string  `json:"sender_email"`
+	DefaultLocale string  `json:"default_locale"`
+	Font          string  `json:"font"`
+	TitleSize     float64 `json:"title_size"`
+	TextSize      float64 `json:"text_size"`
+	FooterSize    float64 `json:"footer_size"`
+	HeaderFill    [3]int  `json:"header_fill"`
+}
+
+// textCatalog is locale's part of invoice template: texts, which may have {placeholders}, and
+// formats of dates (Go layout), numbers and amounts. Currency format places {symbol} and
+// {amount}; currencies without symbol are written as amount followed by ISO code
+type textCatalog struct {
+	DateFormat         string            `json:"date_format"`
+	DecimalSeparator   string            `json:"decimal_separator"`
+	ThousandsSeparator string            `json:"thousands_separator"`
+	CurrencyFormat     string            `json:"currency_format"`
+	CurrencySymbols    map[string]string `json:"currency_symbols"`
+	Text               map[string]string `json:"text"`
+}
+
+// invoiceTemplate is template documents are rendered with for brand in locale
+type invoiceTemplate struct {
+	Brand   string
+	Locale  string
+	Layout  brandLayout
+	Catalog textCatalog
+}
+
+type brandTemplates struct {
+	layout   brandLayout
+	catalogs map[string]textCatalog
+}
+
+// invoiceTemplates are templates of all brands; the default one is used for orders naming no brand
+// or one without templates
+type invoiceTemplates struct {
+	brands       map[string]*brandTemplates
+	defaultBrand string
+}
+
+// loadInvoiceTemplates loads and checks templates of all brands, so that missing texts or fonts
+// are found on start rather than when invoice is rendered
+func loadInvoiceTemplates(fsys fs.FS, root, defaultBrand string) (*invoiceTemplates, error) {
+	entries, err := fs.ReadDir(fsys, root)
+	if err != nil {
+		return nil, fmt.Errorf("error reading invoice templates: %w", err)
+	}
+	templates := &invoiceTemplates{brands: map[string]*brandTemplates{}, defaultBrand: defaultBrand}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		brand, err := loadBrandTemplates(fsys, path.Join(root, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("brand %s: %w", entry.Name(), err)
+		}
+		templates.brands[entry.Name()] = brand
+	}
+	if templates.brands[defaultBrand] == nil {
+		return nil, fmt.Errorf("there are no invoice templates of default brand %q", defaultBrand)
+	}
+	return templates, nil
+}
+
+func loadBrandTemplates(fsys fs.FS, dir string) (*brandTemplates, error) {
+	brand := &brandTemplates{catalogs: map[string]textCatalog{}}
+	if err := readJSONFile(fsys, path.Join(dir, layoutFile), &brand.layout); err != nil {
+		return nil, err
+	}
+	l := brand.layout
+	if l.Seller == "" || l.SenderEmail == "" {
+		return nil, errors.New("seller and sender email are required")
+	}
+	if !pdfCoreFonts[l.Font] {
+		return nil, fmt.Errorf("font %q is not one of PDF core fonts", l.Font)
+	}
+	if l.TitleSize <= 0 || l.TextSize <= 0 || l.FooterSize <= 0 {
+		return nil, errors.New("font sizes must be positive")
+	}
+
+	files, err := fs.Glob(fsys, path.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		name := path.Base(file)
+		if name == layoutFile {
+			continue
+		}
+		var c textCatalog
+		if err = readJSONFile(fsys, file, &c); err != nil {
+			return nil, err
+		}
+		if c.DateFormat == "" || c.DecimalSeparator == "" || !strings.Contains(c.CurrencyFormat, "{amount}") {
+			return nil, fmt.Errorf("%s: date format, decimal separator and currency format with {amount} are required", name)
+		}
+		for _, key := range requiredTexts {
+			if _, ok := c.Text[key]; !ok {
+				return nil, fmt.Errorf("%s: text %q is missing", name, key)
+			}
+		}
+		brand.catalogs[strings.ToLower(strings.TrimSuffix(name, ".json"))] = c
+	}
+	if _, ok := brand.catalogs[strings.ToLower(l.DefaultLocale)]; !ok {
+		return nil, fmt.Errorf("there is no text catalog of default locale %q", l.DefaultLocale)
+	}
+	return brand, nil
+}
+
+func readJSONFile(fsys fs.FS, name string, v any) error {
+	data, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return fmt.Errorf("error reading %s: %w", name, err)
+	}
+	if err = json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("error parsing %s: %w", name, err)
+	}
+	return nil
+}
+
+// get returns template of the brand best matching the locale: the locale itself, the locale
+// less its last subtags (de-AT falls back to de) or brand's default locale
+func (t *invoiceTemplates) get(brand, locale string) *invoiceTemplate {
+	b, ok := t.brands[brand]
+	if !ok {
+		brand, b = t.defaultBrand, t.brands[t.defaultBrand]
+	}
+	tag := strings.ToLower(locale)
+	for tag != "" {
+		if c, ok := b.catalogs[tag]; ok {
+			return &invoiceTemplate{Brand: brand, Locale: tag, Layout: b.layout, Catalog: c}
+		}
+		i := strings.LastIndex(tag, "-")
+		if i < 0 {
+			break
+		}
+		tag = tag[:i]
+	}
+	tag = strings.ToLower(b.layout.DefaultLocale)
+	return &invoiceTemplate{Brand: brand, Locale: tag, Layout: b.layout, Catalog: b.catalogs[tag]}
+}
+
+// text returns text of the catalog by key with placeholders replaced by values of vars,
+// which are pairs of placeholder's name and value
+func (t *invoiceTemplate) text(key string, vars ...string) string {
+	s := t.Catalog.Text[key]
+	for i := 0; i+1 < len(vars); i += 2 {
+		s = strings.ReplaceAll(s, "{"+vars[i]+"}", vars[i+1])
+	}
+	return s
+}
+
+// texts returns all the texts with the prefix, i.e. those of emails, with placeholders replaced
+func (t *invoiceTemplate) texts(prefix string, vars ...string) map[string]string {
+	texts := map[string]string{}
+	for key := range t.Catalog.Text {
+		if strings.HasPrefix(key, prefix) {
+			texts[key] = t.text(key, vars...)
+		}
+	}
+	return texts
+}
+
+func (t *invoiceTemplate) formatDate(d time.Time) string {
+	return d.Format(t.Catalog.DateFormat)
+}
+
+// formatNumber formats integer with thousands separators of the locale
+func (t *invoiceTemplate) formatNumber(n int) string {
+	sign := ""
+	if n < 0 {
+		sign = "-"
+		n = -n
+	}
+	digits := fmt.Sprintf("%d", n)
+	var b strings.Builder
+	for i, d := range digits {
+		if i > 0 && (len(digits)-i)%3 == 0 {
+			b.WriteString(t.Catalog.ThousandsSeparator)
+		}
+		b.WriteRune(d)
+	}
+	return sign + b.String()
+}
+
+// formatCurrency formats amount in cents without losing them to float rounding
+func (t *invoiceTemplate) formatCurrency(cents int, currency string) string {
+	sign := ""
+	if cents < 0 {
+		sign = "-"
+		cents = -cents
+	}
+	amount := fmt.Sprintf("%s%s%02d", t.formatNumber(cents/100), t.Catalog.DecimalSeparator, cents%100)
+	code := strings.ToUpper(currency)
+	if code == "" {
+		code = "USD"
+	}
+	symbol, ok := t.Catalog.CurrencySymbols[code]
+	if !ok {
+		return fmt.Sprintf("%s%s %s", sign, amount, code)
+	}
+	return sign + strings.NewReplacer("{symbol}", symbol, "{amount}", amount).Replace(t.Catalog.CurrencyFormat)
+}
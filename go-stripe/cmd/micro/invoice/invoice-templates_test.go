@@ -0,0 +1,122 @@
+package main
+
+import (
+	"io/fs"
+	"testing"
+	"testing/fstest"
+)
+
+// testTemplates returns the bundled templates along with gadgets brand, whose only catalog is
+// the German one
+func testTemplates(t *testing.T) *invoiceTemplates {
+	t.Helper()
+	fsys := fstest.MapFS{}
+	for _, name := range []string{"layout.json", "en.json", "de.json", "fr.json"} {
+		data, err := fs.ReadFile(invoiceTemplateFS, "invoice-templates/widgets/"+name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fsys["templates/widgets/"+name] = &fstest.MapFile{Data: data}
+		if name == "de.json" {
+			fsys["templates/gadgets/"+name] = &fstest.MapFile{Data: data}
+		}
+	}
+	fsys["templates/gadgets/layout.json"] = &fstest.MapFile{Data: []byte(`{"seller": "Gadgets GmbH", ` +
+		`"sender_email": "info@gadgets.de", "default_locale": "de", "font": "Helvetica", "title_size": 18, ` +
+		`"text_size": 10, "footer_size": 8}`)}
+
+	templates, err := loadInvoiceTemplates(fsys, "templates", "widgets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return templates
+}
+
+func Test_InvoiceTemplatesGet(t *testing.T) {
+	templates := testTemplates(t)
+
+	tests := []struct {
+		name, brand, locale string
+		wantBrand           string
+		wantLocale          string
+	}{
+		{"exact locale", "widgets", "fr", "widgets", "fr"},
+		{"locale case", "widgets", "DE", "widgets", "de"},
+		{"region falls back to language", "widgets", "de-AT", "widgets", "de"},
+		{"script and region fall back to language", "widgets", "fr-Latn-CA", "widgets", "fr"},
+		{"unknown locale falls back to default", "widgets", "ja-JP", "widgets", "en"},
+		{"no locale", "widgets", "", "widgets", "en"},
+		{"default locale of the brand", "gadgets", "en-US", "gadgets", "de"},
+		{"unknown brand", "acme", "de-AT", "widgets", "de"},
+		{"no brand", "", "", "widgets", "en"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tpl := templates.get(tt.brand, tt.locale)
+			if tpl.Brand != tt.wantBrand || tpl.Locale != tt.wantLocale {
+				t.Errorf("expected %s/%s but got %s/%s", tt.wantBrand, tt.wantLocale, tpl.Brand, tpl.Locale)
+			}
+			if tpl.Catalog.Text["invoice_title"] == "" {
+				t.Error("expected catalog with texts")
+			}
+		})
+	}
+	if seller := templates.get("gadgets", "de").Layout.Seller; seller != "Gadgets GmbH" {
+		t.Errorf("expected layout of the brand, got seller %q", seller)
+	}
+}
+
+func Test_FormatNumber(t *testing.T) {
+	templates := testTemplates(t)
+	en, de, fr := templates.get("widgets", "en"), templates.get("widgets", "de"), templates.get("widgets", "fr")
+
+	tests := []struct {
+		tpl      *invoiceTemplate
+		n        int
+		expected string
+	}{
+		{en, 0, "0"},
+		{en, 999, "999"},
+		{en, 1000, "1,000"},
+		{en, 123456, "123,456"},
+		{en, 1234567, "1,234,567"},
+		{en, -1234567, "-1,234,567"},
+		{en, -999, "-999"},
+		{de, 1000000, "1.000.000"},
+		{fr, 1234567, "1 234 567"},
+	}
+	for _, tt := range tests {
+		if s := tt.tpl.formatNumber(tt.n); s != tt.expected {
+			t.Errorf("%s: expected %d formatted as %q but got %q", tt.tpl.Locale, tt.n, tt.expected, s)
+		}
+	}
+}
+
+func Test_FormatCurrency(t *testing.T) {
+	templates := testTemplates(t)
+	en, de, fr := templates.get("widgets", "en"), templates.get("widgets", "de"), templates.get("widgets", "fr")
+
+	tests := []struct {
+		tpl      *invoiceTemplate
+		cents    int
+		currency string
+		expected string
+	}{
+		{en, 0, "usd", "$0.00"},
+		{en, 5, "usd", "$0.05"},
+		{en, 123456789, "usd", "$1,234,567.89"},
+		{en, 1099, "", "$10.99"},
+		{en, -150, "usd", "-$1.50"},
+		{en, -5, "USD", "-$0.05"},
+		{en, 123456, "eur", "1,234.56 EUR"},
+		{en, -123456, "eur", "-1,234.56 EUR"},
+		{de, 123456789, "eur", "1.234.567,89 €"},
+		{de, -1050, "chf", "-10,50 CHF"},
+		{fr, 123456, "usd", "1 234,56 $US"},
+	}
+	for _, tt := range tests {
+		if s := tt.tpl.formatCurrency(tt.cents, tt.currency); s != tt.expected {
+			t.Errorf("%s: expected %d %s formatted as %q but got %q", tt.tpl.Locale, tt.cents, tt.currency, tt.expected, s)
+		}
+	}
+}
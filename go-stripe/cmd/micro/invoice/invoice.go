@@ -1,19 +1,30 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"io/fs"
 	"log"
 	"net/http"
 	"os"
 	"strconv"
 	"time"
+
+	"github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/driver"
+	"github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/keyring"
+	"github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/models"
+	"github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/serviceauth"
+	"github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/storage"
 )
 
 const version = "1.0.0"
 
 type config struct {
 	port int
+	db   struct {
+		dsn string
+	}
 	smtp struct {
 		host     string
 		port     int
@@ -21,13 +32,44 @@ type config struct {
 		password string
 	}
 	frontEnd string
+	keys     *keyring.Keyring
+	storage  storage.Config
+	// paymentTermDays is the number of days invoices are due in unless order sets due date
+	paymentTermDays int
+	// keys shared with services calling this one; requests must be signed with one of them
+	serviceKeys   *keyring.Keyring
+	signatureSkew time.Duration
+	// jobs are run by that many workers and retried until they run out of attempts
+	jobs struct {
+		workers  int
+		attempts int
+		timeout  time.Duration
+	}
+	// invoices are also issued as UBL e-invoices; they are offered for download and attached
+	// to invoice emails only if attach is set. Seller is that of invoice's brand
+	einvoice struct {
+		country string
+		attach  bool
+	}
+	// invoices are rendered with templates of order's brand in its locale; brand is the default
+	// one for orders not naming one. Templates are bundled unless they are read from the directory
+	templates struct {
+		dir   string
+		brand string
+	}
 }
 
 type application struct {
-	config   config
-	infoLog  *log.Logger
-	errorLog *log.Logger
-	version  string
+	config    config
+	infoLog   *log.Logger
+	errorLog  *log.Logger
+	version   string
+	verifier  *serviceauth.Verifier
+	DB        models.DBModel
+	storage   storage.Store
+	templates *invoiceTemplates
+	jobSlots  chan struct{}
+	jobWake   chan struct{}
 }
 
 func (app *application) serve() error {
@@ -47,8 +89,20 @@ func main() {
 	var cfg config
 	flag.IntVar(&cfg.port, "port", 5000, "Server port to listen on")
 	flag.StringVar(&cfg.frontEnd, "frontend", "http://localhost:4000", "URL to front-end app")
+	flag.IntVar(&cfg.paymentTermDays, "payment-term", 30, "Number of days invoices are due in")
+	flag.DurationVar(&cfg.signatureSkew, "signature-skew", 5*time.Minute, "How old signed requests are accepted")
+	flag.IntVar(&cfg.jobs.workers, "workers", 4, "Number of invoice jobs run at once")
+	flag.IntVar(&cfg.jobs.attempts, "job-attempts", 5, "Number of attempts to run invoice job")
+	flag.DurationVar(&cfg.jobs.timeout, "job-timeout", time.Minute, "Timeout of single attempt to run invoice job")
+	flag.StringVar(&cfg.storage.Kind, "storage", storage.KindLocal, "Where invoice documents are kept {local|s3}")
+	flag.StringVar(&cfg.storage.Dir, "storage-dir", ".", "Directory of local document storage")
+	flag.StringVar(&cfg.einvoice.country, "seller-country", "US", "ISO 3166-1 alpha-2 code of seller's country in e-invoices")
+	flag.BoolVar(&cfg.einvoice.attach, "attach-einvoice", false, "Attach UBL e-invoices to invoice emails besides PDFs")
+	flag.StringVar(&cfg.templates.dir, "invoice-templates", "", "Directory of invoice templates used instead of bundled ones")
+	flag.StringVar(&cfg.templates.brand, "brand", "widgets", "Brand of invoices of orders not naming one")
 	flag.Parse()
 
+	cfg.db.dsn = os.Getenv("WIDGETS_DSN")
 	cfg.smtp.host = os.Getenv("SMTP_HOST")
 	var err error
 	cfg.smtp.port, err = strconv.Atoi(os.Getenv("SMTP_PORT"))
@@ -57,20 +111,74 @@ func main() {
 	}
 	cfg.smtp.username = os.Getenv("SMTP_USER")
 	cfg.smtp.password = os.Getenv("SMTP_PASSWORD")
+	cfg.storage.Endpoint = os.Getenv("WIDGET_S3_ENDPOINT")
+	cfg.storage.Region = os.Getenv("WIDGET_S3_REGION")
+	cfg.storage.Bucket = os.Getenv("WIDGET_S3_BUCKET")
+	cfg.storage.AccessKey = os.Getenv("WIDGET_S3_ACCESS_KEY")
+	cfg.storage.SecretKey = os.Getenv("WIDGET_S3_SECRET_KEY")
 
 	infoLog := log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime)
 	errorLog := log.New(os.Stdout, "ERROR\t", log.Ldate|log.Ltime|log.Lshortfile)
 
-	app := &application{
-		config:   cfg,
-		infoLog:  infoLog,
-		errorLog: errorLog,
-		version:  version,
+	// invoice download links are signed and job payloads encrypted with the keys shared with web app
+	cfg.keys, err = keyring.Parse(os.Getenv("WIDGET_SECRET_KEYS"), os.Getenv("WIDGET_ACTIVE_KEY_ID"), os.Getenv("WIDGET_SECRET_KEY"))
+	if err != nil {
+		errorLog.Fatal(err)
 	}
-	err = app.CreateDirIfNotExists("./invoices")
+	cfg.serviceKeys, err = keyring.Parse(os.Getenv("WIDGET_SERVICE_KEYS"), os.Getenv("WIDGET_SERVICE_ACTIVE_KEY_ID"), os.Getenv("WIDGET_SERVICE_KEY"))
 	if err != nil {
-		log.Fatal(err)
+		errorLog.Fatal(err)
+	}
+	// accepted jobs hold customers' data, which is encrypted at rest like in the other services
+	indexKey := os.Getenv("WIDGET_BLIND_INDEX_KEY")
+	if indexKey == "" {
+		indexKey = os.Getenv("WIDGET_SECRET_KEY")
+	}
+	// invoicing service reads no secrets that may be stored in legacy format
+	if err = models.ConfigureFieldEncryption(cfg.keys, []byte(indexKey), false); err != nil {
+		errorLog.Fatal(err)
+	}
+	if cfg.jobs.workers < 1 {
+		errorLog.Fatal("at least one worker is required")
+	}
+	// templates are checked before any job is taken, so that broken ones do not fail invoices
+	var templateFS fs.FS = invoiceTemplateFS
+	templateRoot := "invoice-templates"
+	if cfg.templates.dir != "" {
+		templateFS, templateRoot = os.DirFS(cfg.templates.dir), "."
+	}
+	templates, err := loadInvoiceTemplates(templateFS, templateRoot, cfg.templates.brand)
+	if err != nil {
+		errorLog.Fatal(err)
+	}
+
+	// invoices are numbered by DB, so that numbers have no gaps
+	conn, err := driver.OpenDB(cfg.db.dsn)
+	if err != nil {
+		errorLog.Fatal(err)
+	}
+	sqlDB, _ := conn.DB()
+	defer sqlDB.Close()
+	infoLog.Println("Connected to DB!")
+
+	store, err := storage.New(cfg.storage)
+	if err != nil {
+		errorLog.Fatal(err)
+	}
+
+	app := &application{
+		config:    cfg,
+		infoLog:   infoLog,
+		errorLog:  errorLog,
+		version:   version,
+		verifier:  serviceauth.NewVerifier(cfg.serviceKeys, cfg.signatureSkew),
+		DB:        models.DBModel{DB: conn},
+		storage:   store,
+		templates: templates,
+		jobSlots:  make(chan struct{}, cfg.jobs.workers),
+		jobWake:   make(chan struct{}, 1),
 	}
+	go app.runJobs(context.Background())
 	err = app.serve()
 	if err != nil {
 		log.Fatal(err)
@@ -14,7 +14,7 @@ import (
 //go:embed email-templates
 var emailTemplateFS embed.FS
 
-func (app *application) SendMail(from, to, subject, tmpl string, attachments []string, data any) error {
+func (app *application) SendMail(from, to, subject, tmpl string, attachments []*mail.File, data any) error {
 	templateToRender := fmt.Sprintf("email-templates/%s.html.tmpl", tmpl)
 
 	t, err := template.New("email-html").ParseFS(emailTemplateFS, templateToRender)
@@ -66,10 +66,8 @@ func (app *application) SendMail(from, to, subject, tmpl string, attachments []s
 		SetBody(mail.TextHTML, formattedMessage).
 		AddAlternative(mail.TextPlain, plainMessage)
 
-	if len(attachments) > 0 {
-		for _, aPath := range attachments {
-			email.AddAttachment(aPath)
-		}
+	for _, a := range attachments {
+		email.Attach(a)
 	}
 
 	err = email.Send(smtpClient)
@@ -1,17 +1,17 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"strconv"
 	"time"
 
 	"github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/cards"
 	common_models "github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/common"
-	"github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/encryption"
 	"github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/models"
+	"github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/storage"
 	"github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/urlsigner"
 	"github.com/go-chi/chi/v5"
 )
@@ -45,6 +45,7 @@ func (app *application) ShowSale(w http.ResponseWriter, r *http.Request) {
 		"backUrl":         "/admin/all-sales",
 		"backCaption":     "Back to all sales",
 		"refund-url":      "/api/admin/refund",
+		"refund-perm":     models.PermRefund,
 		"refund-btn":      "Refund order",
 		"refunded-msg":    "Charge refunded!",
 		"refunded-status": "refunded",
@@ -55,12 +56,89 @@ func (app *application) ShowSale(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// DownloadSaleInvoice sends PDF invoice of the order, or its UBL e-invoice, to admins
+func (app *application) DownloadSaleInvoice(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	invoice, err := app.DB.GetInvoiceByOrderID(id)
+	if err != nil {
+		app.errorLog.Println(err)
+		http.NotFound(w, r)
+		return
+	}
+	app.serveInvoice(w, r, invoice)
+}
+
+// DownloadInvoice sends PDF invoice, or its UBL e-invoice, to customer following signed link from invoice email
+func (app *application) DownloadInvoice(w http.ResponseWriter, r *http.Request) {
+	testUrl := fmt.Sprintf("%s%s", app.config.frontEnd, r.RequestURI)
+	signer := urlsigner.Signer{
+		Keys: app.config.keys,
+	}
+	if valid := signer.VerifyToken(testUrl); !valid {
+		app.errorLog.Printf("Invalid URL tampering detected: %q\n", testUrl)
+		http.NotFound(w, r)
+		return
+	}
+	if signer.Expired(testUrl, int(app.config.invoiceLinkTTL.Minutes())) {
+		http.Error(w, "The link has expired; please contact us to get the invoice.", http.StatusGone)
+		return
+	}
+	invoice, err := app.DB.GetInvoiceByNumber(r.URL.Query().Get("number"))
+	if err != nil {
+		app.errorLog.Println(err)
+		http.NotFound(w, r)
+		return
+	}
+	app.serveInvoice(w, r, invoice)
+}
+
+// serveInvoice streams invoice's PDF from document storage, or its UBL e-invoice if format is "xml"
+func (app *application) serveInvoice(w http.ResponseWriter, r *http.Request, invoice models.Invoice) {
+	key, contentType, ext := invoice.PDFPath, "application/pdf", "pdf"
+	switch r.URL.Query().Get("format") {
+	case "", "pdf":
+	case "xml":
+		key, contentType, ext = invoice.XMLPath, "application/xml", "xml"
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if key == "" {
+		http.NotFound(w, r)
+		return
+	}
+	doc, err := app.storage.Get(r.Context(), key)
+	if errors.Is(err, storage.ErrNotFound) {
+		app.errorLog.Println(err)
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		app.errorLog.Println(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	defer doc.Close()
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fmt.Sprintf("invoice-%s.%s", invoice.Number, ext)))
+	w.Header().Set("Cache-Control", "private, no-store")
+	if _, err = io.Copy(w, doc); err != nil {
+		app.errorLog.Println(fmt.Errorf("error sending invoice %s: %w", invoice.Number, err))
+	}
+}
+
 func (app *application) ShowSubscription(w http.ResponseWriter, r *http.Request) {
 	td := &templateData{StringMap: map[string]string{
 		"title":           "Subscription",
 		"backUrl":         "/admin/all-subscriptions",
 		"backCaption":     "Back to all subscriptions",
 		"refund-url":      "/api/admin/cancel-subscription",
+		"refund-perm":     models.PermCancelSubscription,
 		"refund-btn":      "Cancel subscription",
 		"refunded-msg":    "Subscription cancelled!",
 		"refunded-status": "cancelled",
@@ -87,6 +165,58 @@ func (app *application) OneUser(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// AuditLog shows searchable log of privileged actions performed by admin users
+func (app *application) AuditLog(w http.ResponseWriter, r *http.Request) {
+	td := &templateData{}
+	if err := app.renderTemplate(w, r, "audit-log", td); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// Tokens shows devices the logged in user is signed in on and allows to revoke them
+func (app *application) Tokens(w http.ResponseWriter, r *http.Request) {
+	td := &templateData{}
+	if err := app.renderTemplate(w, r, "tokens", td); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// TwoFactor allows the logged in user to enroll into two-factor authentication
+func (app *application) TwoFactor(w http.ResponseWriter, r *http.Request) {
+	user, err := app.DB.GetUserByID(app.Session.GetInt(r.Context(), "userID"))
+	if err != nil {
+		app.errorLog.Println(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	td := &templateData{Data: map[string]any{"enabled": user.TOTPEnabled}}
+	if err := app.renderTemplate(w, r, "two-factor", td); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// APIKeys shows API keys of integrations and allows to create and revoke them
+func (app *application) APIKeys(w http.ResponseWriter, r *http.Request) {
+	td := &templateData{}
+	if err := app.renderTemplate(w, r, "api-keys", td); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+func (app *application) Sessions(w http.ResponseWriter, r *http.Request) {
+	td := &templateData{}
+	if err := app.renderTemplate(w, r, "sessions", td); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+func (app *application) Outbox(w http.ResponseWriter, r *http.Request) {
+	td := &templateData{}
+	if err := app.renderTemplate(w, r, "outbox", td); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
 // Home displays the home page
 func (app *application) Home(w http.ResponseWriter, r *http.Request) {
 	td := &templateData{}
@@ -177,6 +307,11 @@ func (app *application) PaymentSucceeded(w http.ResponseWriter, r *http.Request)
 		app.errorLog.Println(fmt.Errorf("error converting widget id: %w", err))
 		return
 	}
+	widget, err := app.DB.GetWidget(widgetID)
+	if err != nil {
+		app.errorLog.Println(err)
+		return
+	}
 	txnData, err := app.GetTransactionData(r)
 	if err != nil {
 		app.infoLog.Println(err)
@@ -208,7 +343,8 @@ func (app *application) PaymentSucceeded(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	// create a new order
+	// create a new order; invoice for it is generated and sent to customer by microservice,
+	// that gets it from the outbox
 	order := models.Order{
 		WidgetID:      widgetID,
 		TransactionID: txnID,
@@ -216,59 +352,34 @@ func (app *application) PaymentSucceeded(w http.ResponseWriter, r *http.Request)
 		StatusID:      1, // Cleared
 		Quantity:      1,
 		Amount:        txnData.PaymentAmount,
-		DBEntity: models.DBEntity{
+		Locale:        common_models.PreferredLocale(r.Header.Get("Accept-Language")),
+	}
+	_, err = app.DB.InsertOrderWithMessage(order, models.OutboxTopicInvoice, func(orderID int) any {
+		return common_models.Order{
+			ID:            orderID,
+			TransactionID: order.TransactionID,
+			Amount:        order.Amount,
+			Currency:      txnData.PaymentCurrency,
+			Items: []common_models.OrderItem{
+				{Product: "Widget", Quantity: order.Quantity, UnitPrice: order.Amount / order.Quantity, Amount: order.Amount},
+			},
+			FirstName: txnData.FirstName,
+			LastName:  txnData.LastName,
+			Email:     txnData.Email,
+			Locale:    order.Locale,
+			Brand:     widget.Brand,
 			CreatedAt: time.Now(),
-			UpdatedAt: time.Now(),
-		},
-	}
-	orderID, err := app.SaveOrder(order)
+		}
+	})
 	if err != nil {
 		app.errorLog.Println(err)
 		return
 	}
 
-	// call the microservice that forms invoice and send it to customer
-	invoice := common_models.Order{
-		ID:        orderID,
-		Amount:    order.Amount,
-		Product:   "Widget",
-		Quantity:  order.Quantity,
-		FirstName: txnData.FirstName,
-		LastName:  txnData.LastName,
-		Email:     txnData.Email,
-		CreatedAt: time.Now(),
-	}
-	err = app.callInvoiceMicro(invoice)
-	if err != nil {
-		app.errorLog.Println(err)
-		app.Session.Put(r.Context(), "error", fmt.Sprintf("Error generating invoice: %s", err))
-	}
-
 	app.Session.Put(r.Context(), "receipt", txnData)
 	http.Redirect(w, r, "/receipt", http.StatusSeeOther)
 }
 
-func (app *application) callInvoiceMicro(inv common_models.Order) error {
-	url := "http://localhost:5000/invoice/create-and-send"
-	out, err := json.MarshalIndent(inv, "", "  ")
-	if err != nil {
-		return fmt.Errorf("error marshalling invoice: %w", err)
-	}
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(out))
-	if err != nil {
-		return fmt.Errorf("error creating request: %w", err)
-	}
-	req.Header.Set("Content-Type", "application/json")
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return fmt.Errorf("error calling invoice microservice: %w", err)
-	}
-	defer resp.Body.Close()
-	app.infoLog.Println(resp.Body)
-	return nil
-}
-
 func (app *application) Receipt(w http.ResponseWriter, r *http.Request) {
 	txn := app.Session.Pop(r.Context(), "receipt").(TransactionData)
 	data := map[string]any{
@@ -333,17 +444,13 @@ func (app *application) SaveCustomer(firstName, lastName, email string) (int, er
 		LastName:  lastName,
 		Email:     email,
 	}
-	return app.DB.InsertCustomer(customer)
+	return app.DB.FindOrInsertCustomer(customer)
 }
 
 func (app *application) SaveTransaction(txn models.Transaction) (int, error) {
 	return app.DB.InsertTransaction(txn)
 }
 
-func (app *application) SaveOrder(order models.Order) (int, error) {
-	return app.DB.InsertOrder(order)
-}
-
 // ChargeOnce displays the page to buy one widget
 func (app *application) ChargeOnce(w http.ResponseWriter, r *http.Request) {
 	id := chi.URLParam(r, "id")
@@ -405,17 +512,85 @@ func (app *application) PostLoginPage(w http.ResponseWriter, r *http.Request) {
 
 	email := r.Form.Get("email")
 	password := r.Form.Get("password")
+	ip := app.config.security.trustedProxies.ClientIP(r)
+	if err = app.guard.Check(models.ThrottleLogin, email, ip); err != nil {
+		app.errorLog.Println(err)
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
 	id, err := app.DB.Authenticate(email, password)
+	if err != nil {
+		app.errorLog.Println(err)
+		if err = app.guard.Fail(models.ThrottleLogin, email, ip); err != nil {
+			app.errorLog.Println(err)
+		}
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	user, err := app.DB.GetUserByID(id)
+	if err != nil {
+		app.errorLog.Println(err)
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	if user.TOTPEnabled {
+		code := r.Form.Get("code")
+		if code == "" {
+			app.renderLoginPage(w, r, email, "Two-factor authentication code required")
+			return
+		}
+		codeMatches, err := app.DB.VerifySecondFactor(user, code, app.config.keys)
+		if err != nil {
+			app.errorLog.Println(err)
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+		if !codeMatches {
+			app.infoLog.Printf("Incorrect two-factor code entered by: %s\n", email)
+			if err = app.guard.Fail(models.ThrottleLogin, email, ip); err != nil {
+				app.errorLog.Println(err)
+			}
+			app.renderLoginPage(w, r, email, "Invalid two-factor authentication code")
+			return
+		}
+	}
+	if err = app.guard.Succeed(models.ThrottleLogin, email); err != nil {
+		app.errorLog.Println(err)
+	}
+
+	// API token is issued along with the session, so that admin pages calling back end
+	// are logged in too; both expire together and are revoked together on logout
+	token, err := app.DB.StartUserSession(user, app.Session.Token(r.Context()), ip, r.UserAgent(), app.Session.Lifetime)
 	if err != nil {
 		app.errorLog.Println(err)
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
 		return
 	}
+	// token of anonymous session must not outlive the login
+	app.Session.Remove(r.Context(), csrfSessionKey)
 	app.Session.Put(r.Context(), "userID", id)
+	// the token is handed to the page once, see addDefaultData
+	app.Session.Put(r.Context(), apiTokenSessionKey, token.PlainText)
+	app.Session.Put(r.Context(), apiTokenExpirySessionKey, token.Expiry.Format(time.RFC3339))
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
+// renderLoginPage renders login form asking for two-factor authentication code
+func (app *application) renderLoginPage(w http.ResponseWriter, r *http.Request, email, message string) {
+	td := &templateData{
+		Error: message,
+		Data:  map[string]any{"email": email, "two_factor_required": true},
+	}
+	if err := app.renderTemplate(w, r, "login", td); err != nil {
+		app.errorLog.Println(fmt.Errorf("error rendering template: %w", err))
+	}
+}
+
 func (app *application) Logout(w http.ResponseWriter, r *http.Request) {
+	if err := app.DB.EndUserSession(app.Session.Token(r.Context())); err != nil {
+		app.errorLog.Println(err)
+	}
 	app.Session.Destroy(r.Context())
 	app.Session.RenewToken(r.Context())
 	http.Redirect(w, r, "/login", http.StatusSeeOther)
@@ -429,10 +604,10 @@ func (app *application) ForgotPassword(w http.ResponseWriter, r *http.Request) {
 }
 
 func (app *application) ShowResetPassword(w http.ResponseWriter, r *http.Request) {
-	email := r.URL.Query().Get("email")
+	token := r.URL.Query().Get("token")
 	testUrl := fmt.Sprintf("%s%s", app.config.frontEnd, r.RequestURI)
 	signer := urlsigner.Signer{
-		Secret: []byte(app.config.secretKey),
+		Keys: app.config.keys,
 	}
 	if valid := signer.VerifyToken(testUrl); !valid {
 		app.errorLog.Printf("Invalid URL tampering detected: %q\n", testUrl)
@@ -440,24 +615,20 @@ func (app *application) ShowResetPassword(w http.ResponseWriter, r *http.Request
 	}
 
 	// make sure token has not expired yet
-	expired := signer.Expired(testUrl, 60)
+	expired := signer.Expired(testUrl, int(app.config.passwordResetTTL.Minutes()))
 	if expired {
 		app.errorLog.Println("Change password URL has been expired.")
 		return
 	}
 
-	encryptor := encryption.Encryption{
-		Key: []byte(app.config.secretKey),
-	}
-
-	encryptedEmail, err := encryptor.Encrypt(email)
-	if err != nil {
+	// make sure token has not been used or invalidated by password change
+	if _, err := app.DB.GetUserForPasswordReset(token); err != nil {
 		app.errorLog.Println(err)
 		return
 	}
 
 	data := map[string]any{
-		"email": encryptedEmail,
+		"token": token,
 	}
 	if err := app.renderTemplate(w, r, "reset-password", &templateData{
 		Data: data,
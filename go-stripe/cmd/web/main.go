@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/gob"
 	"flag"
 	"fmt"
@@ -8,10 +9,18 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/driver"
+	"github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/keyring"
+	"github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/lockout"
+	"github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/mailer"
+	"github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/middleware"
 	"github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/models"
+	"github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/outbox"
+	"github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/serviceauth"
+	"github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/storage"
 	"github.com/alexedwards/scs/mysqlstore"
 	"github.com/alexedwards/scs/v2"
 )
@@ -32,8 +41,28 @@ type config struct {
 		secret string
 		key    string
 	}
-	secretKey string
-	frontEnd  string
+	smtp struct {
+		host     string
+		port     int
+		username string
+		password string
+	}
+	keys             *keyring.Keyring
+	frontEnd         string
+	invoice          string
+	passwordResetTTL time.Duration
+	sessionLifetime  time.Duration
+	invoiceLinkTTL   time.Duration
+	storage          storage.Config
+	security         struct {
+		policy        middleware.Policy
+		cspReportOnly bool
+		cspReportURI  string
+		// trustedProxies may set X-Forwarded-For header with client's address
+		trustedProxies lockout.Proxies
+	}
+	// serviceKeys are shared with invoicing microservice to sign requests to it
+	serviceKeys *keyring.Keyring
 }
 
 type application struct {
@@ -44,6 +73,8 @@ type application struct {
 	version       string
 	DB            models.DBModel
 	Session       *scs.SessionManager
+	guard         *lockout.Guard
+	storage       storage.Store
 }
 
 func (app *application) serve() error {
@@ -60,6 +91,40 @@ func (app *application) serve() error {
 	return srv.ListenAndServe()
 }
 
+// contentSecurityPolicy permits pages to load scripts from this server, Stripe.js and Bootstrap
+// pinned to its version on the CDN, and to call back end and Stripe only. Inline scripts must
+// carry nonce of the response, which is added to script-src by SecurityHeaders
+func contentSecurityPolicy(cfg config) (middleware.Policy, error) {
+	api, err := middleware.Origin(cfg.api)
+	if err != nil {
+		return nil, err
+	}
+	ws, err := middleware.WebSocketOrigin(cfg.frontEnd)
+	if err != nil {
+		return nil, err
+	}
+	const (
+		bootstrapCSS = "https://cdn.jsdelivr.net/npm/bootstrap@5.2.3/dist/css/bootstrap.min.css"
+		bootstrapJS  = "https://cdn.jsdelivr.net/npm/bootstrap@5.2.3/dist/js/bootstrap.bundle.min.js"
+	)
+
+	p := middleware.Policy{
+		"default-src":     {"'self'"},
+		"base-uri":        {"'self'"},
+		"form-action":     {"'self'"},
+		"frame-ancestors": {"'none'"},
+		"object-src":      {"'none'"},
+		"img-src":         {"'self'", "data:"},
+		"script-src":      {"'self'", bootstrapJS},
+		"style-src":       {"'self'", bootstrapCSS},
+		"connect-src":     {"'self'", api, ws},
+	}
+	p.Add("script-src", middleware.StripeScriptSources...)
+	p.Add("frame-src", middleware.StripeFrameSources...)
+	p.Add("connect-src", middleware.StripeConnectSources...)
+	return p, nil
+}
+
 func main() {
 	gob.Register(TransactionData{})
 
@@ -69,16 +134,66 @@ func main() {
 	flag.StringVar(&cfg.env, "env", "development", "Application environment {development|production}")
 	flag.StringVar(&cfg.api, "api", "http://localhost:4001", "URL to API")
 	flag.StringVar(&cfg.frontEnd, "frontend", "http://localhost:4000", "URL to front-end app (this one)")
+	flag.StringVar(&cfg.invoice, "invoice", "http://localhost:5000", "URL to invoicing microservice")
+	flag.DurationVar(&cfg.passwordResetTTL, "reset-ttl", time.Hour, "Lifetime of password reset links")
+	flag.DurationVar(&cfg.invoiceLinkTTL, "invoice-link-ttl", 30*24*time.Hour, "Lifetime of invoice download links sent to customers")
+	flag.StringVar(&cfg.storage.Kind, "storage", storage.KindLocal, "Where invoice documents are kept {local|s3}")
+	flag.StringVar(&cfg.storage.Dir, "storage-dir", ".", "Directory of local document storage")
+	flag.DurationVar(&cfg.sessionLifetime, "session-lifetime", 12*time.Hour, "Lifetime of login sessions and API tokens issued with them")
+	flag.BoolVar(&cfg.security.cspReportOnly, "csp-report-only", false, "Only report Content Security Policy violations instead of blocking")
+	flag.StringVar(&cfg.security.cspReportURI, "csp-report-uri", "", "URI browsers report Content Security Policy violations to")
+	trustedProxies := flag.String("trusted-proxies", "", "Comma separated addresses and CIDR networks of reverse proxies trusted to set X-Forwarded-For header")
+	legacyCiphertext := flag.Bool("legacy-ciphertext", true, "Decrypt secrets stored in legacy unauthenticated format; turn off once -encrypt-pii has re-encrypted them")
 	flag.Parse()
 
 	cfg.stripe.key = os.Getenv("STRIPE_KEY")
 	cfg.stripe.secret = os.Getenv("STRIPE_SECRET")
 	cfg.db.dsn = os.Getenv("WIDGETS_DSN")
-	cfg.secretKey = os.Getenv("WIDGET_SECRET_KEY")
+
+	cfg.smtp.host = os.Getenv("SMTP_HOST")
+	var err error
+	cfg.smtp.port, err = strconv.Atoi(os.Getenv("SMTP_PORT"))
+	if err != nil {
+		cfg.smtp.port = 1025
+	}
+	cfg.smtp.username = os.Getenv("SMTP_USER")
+	cfg.smtp.password = os.Getenv("SMTP_PASSWORD")
+	cfg.storage.Endpoint = os.Getenv("WIDGET_S3_ENDPOINT")
+	cfg.storage.Region = os.Getenv("WIDGET_S3_REGION")
+	cfg.storage.Bucket = os.Getenv("WIDGET_S3_BUCKET")
+	cfg.storage.AccessKey = os.Getenv("WIDGET_S3_ACCESS_KEY")
+	cfg.storage.SecretKey = os.Getenv("WIDGET_S3_SECRET_KEY")
 
 	infoLog := log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime)
 	errorLog := log.New(os.Stdout, "ERROR\t", log.Ldate|log.Ltime|log.Lshortfile)
 
+	cfg.security.policy, err = contentSecurityPolicy(cfg)
+	if err != nil {
+		errorLog.Fatal(err)
+	}
+	cfg.security.trustedProxies, err = lockout.ParseProxies(*trustedProxies)
+	if err != nil {
+		errorLog.Fatal(err)
+	}
+
+	// WIDGET_SECRET_KEY is still accepted for links and data made before keys got IDs
+	cfg.keys, err = keyring.Parse(os.Getenv("WIDGET_SECRET_KEYS"), os.Getenv("WIDGET_ACTIVE_KEY_ID"), os.Getenv("WIDGET_SECRET_KEY"))
+	if err != nil {
+		errorLog.Fatal(err)
+	}
+	cfg.serviceKeys, err = keyring.Parse(os.Getenv("WIDGET_SERVICE_KEYS"), os.Getenv("WIDGET_SERVICE_ACTIVE_KEY_ID"), os.Getenv("WIDGET_SERVICE_KEY"))
+	if err != nil {
+		errorLog.Fatal(err)
+	}
+	// blind index key can not be rotated, so it is configured separately from the keyring
+	indexKey := os.Getenv("WIDGET_BLIND_INDEX_KEY")
+	if indexKey == "" {
+		indexKey = os.Getenv("WIDGET_SECRET_KEY")
+	}
+	if err = models.ConfigureFieldEncryption(cfg.keys, []byte(indexKey), *legacyCiphertext); err != nil {
+		errorLog.Fatal(err)
+	}
+
 	infoLog.Printf("Trying to connect to DB with DSN: %q\n", cfg.db.dsn)
 	conn, err := driver.OpenDB(cfg.db.dsn)
 	if err != nil {
@@ -90,9 +205,15 @@ func main() {
 
 	// set up session
 	session = scs.New()
-	session.Lifetime = 12 * time.Hour
+	session.Lifetime = cfg.sessionLifetime
 	session.Store = mysqlstore.New(sqlDB)
 
+	// invoices are rendered by the microservice into the same storage
+	store, err := storage.New(cfg.storage)
+	if err != nil {
+		errorLog.Fatal(err)
+	}
+
 	tc := map[string]*template.Template{}
 
 	app := &application{
@@ -103,10 +224,27 @@ func main() {
 		version:       version,
 		DB:            models.DBModel{DB: conn},
 		Session:       session,
+		storage:       store,
 	}
+	// lockout notices are sent by the guard, which brings its own templates
+	app.guard = lockout.New(&app.DB, &mailer.Mailer{
+		Host:     cfg.smtp.host,
+		Port:     cfg.smtp.port,
+		Username: cfg.smtp.username,
+		Password: cfg.smtp.password,
+	}, "info@widget.com", errorLog)
 
 	go app.ListenToWsChannel()
 
+	// invoices are delivered from the outbox, so that none of them is lost while the microservice is down;
+	// requests to it are signed with the key shared with it
+	invoiceClient := &http.Client{Transport: (&serviceauth.Signer{Keys: cfg.serviceKeys}).Transport(nil)}
+	dispatcher := outbox.New(&app.DB, map[string]outbox.Handler{
+		models.OutboxTopicInvoice:    outbox.PostJSON(invoiceClient, cfg.invoice+"/invoice/create-and-send"),
+		models.OutboxTopicCreditNote: outbox.PostJSON(invoiceClient, cfg.invoice+"/invoice/credit-note"),
+	}, infoLog, errorLog)
+	go dispatcher.Run(context.Background())
+
 	err = app.serve()
 	if err != nil {
 		app.errorLog.Println(err)
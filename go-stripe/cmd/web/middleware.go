@@ -1,11 +1,63 @@
 package main
 
-import "net/http"
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"strings"
+)
+
+const (
+	// csrfSessionKey is the session key CSRF token is stored by
+	csrfSessionKey = "csrf_token"
+	// csrfFormField and csrfHeader carry CSRF token in forms and in JS requests respectively
+	csrfFormField = "csrf_token"
+	csrfHeader    = "X-CSRF-Token"
+
+	// apiTokenSessionKey and apiTokenExpirySessionKey keep API token issued on login
+	// until it is handed to the page
+	apiTokenSessionKey       = "api_token"
+	apiTokenExpirySessionKey = "api_token_expiry"
+)
 
 func SessionLoad(next http.Handler) http.Handler {
 	return session.LoadAndSave(next)
 }
 
+// skipStatic bypasses the middleware for static files, which need no session; loading and
+// validating it would cost DB queries for every asset
+func skipStatic(mw func(http.Handler) http.Handler) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		withMiddleware := mw(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if strings.HasPrefix(r.URL.Path, "/static/") {
+				next.ServeHTTP(w, r)
+				return
+			}
+			withMiddleware.ServeHTTP(w, r)
+		})
+	}
+}
+
+// ValidateSession logs user out if the session has been revoked, i.e. by administrator
+// or by logging out with API token issued along with it. It must be used after SessionLoad
+func (app *application) ValidateSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.Session.Exists(r.Context(), "userID") {
+			alive, err := app.DB.TouchUserSession(app.Session.Token(r.Context()))
+			if err != nil {
+				app.errorLog.Println(err)
+			}
+			if !alive && err == nil {
+				app.Session.Destroy(r.Context())
+				app.Session.RenewToken(r.Context())
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 func (app *application) Auth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if !app.Session.Exists(r.Context(), "userID") {
@@ -15,3 +67,61 @@ func (app *application) Auth(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+// RequirePermission allows request only if logged in user's role grants the permission.
+// It must be used after Auth middleware
+func (app *application) RequirePermission(permission string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			allowed, err := app.DB.HasPermission(app.Session.GetInt(r.Context(), "userID"), permission)
+			if err != nil {
+				app.errorLog.Println(err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+			if !allowed {
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// CSRF rejects state-changing requests that do not carry CSRF token of the session either
+// in the form or in the header. Tokens are issued to pages by addDefaultData
+func (app *application) CSRF(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		expected := app.Session.GetString(r.Context(), csrfSessionKey)
+		actual := r.Header.Get(csrfHeader)
+		if actual == "" {
+			actual = r.PostFormValue(csrfFormField)
+		}
+		if expected == "" || subtle.ConstantTimeCompare([]byte(expected), []byte(actual)) != 1 {
+			app.errorLog.Printf("CSRF token mismatch on %s %s\n", r.Method, r.URL.Path)
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// csrfToken returns CSRF token of the session, generating it if there is none yet
+func (app *application) csrfToken(r *http.Request) (string, error) {
+	if token := app.Session.GetString(r.Context(), csrfSessionKey); token != "" {
+		return token, nil
+	}
+	rndBytes := make([]byte, 32)
+	if _, err := rand.Read(rndBytes); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(rndBytes)
+	app.Session.Put(r.Context(), csrfSessionKey, token)
+	return token, nil
+}
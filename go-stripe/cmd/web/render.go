@@ -6,14 +6,21 @@ import (
 	"html/template"
 	"net/http"
 	"strings"
+
+	"github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/middleware"
 )
 
+// templateData is passed to templates. Nonce must be carried by every script tag,
+// as Content Security Policy allows no other scripts
 type templateData struct {
 	StringMap            map[string]string
 	IntMap               map[string]int
 	FloatMap             map[string]float32
 	Data                 map[string]any
 	CSRFToken            string
+	Nonce                string
+	APIToken             string
+	APITokenExpiry       string
 	Flash                string
 	Warning              string
 	Error                string
@@ -23,6 +30,13 @@ type templateData struct {
 	CSSVersion           string
 	StripeSecretKey      string
 	StripePublishableKey string
+	Permissions          map[string]bool
+}
+
+// Can reports if logged in user is permitted to perform the action; used by templates
+// to hide actions the user can not perform
+func (td *templateData) Can(permission string) bool {
+	return td.Permissions[permission]
 }
 
 var functions = template.FuncMap{
@@ -42,9 +56,26 @@ func (app *application) addDefaultData(td *templateData, r *http.Request) *templ
 	td.StripeSecretKey = app.config.stripe.secret
 	td.StripePublishableKey = app.config.stripe.key
 
+	token, err := app.csrfToken(r)
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+	td.CSRFToken = token
+	td.Nonce = middleware.Nonce(r)
+
 	if app.Session.Exists(r.Context(), "userID") {
 		td.IsAuthenticated = 1
 		td.UserID = app.Session.GetInt(r.Context(), "userID")
+		td.APIToken = app.Session.PopString(r.Context(), apiTokenSessionKey)
+		td.APITokenExpiry = app.Session.PopString(r.Context(), apiTokenExpirySessionKey)
+		td.Permissions = map[string]bool{}
+		perms, err := app.DB.GetPermissionsForUser(td.UserID)
+		if err != nil {
+			app.errorLog.Println(err)
+		}
+		for _, p := range perms {
+			td.Permissions[p] = true
+		}
 	} else {
 		td.IsAuthenticated = 0
 		td.UserID = 0
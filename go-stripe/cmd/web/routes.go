@@ -3,28 +3,47 @@ package main
 import (
 	"net/http"
 
+	"github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/middleware"
+	"github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/models"
 	"github.com/go-chi/chi/v5"
 )
 
 func (app *application) routes() http.Handler {
 	mux := chi.NewRouter()
-	mux.Use(SessionLoad)
+	mux.Use(middleware.SecurityHeaders(middleware.Options{
+		Policy:      app.config.security.policy,
+		ReportOnly:  app.config.security.cspReportOnly,
+		ReportURI:   app.config.security.cspReportURI,
+		HSTS:        app.config.env == "production",
+		ScriptNonce: true,
+	}))
+	mux.Use(skipStatic(SessionLoad))
+	mux.Use(skipStatic(app.ValidateSession))
+	mux.Use(skipStatic(app.CSRF))
 	mux.Get("/", app.Home)
 	mux.Get("/ws", app.WsEndPoint)
 	mux.Route("/admin", func(mux chi.Router) {
 		mux.Use(app.Auth)
 
-		mux.Get("/virtual-terminal", app.VirtualTerminal)
-		mux.Get("/all-sales", app.AllSales)
-		mux.Get("/all-subscriptions", app.AllSubscriptions)
-		mux.Get("/sales/{id}", app.ShowSale)
-		mux.Get("/subscriptions/{id}", app.ShowSubscription)
-		mux.Get("/all-users", app.AllUsers)
-		mux.Get("/all-users/{id}", app.OneUser)
+		mux.With(app.RequirePermission(models.PermVirtualTerminal)).Get("/virtual-terminal", app.VirtualTerminal)
+		mux.With(app.RequirePermission(models.PermViewSales)).Get("/all-sales", app.AllSales)
+		mux.With(app.RequirePermission(models.PermViewSales)).Get("/all-subscriptions", app.AllSubscriptions)
+		mux.With(app.RequirePermission(models.PermViewSales)).Get("/sales/{id}", app.ShowSale)
+		mux.With(app.RequirePermission(models.PermViewSales)).Get("/sales/{id}/invoice", app.DownloadSaleInvoice)
+		mux.With(app.RequirePermission(models.PermViewSales)).Get("/subscriptions/{id}", app.ShowSubscription)
+		mux.With(app.RequirePermission(models.PermViewUsers)).Get("/all-users", app.AllUsers)
+		mux.With(app.RequirePermission(models.PermViewUsers)).Get("/all-users/{id}", app.OneUser)
+		mux.With(app.RequirePermission(models.PermViewAuditLog)).Get("/audit-log", app.AuditLog)
+		mux.Get("/tokens", app.Tokens)
+		mux.Get("/two-factor", app.TwoFactor)
+		mux.With(app.RequirePermission(models.PermManageAPIKeys)).Get("/api-keys", app.APIKeys)
+		mux.With(app.RequirePermission(models.PermManageSessions)).Get("/sessions", app.Sessions)
+		mux.With(app.RequirePermission(models.PermManageOutbox)).Get("/outbox", app.Outbox)
 	})
 
 	mux.Post("/payment-succeeded", app.PaymentSucceeded)
 	mux.Get("/receipt", app.Receipt)
+	mux.Get("/invoice", app.DownloadInvoice)
 
 	mux.Get("/widget/{id}", app.ChargeOnce)
 
@@ -33,7 +52,7 @@ func (app *application) routes() http.Handler {
 
 	mux.Get("/login", app.LoginPage)
 	mux.Post("/login", app.PostLoginPage)
-	mux.Get("/logout", app.Logout)
+	mux.Post("/logout", app.Logout)
 	mux.Get("/forgot-password", app.ForgotPassword)
 	mux.Get("/reset-password", app.ShowResetPassword)
 
@@ -142,3 +142,19 @@ func (c *Card) CancelSubscription(subID string) error {
 	}
 	return nil
 }
+
+// GetLatestInvoice gets the latest invoice of subscription, which is the one of its current period
+func (c *Card) GetLatestInvoice(subID string) (*stripe.Invoice, error) {
+	stripe.Key = c.Secret
+
+	params := &stripe.SubscriptionParams{}
+	params.AddExpand("latest_invoice")
+	sub, err := subscription.Get(subID, params)
+	if err != nil {
+		return nil, fmt.Errorf("error getting subscription %q: %w", subID, err)
+	}
+	if sub.LatestInvoice == nil {
+		return nil, fmt.Errorf("subscription %q has no invoices", subID)
+	}
+	return sub.LatestInvoice, nil
+}
@@ -2,15 +2,126 @@ package common_models
 
 import "time"
 
-// Order is the type for all orders
+// Order is the type for all orders. Orders with Items list lines to be invoiced; older ones
+// have single line described by Product, Quantity and Amount. Amounts are in cents.
+// TransactionID is the charge invoiced; subscription renewals also have the billing period.
+// Brand and Locale (BCP 47 tag) select template invoice is rendered with; when brand is empty,
+// or there are no templates of it, the invoicing microservice's default brand is used, and when
+// locale is empty, or there is no such catalog, default locale of the brand
 type Order struct {
-	ID        int       `json:"id"`
-	StatusID  int       `json:"status_id"`
-	Quantity  int       `json:"quantity"`
-	Amount    int       `json:"amount"`
-	Product   string    `json:"product"`
-	FirstName string    `json:"first_name"`
-	LastName  string    `json:"last_name"`
-	Email     string    `json:"email"`
-	CreatedAt time.Time `json:"created_at"`
+	ID             int         `json:"id"`
+	TransactionID  int         `json:"transaction_id"`
+	StatusID       int         `json:"status_id"`
+	Quantity       int         `json:"quantity"`
+	Amount         int         `json:"amount"`
+	Currency       string      `json:"currency"`
+	Product        string      `json:"product"`
+	Items          []OrderItem `json:"items"`
+	Discount       int         `json:"discount"`
+	Tax            int         `json:"tax"`
+	FirstName      string      `json:"first_name"`
+	LastName       string      `json:"last_name"`
+	Email          string      `json:"email"`
+	BillingAddress Address     `json:"billing_address"`
+	DueDate        time.Time   `json:"due_date"`
+	PeriodStart    *time.Time  `json:"period_start,omitempty"`
+	PeriodEnd      *time.Time  `json:"period_end,omitempty"`
+	Locale         string      `json:"locale,omitempty"`
+	Brand          string      `json:"brand,omitempty"`
+	CreatedAt      time.Time   `json:"created_at"`
+}
+
+// OrderItem is the type for order lines. Amount is line's total; when it is zero
+// the total is Quantity times UnitPrice
+type OrderItem struct {
+	Product   string `json:"product"`
+	Quantity  int    `json:"quantity"`
+	UnitPrice int    `json:"unit_price"`
+	Amount    int    `json:"amount"`
+}
+
+// Reasons to credit invoice
+const (
+	CreditNoteReasonRefund = "refund"
+)
+
+// CreditNote is the type for requests to credit invoice of the charge once money is returned
+// to customer. TransactionID is the charge refunded and Amount is the amount returned
+type CreditNote struct {
+	OrderID       int    `json:"order_id"`
+	TransactionID int    `json:"transaction_id"`
+	Amount        int    `json:"amount"`
+	Reason        string `json:"reason"`
+	FirstName     string `json:"first_name"`
+	LastName      string `json:"last_name"`
+	Email         string `json:"email"`
+}
+
+// Address is the type for postal addresses
+type Address struct {
+	Line1      string `json:"line1"`
+	Line2      string `json:"line2"`
+	City       string `json:"city"`
+	State      string `json:"state"`
+	PostalCode string `json:"postal_code"`
+	Country    string `json:"country"`
+}
+
+// Total returns line's total
+func (i OrderItem) Total() int {
+	if i.Amount != 0 {
+		return i.Amount
+	}
+	return i.Quantity * i.UnitPrice
+}
+
+// LineItems returns lines of the order; single line is made of older orders' fields
+func (o Order) LineItems() []OrderItem {
+	if len(o.Items) > 0 {
+		return o.Items
+	}
+	item := OrderItem{Product: o.Product, Quantity: o.Quantity, Amount: o.Amount}
+	if o.Quantity > 0 && o.Amount%o.Quantity == 0 {
+		item.UnitPrice = o.Amount / o.Quantity
+	}
+	return []OrderItem{item}
+}
+
+// Subtotal returns sum of lines' totals
+func (o Order) Subtotal() int {
+	subtotal := 0
+	for _, item := range o.LineItems() {
+		subtotal += item.Total()
+	}
+	return subtotal
+}
+
+// Total returns the amount due: subtotal less discount plus tax
+func (o Order) Total() int {
+	return o.Subtotal() - o.Discount + o.Tax
+}
+
+// Lines returns non-empty lines of the address as they are printed
+func (a Address) Lines() []string {
+	var lines []string
+	for _, l := range []string{a.Line1, a.Line2, joinNonEmpty(", ", a.City, a.State, a.PostalCode), a.Country} {
+		if l != "" {
+			lines = append(lines, l)
+		}
+	}
+	return lines
+}
+
+func joinNonEmpty(sep string, parts ...string) string {
+	s := ""
+	for _, p := range parts {
+		if p == "" {
+			continue
+		}
+		if s != "" {
+			s += sep
+		}
+		s += p
+	}
+	return s
 }
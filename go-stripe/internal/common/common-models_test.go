@@ -0,0 +1,58 @@
+package common_models
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_OrderTotals(t *testing.T) {
+	order := Order{
+		Items: []OrderItem{
+			{Product: "Widget", Quantity: 3, UnitPrice: 1099},
+			{Product: "Shipping", Quantity: 1, Amount: 500},
+		},
+		Discount: 297,
+		Tax:      250,
+	}
+	if got := order.Subtotal(); got != 3797 {
+		t.Errorf("expected subtotal 3797, got %d", got)
+	}
+	if got := order.Total(); got != 3750 {
+		t.Errorf("expected total 3750, got %d", got)
+	}
+}
+
+func Test_OrderLineItemsOfSingleLineOrder(t *testing.T) {
+	order := Order{Product: "Widget", Quantity: 2, Amount: 2000}
+	want := []OrderItem{{Product: "Widget", Quantity: 2, UnitPrice: 1000, Amount: 2000}}
+	if got := order.LineItems(); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+	if got := order.Total(); got != 2000 {
+		t.Errorf("expected total 2000, got %d", got)
+	}
+}
+
+func Test_AddressLines(t *testing.T) {
+	a := Address{Line1: "1 Main St", City: "Springfield", State: "IL", PostalCode: "62701", Country: "US"}
+	want := []string{"1 Main St", "Springfield, IL, 62701", "US"}
+	if got := a.Lines(); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
+
+func Test_PreferredLocale(t *testing.T) {
+	tests := map[string]string{
+		"":                         "",
+		"de-DE,de;q=0.9,en;q=0.8":  "de-DE",
+		"en;q=0.5, fr-CA;q=0.8, *": "fr-CA",
+		"es;q=0, it":               "it",
+		"<script>,pt-BR;q=0.1":     "pt-BR",
+		"nl;q=0.7,sv;q=0.7":        "nl",
+	}
+	for header, want := range tests {
+		if got := PreferredLocale(header); got != want {
+			t.Errorf("PreferredLocale(%q): expected %q, got %q", header, want, got)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package common_models
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// maxLocaleLength is the longest locale kept; longer tags are private use ones nobody has templates for
+const maxLocaleLength = 35
+
+// PreferredLocale returns the locale of Accept-Language header value customer prefers most,
+// or an empty string if there is none
+func PreferredLocale(acceptLanguage string) string {
+	type choice struct {
+		tag string
+		q   float64
+	}
+	var choices []choice
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		tag = strings.TrimSpace(tag)
+		if !validLocale(tag) {
+			continue
+		}
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if name != "q" {
+				continue
+			}
+			v, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				v = 0
+			}
+			q = v
+		}
+		if q > 0 {
+			choices = append(choices, choice{tag: tag, q: q})
+		}
+	}
+	if len(choices) == 0 {
+		return ""
+	}
+	// tags of equal weight keep the order customer listed them in
+	sort.SliceStable(choices, func(i, j int) bool { return choices[i].q > choices[j].q })
+	return choices[0].tag
+}
+
+// validLocale reports if tag looks like BCP 47 language tag: alphanumeric subtags separated by hyphens
+func validLocale(tag string) bool {
+	if tag == "" || len(tag) > maxLocaleLength {
+		return false
+	}
+	for _, subtag := range strings.Split(tag, "-") {
+		if subtag == "" || len(subtag) > 8 {
+			return false
+		}
+		for _, r := range subtag {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9') {
+				return false
+			}
+		}
+	}
+	return true
+}
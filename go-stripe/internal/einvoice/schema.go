@@ -0,0 +1,470 @@
+package einvoice
+
+import (
+	"bytes"
+	"embed"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//go:embed ubl-subset/*.xsd
+var schemaFS embed.FS
+
+// invoiceSchema is the document schema of the bundled UBL subset
+const invoiceSchema = "ubl-subset/UBL-Invoice-2.1.xsd"
+
+const xsdNamespace = "http://www.w3.org/2001/XMLSchema"
+
+// Schema checks documents against the bundled subset of UBL 2.1, trimmed to the elements our
+// invoices use. It is neither the OASIS schema set nor a full XSD validator: it reads only global
+// elements, complex types with a sequence of element references and complex types with simple
+// content of built-in type and attributes, and schemas using anything else fail to load. Passing
+// the check does not make document valid UBL 2.1, let alone Peppol BIS; it catches missing,
+// misplaced and malformed elements of the documents we make
+type Schema struct {
+	root     qname
+	elements map[qname]qname
+	types    map[qname]*complexType
+}
+
+type qname struct {
+	Space, Local string
+}
+
+// complexType has either particles of a sequence or simple content of built-in type
+type complexType struct {
+	sequence []particle
+	simple   string
+	attrs    []attribute
+}
+
+type particle struct {
+	element  qname
+	min, max int
+}
+
+type attribute struct {
+	name     string
+	builtin  string
+	required bool
+}
+
+// unbounded is max of particles which may repeat any number of times
+const unbounded = -1
+
+// ValidationError lists all the problems found in document
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("document does not conform to UBL subset: %s", strings.Join(e.Problems, "; "))
+}
+
+var (
+	loadInvoiceSubset sync.Once
+	invoiceSubset     *Schema
+	invoiceSubsetErr  error
+)
+
+// InvoiceSubset returns invoice schema of the bundled UBL 2.1 subset
+func InvoiceSubset() (*Schema, error) {
+	loadInvoiceSubset.Do(func() {
+		invoiceSubset, invoiceSubsetErr = LoadSchema(schemaFS, invoiceSchema)
+	})
+	return invoiceSubset, invoiceSubsetErr
+}
+
+// xsdSchema, xsdElement etc. are the parts of XSD documents the loader reads
+type xsdSchema struct {
+	TargetNamespace string       `xml:"targetNamespace,attr"`
+	Attrs           []xml.Attr   `xml:",any,attr"`
+	Imports         []xsdImport  `xml:"import"`
+	Elements        []xsdElement `xml:"element"`
+	ComplexTypes    []xsdType    `xml:"complexType"`
+	Other           []xsdOther   `xml:",any"`
+}
+
+// xsdOther is any construct the loader does not support
+type xsdOther struct {
+	XMLName xml.Name
+}
+
+type xsdImport struct {
+	Namespace      string `xml:"namespace,attr"`
+	SchemaLocation string `xml:"schemaLocation,attr"`
+}
+
+type xsdElement struct {
+	Name      string `xml:"name,attr"`
+	Ref       string `xml:"ref,attr"`
+	Type      string `xml:"type,attr"`
+	MinOccurs string `xml:"minOccurs,attr"`
+	MaxOccurs string `xml:"maxOccurs,attr"`
+}
+
+type xsdAttribute struct {
+	Name string `xml:"name,attr"`
+	Type string `xml:"type,attr"`
+	Use  string `xml:"use,attr"`
+}
+
+type xsdType struct {
+	Name     string `xml:"name,attr"`
+	Sequence *struct {
+		Elements []xsdElement `xml:"element"`
+		Other    []xsdOther   `xml:",any"`
+	} `xml:"sequence"`
+	SimpleContent *struct {
+		Extension *struct {
+			Base       string         `xml:"base,attr"`
+			Attributes []xsdAttribute `xml:"attribute"`
+		} `xml:"extension"`
+	} `xml:"simpleContent"`
+	Other []xsdOther `xml:",any"`
+}
+
+// LoadSchema loads schema document by name from fsys along with the schemas it imports;
+// the first global element of the document is the root of valid documents
+func LoadSchema(fsys fs.FS, name string) (*Schema, error) {
+	s := &Schema{
+		elements: map[qname]qname{},
+		types:    map[qname]*complexType{},
+	}
+	loaded := map[string]bool{}
+	var load func(name string, root bool) error
+	load = func(name string, root bool) error {
+		if loaded[name] {
+			return nil
+		}
+		loaded[name] = true
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return fmt.Errorf("error reading schema %s: %w", name, err)
+		}
+		var doc xsdSchema
+		if err = xml.Unmarshal(data, &doc); err != nil {
+			return fmt.Errorf("error parsing schema %s: %w", name, err)
+		}
+		if len(doc.Other) > 0 {
+			return fmt.Errorf("schema %s uses %s, which is not supported", name, doc.Other[0].XMLName.Local)
+		}
+		for _, imp := range doc.Imports {
+			if err = load(path.Join(path.Dir(name), imp.SchemaLocation), false); err != nil {
+				return err
+			}
+		}
+		if err = s.add(doc, root); err != nil {
+			return fmt.Errorf("schema %s: %w", name, err)
+		}
+		return nil
+	}
+	if err := load(name, true); err != nil {
+		return nil, err
+	}
+	if err := s.check(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// add adds declarations of the schema document
+func (s *Schema) add(doc xsdSchema, root bool) error {
+	prefixes := map[string]string{}
+	for _, a := range doc.Attrs {
+		switch {
+		case a.Name.Space == "xmlns":
+			prefixes[a.Name.Local] = a.Value
+		case a.Name.Space == "" && a.Name.Local == "xmlns":
+			prefixes[""] = a.Value
+		}
+	}
+	resolve := func(name string) (qname, error) {
+		prefix, local, found := strings.Cut(name, ":")
+		if !found {
+			prefix, local = "", name
+		}
+		space, ok := prefixes[prefix]
+		if !ok {
+			return qname{}, fmt.Errorf("undeclared prefix of %q", name)
+		}
+		return qname{Space: space, Local: local}, nil
+	}
+
+	for i, el := range doc.Elements {
+		if el.Name == "" || el.Type == "" {
+			return errors.New("global elements must have name and type")
+		}
+		typ, err := resolve(el.Type)
+		if err != nil {
+			return err
+		}
+		name := qname{Space: doc.TargetNamespace, Local: el.Name}
+		s.elements[name] = typ
+		if root && i == 0 {
+			s.root = name
+		}
+	}
+	for _, t := range doc.ComplexTypes {
+		if len(t.Other) > 0 {
+			return fmt.Errorf("type %s uses %s, which is not supported", t.Name, t.Other[0].XMLName.Local)
+		}
+		ct := &complexType{}
+		switch {
+		case t.Sequence != nil && t.SimpleContent == nil:
+			if len(t.Sequence.Other) > 0 {
+				return fmt.Errorf("sequence of type %s has %s, which is not supported", t.Name, t.Sequence.Other[0].XMLName.Local)
+			}
+			for _, el := range t.Sequence.Elements {
+				if el.Ref == "" {
+					return fmt.Errorf("sequence of type %s must refer to global elements", t.Name)
+				}
+				ref, err := resolve(el.Ref)
+				if err != nil {
+					return err
+				}
+				p := particle{element: ref, min: 1, max: 1}
+				if el.MinOccurs != "" {
+					if p.min, err = strconv.Atoi(el.MinOccurs); err != nil {
+						return fmt.Errorf("invalid minOccurs of %s: %w", el.Ref, err)
+					}
+				}
+				if el.MaxOccurs == "unbounded" {
+					p.max = unbounded
+				} else if el.MaxOccurs != "" {
+					if p.max, err = strconv.Atoi(el.MaxOccurs); err != nil {
+						return fmt.Errorf("invalid maxOccurs of %s: %w", el.Ref, err)
+					}
+				}
+				ct.sequence = append(ct.sequence, p)
+			}
+		case t.SimpleContent != nil && t.SimpleContent.Extension != nil && t.Sequence == nil:
+			ext := t.SimpleContent.Extension
+			base, err := builtinType(resolve, ext.Base)
+			if err != nil {
+				return err
+			}
+			ct.simple = base
+			for _, a := range ext.Attributes {
+				typ, err := builtinType(resolve, a.Type)
+				if err != nil {
+					return err
+				}
+				ct.attrs = append(ct.attrs, attribute{name: a.Name, builtin: typ, required: a.Use == "required"})
+			}
+		default:
+			return fmt.Errorf("type %s must have either sequence or simple content extension", t.Name)
+		}
+		s.types[qname{Space: doc.TargetNamespace, Local: t.Name}] = ct
+	}
+	return nil
+}
+
+// builtin resolves name of built-in XSD type the validator can check
+func builtinType(resolve func(string) (qname, error), name string) (string, error) {
+	n, err := resolve(name)
+	if err != nil {
+		return "", err
+	}
+	if n.Space != xsdNamespace || builtins[n.Local] == nil {
+		return "", fmt.Errorf("type %s is not a supported built-in type", name)
+	}
+	return n.Local, nil
+}
+
+// check makes sure every element and type referred to is declared
+func (s *Schema) check() error {
+	if s.root == (qname{}) {
+		return errors.New("schema has no root element")
+	}
+	for name, typ := range s.elements {
+		if s.types[typ] == nil {
+			return fmt.Errorf("type %s of element %s is not declared", typ.Local, name.Local)
+		}
+	}
+	for name, t := range s.types {
+		for _, p := range t.sequence {
+			if _, ok := s.elements[p.element]; !ok {
+				return fmt.Errorf("element %s referred to by type %s is not declared", p.element.Local, name.Local)
+			}
+		}
+	}
+	return nil
+}
+
+var (
+	decimalPattern  = regexp.MustCompile(`^[+-]?(\d+(\.\d*)?|\.\d+)$`)
+	languagePattern = regexp.MustCompile(`^[a-zA-Z]{1,8}(-[a-zA-Z0-9]{1,8})*$`)
+)
+
+// builtins check lexical values of built-in types
+var builtins = map[string]func(string) error{
+	"string": func(string) error { return nil },
+	"normalizedString": func(v string) error {
+		if strings.ContainsAny(v, "\t\n\r") {
+			return errors.New("must not contain tabs or line breaks")
+		}
+		return nil
+	},
+	"decimal": func(v string) error {
+		if !decimalPattern.MatchString(strings.TrimSpace(v)) {
+			return errors.New("must be a decimal number")
+		}
+		return nil
+	},
+	"date": func(v string) error {
+		if _, err := time.Parse("2006-01-02", strings.TrimSpace(v)); err != nil {
+			return errors.New("must be a date as YYYY-MM-DD")
+		}
+		return nil
+	},
+	"boolean": func(v string) error {
+		switch strings.TrimSpace(v) {
+		case "true", "false", "1", "0":
+			return nil
+		}
+		return errors.New("must be true or false")
+	},
+	"language": func(v string) error {
+		if !languagePattern.MatchString(strings.TrimSpace(v)) {
+			return errors.New("must be a language tag")
+		}
+		return nil
+	},
+}
+
+// node is element of the document being validated
+type node struct {
+	name     qname
+	attrs    []xml.Attr
+	children []*node
+	text     strings.Builder
+}
+
+// Validate checks the document against the schema; problems found are reported as ValidationError
+func (s *Schema) Validate(doc []byte) error {
+	root, err := parseDocument(doc)
+	if err != nil {
+		return err
+	}
+	var problems []string
+	if root.name != s.root {
+		problems = append(problems, fmt.Sprintf("root element must be %s of %s, not %s of %s",
+			s.root.Local, s.root.Space, root.name.Local, root.name.Space))
+	} else {
+		s.validate(root, "/"+root.name.Local, &problems)
+	}
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+func parseDocument(doc []byte) (*node, error) {
+	dec := xml.NewDecoder(bytes.NewReader(doc))
+	var root *node
+	var stack []*node
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error parsing document: %w", err)
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			n := &node{name: qname{Space: t.Name.Space, Local: t.Name.Local}, attrs: t.Attr}
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				parent.children = append(parent.children, n)
+			} else if root == nil {
+				root = n
+			}
+			stack = append(stack, n)
+		case xml.EndElement:
+			stack = stack[:len(stack)-1]
+		case xml.CharData:
+			if len(stack) > 0 {
+				stack[len(stack)-1].text.Write(t)
+			}
+		}
+	}
+	if root == nil {
+		return nil, errors.New("error parsing document: no root element")
+	}
+	return root, nil
+}
+
+// validate checks element n against its declared type; p is the path reported with problems
+func (s *Schema) validate(n *node, p string, problems *[]string) {
+	report := func(format string, args ...any) {
+		*problems = append(*problems, fmt.Sprintf("%s: %s", p, fmt.Sprintf(format, args...)))
+	}
+	t := s.types[s.elements[n.name]]
+
+	declared := map[string]attribute{}
+	for _, a := range t.attrs {
+		declared[a.name] = a
+	}
+	present := map[string]bool{}
+	for _, a := range n.attrs {
+		if a.Name.Space == "xmlns" || (a.Name.Space == "" && a.Name.Local == "xmlns") {
+			continue
+		}
+		d, ok := declared[a.Name.Local]
+		if !ok || a.Name.Space != "" {
+			report("attribute %s is not allowed", a.Name.Local)
+			continue
+		}
+		present[d.name] = true
+		if err := builtins[d.builtin](a.Value); err != nil {
+			report("attribute %s %s", d.name, err)
+		}
+	}
+	for _, a := range t.attrs {
+		if a.required && !present[a.name] {
+			report("attribute %s is required", a.name)
+		}
+	}
+
+	if t.simple != "" {
+		if len(n.children) > 0 {
+			report("element %s is not allowed", n.children[0].name.Local)
+			return
+		}
+		if err := builtins[t.simple](n.text.String()); err != nil {
+			report("%s", err)
+		}
+		return
+	}
+
+	if strings.TrimSpace(n.text.String()) != "" {
+		report("text is not allowed")
+	}
+	i := 0
+	for _, part := range t.sequence {
+		count := 0
+		for i < len(n.children) && n.children[i].name == part.element && (part.max == unbounded || count < part.max) {
+			child := n.children[i]
+			s.validate(child, fmt.Sprintf("%s/%s", p, child.name.Local), problems)
+			count++
+			i++
+		}
+		if count < part.min {
+			report("element %s is required", part.element.Local)
+		}
+	}
+	if i < len(n.children) {
+		report("element %s is not allowed here", n.children[i].name.Local)
+	}
+}
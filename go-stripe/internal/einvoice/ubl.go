@@ -0,0 +1,333 @@
+// Package einvoice makes machine-readable invoices: UBL 2.1 documents following Peppol BIS
+// Billing 3.0, made from the same invoice as its PDF. Documents are checked against a bundled
+// subset of UBL 2.1 only; validation against the complete OASIS schemas and Peppol business rules
+// is left to receiving access points
+package einvoice
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strings"
+	"time"
+
+	common_models "github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/common"
+	"github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/models"
+)
+
+// Identifiers of Peppol BIS Billing 3.0 documents
+const (
+	CustomizationID = "urn:cen.eu:en16931:2017#compliant#urn:fdc:peppol.eu:2017:poacc:billing:3.0"
+	ProfileID       = "urn:fdc:peppol.eu:2017:poacc:billing:01:1.0"
+)
+
+// Codes used in the documents: commercial invoice type, unit of "one", email endpoint scheme
+// and VAT categories of standard rate and of not being subject to VAT
+const (
+	invoiceTypeCommercial = "380"
+	unitOne               = "C62"
+	schemeEmail           = "EM"
+	taxSchemeVAT          = "VAT"
+	taxCategoryStandard   = "S"
+	taxCategoryNotSubject = "O"
+)
+
+// ContentType is media type of UBL documents
+const ContentType = "application/xml"
+
+// Party is seller or buyer of the invoice; parties are identified by their email addresses.
+// Country is ISO 3166-1 alpha-2 code
+type Party struct {
+	Name    string
+	Email   string
+	Address common_models.Address
+}
+
+const (
+	nsInvoice = "urn:oasis:names:specification:ubl:schema:xsd:Invoice-2"
+	nsCAC     = "urn:oasis:names:specification:ubl:schema:xsd:CommonAggregateComponents-2"
+	nsCBC     = "urn:oasis:names:specification:ubl:schema:xsd:CommonBasicComponents-2"
+)
+
+// ublInvoice and the types below are UBL elements in the order the schema has them
+type ublInvoice struct {
+	XMLName                 xml.Name         `xml:"Invoice"`
+	Xmlns                   string           `xml:"xmlns,attr"`
+	XmlnsCAC                string           `xml:"xmlns:cac,attr"`
+	XmlnsCBC                string           `xml:"xmlns:cbc,attr"`
+	CustomizationID         string           `xml:"cbc:CustomizationID"`
+	ProfileID               string           `xml:"cbc:ProfileID"`
+	ID                      string           `xml:"cbc:ID"`
+	IssueDate               string           `xml:"cbc:IssueDate"`
+	DueDate                 string           `xml:"cbc:DueDate,omitempty"`
+	InvoiceTypeCode         string           `xml:"cbc:InvoiceTypeCode"`
+	DocumentCurrencyCode    string           `xml:"cbc:DocumentCurrencyCode"`
+	InvoicePeriod           *ublPeriod       `xml:"cac:InvoicePeriod"`
+	OrderReference          ublReference     `xml:"cac:OrderReference"`
+	AccountingSupplierParty ublPartyRole     `xml:"cac:AccountingSupplierParty"`
+	AccountingCustomerParty ublPartyRole     `xml:"cac:AccountingCustomerParty"`
+	AllowanceCharges        []ublAllowance   `xml:"cac:AllowanceCharge"`
+	TaxTotal                ublTaxTotal      `xml:"cac:TaxTotal"`
+	LegalMonetaryTotal      ublMonetaryTotal `xml:"cac:LegalMonetaryTotal"`
+	InvoiceLines            []ublInvoiceLine `xml:"cac:InvoiceLine"`
+}
+
+type ublPeriod struct {
+	StartDate string `xml:"cbc:StartDate"`
+	EndDate   string `xml:"cbc:EndDate"`
+}
+
+type ublReference struct {
+	ID string `xml:"cbc:ID"`
+}
+
+type ublPartyRole struct {
+	Party ublParty `xml:"cac:Party"`
+}
+
+type ublParty struct {
+	EndpointID       ublIdentifier `xml:"cbc:EndpointID"`
+	PartyName        ublPartyName  `xml:"cac:PartyName"`
+	PostalAddress    ublAddress    `xml:"cac:PostalAddress"`
+	PartyLegalEntity ublLegal      `xml:"cac:PartyLegalEntity"`
+	Contact          ublContact    `xml:"cac:Contact"`
+}
+
+type ublIdentifier struct {
+	SchemeID string `xml:"schemeID,attr,omitempty"`
+	Value    string `xml:",chardata"`
+}
+
+type ublPartyName struct {
+	Name string `xml:"cbc:Name"`
+}
+
+type ublAddress struct {
+	StreetName           string     `xml:"cbc:StreetName,omitempty"`
+	AdditionalStreetName string     `xml:"cbc:AdditionalStreetName,omitempty"`
+	CityName             string     `xml:"cbc:CityName,omitempty"`
+	PostalZone           string     `xml:"cbc:PostalZone,omitempty"`
+	CountrySubentity     string     `xml:"cbc:CountrySubentity,omitempty"`
+	Country              ublCountry `xml:"cac:Country"`
+}
+
+type ublCountry struct {
+	IdentificationCode string `xml:"cbc:IdentificationCode"`
+}
+
+type ublLegal struct {
+	RegistrationName string `xml:"cbc:RegistrationName"`
+}
+
+type ublContact struct {
+	ElectronicMail string `xml:"cbc:ElectronicMail"`
+}
+
+type ublAmount struct {
+	CurrencyID string `xml:"currencyID,attr"`
+	Value      string `xml:",chardata"`
+}
+
+type ublQuantity struct {
+	UnitCode string `xml:"unitCode,attr"`
+	Value    int    `xml:",chardata"`
+}
+
+type ublAllowance struct {
+	ChargeIndicator       bool           `xml:"cbc:ChargeIndicator"`
+	AllowanceChargeReason string         `xml:"cbc:AllowanceChargeReason"`
+	Amount                ublAmount      `xml:"cbc:Amount"`
+	TaxCategory           ublTaxCategory `xml:"cac:TaxCategory"`
+}
+
+type ublTaxCategory struct {
+	ID                 string       `xml:"cbc:ID"`
+	Percent            string       `xml:"cbc:Percent,omitempty"`
+	TaxExemptionReason string       `xml:"cbc:TaxExemptionReason,omitempty"`
+	TaxScheme          ublReference `xml:"cac:TaxScheme"`
+}
+
+type ublTaxTotal struct {
+	TaxAmount   ublAmount      `xml:"cbc:TaxAmount"`
+	TaxSubtotal ublTaxSubtotal `xml:"cac:TaxSubtotal"`
+}
+
+type ublTaxSubtotal struct {
+	TaxableAmount ublAmount      `xml:"cbc:TaxableAmount"`
+	TaxAmount     ublAmount      `xml:"cbc:TaxAmount"`
+	TaxCategory   ublTaxCategory `xml:"cac:TaxCategory"`
+}
+
+type ublMonetaryTotal struct {
+	LineExtensionAmount  ublAmount  `xml:"cbc:LineExtensionAmount"`
+	TaxExclusiveAmount   ublAmount  `xml:"cbc:TaxExclusiveAmount"`
+	TaxInclusiveAmount   ublAmount  `xml:"cbc:TaxInclusiveAmount"`
+	AllowanceTotalAmount *ublAmount `xml:"cbc:AllowanceTotalAmount"`
+	PayableAmount        ublAmount  `xml:"cbc:PayableAmount"`
+}
+
+type ublInvoiceLine struct {
+	ID                  int         `xml:"cbc:ID"`
+	InvoicedQuantity    ublQuantity `xml:"cbc:InvoicedQuantity"`
+	LineExtensionAmount ublAmount   `xml:"cbc:LineExtensionAmount"`
+	Item                ublItem     `xml:"cac:Item"`
+	Price               ublPrice    `xml:"cac:Price"`
+}
+
+type ublItem struct {
+	Name                  string         `xml:"cbc:Name"`
+	ClassifiedTaxCategory ublTaxCategory `xml:"cac:ClassifiedTaxCategory"`
+}
+
+type ublPrice struct {
+	PriceAmount ublAmount `xml:"cbc:PriceAmount"`
+}
+
+// Invoice makes UBL invoice of the order issued by seller and checks it against the bundled
+// UBL subset. Buyer's country defaults to seller's one, as Peppol requires it and older orders
+// have no billing address
+func Invoice(invoice models.Invoice, order common_models.Order, seller Party) ([]byte, error) {
+	currency := strings.ToUpper(invoice.Currency)
+	if currency == "" {
+		currency = "USD"
+	}
+	amount := func(cents int) ublAmount {
+		return ublAmount{CurrencyID: currency, Value: formatDecimal(cents, 2)}
+	}
+
+	// the invoice has a single tax rate derived from the tax charged; orders of sellers not
+	// charging tax are not subject to VAT
+	taxable := invoice.Subtotal - invoice.Discount
+	category := ublTaxCategory{
+		ID:                 taxCategoryNotSubject,
+		TaxExemptionReason: "Not subject to VAT",
+		TaxScheme:          ublReference{ID: taxSchemeVAT},
+	}
+	if invoice.Tax != 0 && taxable > 0 {
+		category = ublTaxCategory{
+			ID:        taxCategoryStandard,
+			Percent:   formatDecimal(int(float64(invoice.Tax)*10000/float64(taxable)+0.5), 2),
+			TaxScheme: ublReference{ID: taxSchemeVAT},
+		}
+	}
+	lineCategory := category
+	lineCategory.TaxExemptionReason = ""
+
+	buyer := Party{
+		Name:    strings.TrimSpace(fmt.Sprintf("%s %s", order.FirstName, order.LastName)),
+		Email:   order.Email,
+		Address: order.BillingAddress,
+	}
+	if buyer.Address.Country == "" {
+		buyer.Address.Country = seller.Address.Country
+	}
+
+	doc := ublInvoice{
+		Xmlns:                   nsInvoice,
+		XmlnsCAC:                nsCAC,
+		XmlnsCBC:                nsCBC,
+		CustomizationID:         CustomizationID,
+		ProfileID:               ProfileID,
+		ID:                      invoice.Number,
+		IssueDate:               formatDate(invoice.IssuedAt),
+		InvoiceTypeCode:         invoiceTypeCommercial,
+		DocumentCurrencyCode:    currency,
+		OrderReference:          ublReference{ID: fmt.Sprintf("%d", invoice.OrderID)},
+		AccountingSupplierParty: ublPartyRole{Party: party(seller)},
+		AccountingCustomerParty: ublPartyRole{Party: party(buyer)},
+		TaxTotal: ublTaxTotal{
+			TaxAmount: amount(invoice.Tax),
+			TaxSubtotal: ublTaxSubtotal{
+				TaxableAmount: amount(taxable),
+				TaxAmount:     amount(invoice.Tax),
+				TaxCategory:   category,
+			},
+		},
+		LegalMonetaryTotal: ublMonetaryTotal{
+			LineExtensionAmount: amount(invoice.Subtotal),
+			TaxExclusiveAmount:  amount(taxable),
+			TaxInclusiveAmount:  amount(invoice.Total),
+			PayableAmount:       amount(invoice.Total),
+		},
+	}
+	if invoice.DueAt != nil {
+		doc.DueDate = formatDate(*invoice.DueAt)
+	}
+	if invoice.PeriodStart != nil && invoice.PeriodEnd != nil {
+		doc.InvoicePeriod = &ublPeriod{StartDate: formatDate(*invoice.PeriodStart), EndDate: formatDate(*invoice.PeriodEnd)}
+	}
+	if invoice.Discount != 0 {
+		doc.AllowanceCharges = []ublAllowance{{
+			ChargeIndicator:       false,
+			AllowanceChargeReason: "Discount",
+			Amount:                amount(invoice.Discount),
+			TaxCategory:           lineCategory,
+		}}
+		discount := amount(invoice.Discount)
+		doc.LegalMonetaryTotal.AllowanceTotalAmount = &discount
+	}
+	for i, item := range order.LineItems() {
+		// lines of older orders may have no unit price, as their amount is not divisible
+		// by quantity; the price is rounded then
+		price := formatDecimal(item.UnitPrice, 2)
+		if item.UnitPrice == 0 && item.Quantity > 0 {
+			price = formatDecimal(int(float64(item.Total())*100/float64(item.Quantity)+0.5), 4)
+		}
+		doc.InvoiceLines = append(doc.InvoiceLines, ublInvoiceLine{
+			ID:                  i + 1,
+			InvoicedQuantity:    ublQuantity{UnitCode: unitOne, Value: item.Quantity},
+			LineExtensionAmount: amount(item.Total()),
+			Item:                ublItem{Name: item.Product, ClassifiedTaxCategory: lineCategory},
+			Price:               ublPrice{PriceAmount: ublAmount{CurrencyID: currency, Value: price}},
+		})
+	}
+
+	data, err := xml.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("error making e-invoice %s: %w", invoice.Number, err)
+	}
+	data = append([]byte(xml.Header), data...)
+
+	schema, err := InvoiceSubset()
+	if err != nil {
+		return nil, err
+	}
+	if err = schema.Validate(data); err != nil {
+		return nil, fmt.Errorf("e-invoice %s: %w", invoice.Number, err)
+	}
+	return data, nil
+}
+
+func party(p Party) ublParty {
+	return ublParty{
+		EndpointID: ublIdentifier{SchemeID: schemeEmail, Value: p.Email},
+		PartyName:  ublPartyName{Name: p.Name},
+		PostalAddress: ublAddress{
+			StreetName:           p.Address.Line1,
+			AdditionalStreetName: p.Address.Line2,
+			CityName:             p.Address.City,
+			PostalZone:           p.Address.PostalCode,
+			CountrySubentity:     p.Address.State,
+			Country:              ublCountry{IdentificationCode: strings.ToUpper(p.Address.Country)},
+		},
+		PartyLegalEntity: ublLegal{RegistrationName: p.Name},
+		Contact:          ublContact{ElectronicMail: p.Email},
+	}
+}
+
+func formatDate(t time.Time) string {
+	return t.Format("2006-01-02")
+}
+
+// formatDecimal formats value scaled by 10^scale without losing precision to float rounding
+func formatDecimal(value, scale int) string {
+	sign := ""
+	if value < 0 {
+		sign = "-"
+		value = -value
+	}
+	unit := 1
+	for i := 0; i < scale; i++ {
+		unit *= 10
+	}
+	return fmt.Sprintf("%s%d.%0*d", sign, value/unit, scale, value%unit)
+}
@@ -0,0 +1,181 @@
+package einvoice
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	common_models "github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/common"
+	"github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/models"
+)
+
+var seller = Party{Name: "Widgets Co.", Email: "info@widgets.com", Address: common_models.Address{Country: "US"}}
+
+func Test_Invoice(t *testing.T) {
+	issued := time.Date(2023, 5, 19, 10, 0, 0, 0, time.UTC)
+	due := issued.AddDate(0, 0, 30)
+	order := common_models.Order{
+		ID: 42,
+		Items: []common_models.OrderItem{
+			{Product: "Widget & Co", Quantity: 3, UnitPrice: 1099},
+			{Product: "Shipping", Quantity: 2, Amount: 501},
+		},
+		Discount:       298,
+		Tax:            350,
+		FirstName:      "Jane",
+		LastName:       "Doe",
+		Email:          "jane@example.com",
+		BillingAddress: common_models.Address{Line1: "1 Main St", City: "Berlin", PostalCode: "10115", Country: "de"},
+	}
+	invoice := models.Invoice{
+		OrderID:  42,
+		Number:   "2023-000007",
+		Currency: "eur",
+		Subtotal: order.Subtotal(),
+		Discount: order.Discount,
+		Tax:      order.Tax,
+		Total:    order.Total(),
+		IssuedAt: issued,
+		DueAt:    &due,
+	}
+
+	data, err := Invoice(invoice, order, seller)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := string(data)
+	for _, want := range []string{
+		`<cbc:ID>2023-000007</cbc:ID>`,
+		`<cbc:IssueDate>2023-05-19</cbc:IssueDate>`,
+		`<cbc:DueDate>2023-06-18</cbc:DueDate>`,
+		`<cbc:DocumentCurrencyCode>EUR</cbc:DocumentCurrencyCode>`,
+		`<cbc:Name>Widget &amp; Co</cbc:Name>`,
+		`<cbc:PriceAmount currencyID="EUR">2.5050</cbc:PriceAmount>`,
+		`<cbc:Percent>10.00</cbc:Percent>`,
+		`<cbc:AllowanceTotalAmount currencyID="EUR">2.98</cbc:AllowanceTotalAmount>`,
+		`<cbc:PayableAmount currencyID="EUR">38.50</cbc:PayableAmount>`,
+		`<cbc:IdentificationCode>DE</cbc:IdentificationCode>`,
+	} {
+		if !strings.Contains(doc, want) {
+			t.Errorf("expected %s in\n%s", want, doc)
+		}
+	}
+}
+
+func Test_Validate(t *testing.T) {
+	order := common_models.Order{ID: 1, Product: "Widget", Quantity: 1, Amount: 1000, Email: "jane@example.com"}
+	invoice := models.Invoice{OrderID: 1, Number: "2023-000001", Subtotal: 1000, Total: 1000, IssuedAt: time.Now()}
+	data, err := Invoice(invoice, order, seller)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema, err := InvoiceSubset()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	issueDate := "<cbc:IssueDate>" + invoice.IssuedAt.Format("2006-01-02")
+	tests := []struct {
+		name, old, new, problem string
+	}{
+		{"missing element", issueDate + "</cbc:IssueDate>", "", "/Invoice: element IssueDate is required"},
+		{"invalid date", issueDate, "<cbc:IssueDate>today", "IssueDate: must be a date"},
+		{"invalid amount", `<cbc:PayableAmount currencyID="USD">10.00`, `<cbc:PayableAmount currencyID="USD">ten`, "PayableAmount: must be a decimal"},
+		{"missing attribute", `<cbc:PayableAmount currencyID="USD">`, `<cbc:PayableAmount>`, "PayableAmount: attribute currencyID is required"},
+		{"unknown element", "<cac:InvoiceLine>", "<cac:Delivery></cac:Delivery><cac:InvoiceLine>", "element Delivery is not allowed here"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc := strings.Replace(string(data), tt.old, tt.new, 1)
+			if doc == string(data) {
+				t.Fatalf("%q is not in the document", tt.old)
+			}
+			err := schema.Validate([]byte(doc))
+			var verr *ValidationError
+			if !errors.As(err, &verr) {
+				t.Fatalf("expected validation error, got %v", err)
+			}
+			if !strings.Contains(err.Error(), tt.problem) {
+				t.Errorf("expected %q among problems, got %v", tt.problem, err)
+			}
+		})
+	}
+}
+
+// Test_ValidateWithXmllint checks with xmllint that the bundled subset is valid XSD agreeing with
+// the in-process check. UBL_XSD_DIR may name the xsd directory of the OASIS UBL 2.1 distribution
+// to validate the documents against the complete schemas as well; they are not bundled
+func Test_ValidateWithXmllint(t *testing.T) {
+	xmllint, err := exec.LookPath("xmllint")
+	if err != nil {
+		t.Skip("xmllint is not installed")
+	}
+	schemas := []string{invoiceSchema}
+	if dir := os.Getenv("UBL_XSD_DIR"); dir != "" {
+		schemas = append(schemas, filepath.Join(dir, "maindoc", "UBL-Invoice-2.1.xsd"))
+	} else {
+		t.Log("UBL_XSD_DIR is not set; validating against the bundled UBL subset only")
+	}
+
+	issued := time.Date(2023, 5, 19, 10, 0, 0, 0, time.UTC)
+	due := issued.AddDate(0, 0, 30)
+	start := issued.AddDate(0, -1, 0)
+	orders := map[string]common_models.Order{
+		"single item": {ID: 1, Product: "Widget", Quantity: 1, Amount: 1000, Email: "jane@example.com"},
+		"items with discount and tax": {
+			ID: 2,
+			Items: []common_models.OrderItem{
+				{Product: "Widget", Quantity: 3, UnitPrice: 1099},
+				{Product: "Shipping", Quantity: 1, Amount: 500},
+			},
+			Discount:       298,
+			Tax:            350,
+			Email:          "jane@example.com",
+			BillingAddress: common_models.Address{Line1: "1 Main St", City: "Berlin", PostalCode: "10115", Country: "DE"},
+		},
+		"subscription renewal": {ID: 3, Product: "Bronze Plan subscription", Quantity: 1, Amount: 2000, Email: "jane@example.com",
+			PeriodStart: &start, PeriodEnd: &issued},
+	}
+	dir := t.TempDir()
+	for name, order := range orders {
+		invoice := models.Invoice{
+			OrderID:  order.ID,
+			Number:   "2023-000001",
+			Currency: "eur",
+			Subtotal: order.Subtotal(),
+			Discount: order.Discount,
+			Tax:      order.Tax,
+			Total:    order.Total(),
+			IssuedAt: issued,
+			DueAt:    &due,
+		}
+		data, err := Invoice(invoice, order, seller)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		// document missing required IssueDate makes sure xmllint does reject invalid documents
+		invalid := strings.Replace(string(data), "<cbc:IssueDate>2023-05-19</cbc:IssueDate>", "", 1)
+
+		for _, schema := range schemas {
+			t.Run(name+" "+schema, func(t *testing.T) {
+				valid := filepath.Join(dir, "valid.xml")
+				if err := os.WriteFile(valid, data, 0o600); err != nil {
+					t.Fatal(err)
+				}
+				if out, err := exec.Command(xmllint, "--noout", "--nonet", "--schema", schema, valid).CombinedOutput(); err != nil {
+					t.Errorf("expected document to be valid, got %v: %s", err, out)
+				}
+				if err := os.WriteFile(valid, []byte(invalid), 0o600); err != nil {
+					t.Fatal(err)
+				}
+				if out, err := exec.Command(xmllint, "--noout", "--nonet", "--schema", schema, valid).CombinedOutput(); err == nil {
+					t.Errorf("expected document without IssueDate to be invalid: %s", out)
+				}
+			})
+		}
+	}
+}
@@ -8,42 +8,126 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"strings"
+
+	"github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/keyring"
+)
+
+// Ciphertext format is "v2:[<key ID>.]<base64 of nonce, encrypted data and tag>" where the header
+// before base64 is authenticated together with associated data. Legacy AES-CFB ciphertexts have
+// neither version nor integrity check and are only decrypted if allowed
+const (
+	versionPrefix  = "v2:"
+	keyIDSeparator = "."
 )
 
+// ErrLegacyCiphertext is returned for legacy AES-CFB ciphertext when it is not allowed
+var ErrLegacyCiphertext = errors.New("legacy ciphertext is not allowed")
+
 type Encryption struct {
-	Key []byte
+	Keys *keyring.Keyring
+	// AllowLegacy enables decryption of legacy AES-CFB ciphertexts, which can be forged
+	// as they are not authenticated. It should be turned off once data has been re-encrypted
+	AllowLegacy bool
 }
 
+// Encrypt encrypts text with active key using AES-GCM
 func (e *Encryption) Encrypt(text string) (string, error) {
+	return e.EncryptWithAD(text, nil)
+}
+
+// Decrypt decrypts text encrypted by Encrypt or, if allowed, by the legacy AES-CFB format
+func (e *Encryption) Decrypt(encrypted string) (string, error) {
+	return e.DecryptWithAD(encrypted, nil)
+}
+
+// EncryptWithAD encrypts text with active key binding it to associated data, i.e. ID of the record
+// it belongs to, so that ciphertext can not be moved to another record unnoticed.
+// The same data must be passed to DecryptWithAD
+func (e *Encryption) EncryptWithAD(text string, ad []byte) (string, error) {
 	const errFmtStr = "error encrypting text %w"
-	binaryData := []byte(text)
-	block, err := aes.NewCipher(e.Key)
+	keyID, key := e.Keys.Active()
+	aead, err := newAEAD(key)
 	if err != nil {
 		return "", fmt.Errorf(errFmtStr, err)
 	}
-	cipherText := make([]byte, aes.BlockSize+len(binaryData))
-	iv := cipherText[:aes.BlockSize]
-	if _, err = io.ReadFull(rand.Reader, iv); err != nil {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(text)+aead.Overhead())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
 		return "", fmt.Errorf(errFmtStr, err)
 	}
-	stream := cipher.NewCFBEncrypter(block, iv)
-	stream.XORKeyStream(cipherText[aes.BlockSize:], binaryData)
-	return base64.URLEncoding.EncodeToString(cipherText), nil
+	header := versionPrefix
+	if keyID != keyring.LegacyKeyID {
+		header += keyID + keyIDSeparator
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(text), additionalData(header, ad))
+	return header + base64.URLEncoding.EncodeToString(sealed), nil
 }
 
-func (e *Encryption) Decrypt(encrypted string) (string, error) {
+// DecryptWithAD decrypts text encrypted by EncryptWithAD with the same associated data.
+// Legacy ciphertexts carry no associated data, so it is not checked for them
+func (e *Encryption) DecryptWithAD(encrypted string, ad []byte) (string, error) {
 	const errFmtStr = "error decrypting text %w"
-	cipherText, err := base64.URLEncoding.DecodeString(encrypted)
+	if !strings.HasPrefix(encrypted, versionPrefix) {
+		if !e.AllowLegacy {
+			return "", fmt.Errorf(errFmtStr, ErrLegacyCiphertext)
+		}
+		plain, err := e.decryptLegacy(encrypted)
+		if err != nil {
+			return "", fmt.Errorf(errFmtStr, err)
+		}
+		return plain, nil
+	}
+
+	body := strings.TrimPrefix(encrypted, versionPrefix)
+	keyID := keyring.LegacyKeyID
+	if id, data, found := strings.Cut(body, keyIDSeparator); found {
+		keyID, body = id, data
+	}
+	header := encrypted[:len(encrypted)-len(body)]
+	key, err := e.Keys.Get(keyID)
 	if err != nil {
 		return "", fmt.Errorf(errFmtStr, err)
 	}
-	block, err := aes.NewCipher(e.Key)
+	sealed, err := base64.URLEncoding.DecodeString(body)
 	if err != nil {
 		return "", fmt.Errorf(errFmtStr, err)
 	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return "", fmt.Errorf(errFmtStr, err)
+	}
+	if len(sealed) < aead.NonceSize()+aead.Overhead() {
+		return "", fmt.Errorf(errFmtStr, errors.New("input data is too small"))
+	}
+	nonce, cipherText := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plain, err := aead.Open(nil, nonce, cipherText, additionalData(header, ad))
+	if err != nil {
+		return "", fmt.Errorf(errFmtStr, errors.New("ciphertext has been tampered with or wrong associated data given"))
+	}
+	return string(plain), nil
+}
+
+// decryptLegacy decrypts AES-CFB ciphertext, optionally prefixed with key ID
+func (e *Encryption) decryptLegacy(encrypted string) (string, error) {
+	keyID := keyring.LegacyKeyID
+	if id, data, found := strings.Cut(encrypted, keyIDSeparator); found {
+		keyID, encrypted = id, data
+	}
+	key, err := e.Keys.Get(keyID)
+	if err != nil {
+		return "", err
+	}
+	cipherText, err := base64.URLEncoding.DecodeString(encrypted)
+	if err != nil {
+		return "", err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
 
 	if len(cipherText) <= aes.BlockSize {
-		return "", fmt.Errorf(errFmtStr, errors.New("input data is too small"))
+		return "", errors.New("input data is too small")
 	}
 	iv := cipherText[:aes.BlockSize]
 	cipherText = cipherText[aes.BlockSize:]
@@ -51,3 +135,20 @@ func (e *Encryption) Decrypt(encrypted string) (string, error) {
 	stream.XORKeyStream(cipherText, cipherText)
 	return string(cipherText), nil
 }
+
+// IsLegacy reports whether the text is in the legacy AES-CFB format and has to be re-encrypted
+func IsLegacy(encrypted string) bool {
+	return encrypted != "" && !strings.HasPrefix(encrypted, versionPrefix)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func additionalData(header string, ad []byte) []byte {
+	return append([]byte(header), ad...)
+}
@@ -0,0 +1,133 @@
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/keyring"
+)
+
+const (
+	legacyKey = "abcdefghijklmnopqrstuvwxyz012345"
+	newKey    = "0123456789abcdefghijklmnopqrstuv"
+)
+
+// encryptCFB makes ciphertext the way it was done before AES-GCM
+func encryptCFB(t *testing.T, key, text string) string {
+	block, err := aes.NewCipher([]byte(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cipherText := make([]byte, aes.BlockSize+len(text))
+	stream := cipher.NewCFBEncrypter(block, cipherText[:aes.BlockSize])
+	stream.XORKeyStream(cipherText[aes.BlockSize:], []byte(text))
+	return base64.URLEncoding.EncodeToString(cipherText)
+}
+
+func newEncryption(t *testing.T) Encryption {
+	keys, err := keyring.Parse("k2:"+newKey, "", legacyKey)
+	if err != nil {
+		t.Fatalf("error parsing keyring: %s", err)
+	}
+	return Encryption{Keys: keys, AllowLegacy: true}
+}
+
+func Test_KeyRotation(t *testing.T) {
+	old := Encryption{Keys: keyring.Single([]byte(legacyKey))}
+	oldText, err := old.Encrypt("secret")
+	if err != nil {
+		t.Fatalf("error encrypting: %s", err)
+	}
+
+	e := newEncryption(t)
+	newText, err := e.Encrypt("secret")
+	if err != nil {
+		t.Fatalf("error encrypting: %s", err)
+	}
+	if !strings.HasPrefix(newText, "v2:k2.") {
+		t.Errorf("expected ciphertext to start with version and key ID but got %q", newText)
+	}
+
+	for _, text := range []string{oldText, newText} {
+		if plain, err := e.Decrypt(text); err != nil || plain != "secret" {
+			t.Errorf("error decrypting %q: %q, %v", text, plain, err)
+		}
+	}
+	if _, err = old.Decrypt(newText); err == nil {
+		t.Error("expected error decrypting with unknown key")
+	}
+}
+
+func Test_LegacyFormat(t *testing.T) {
+	e := newEncryption(t)
+	legacyText := encryptCFB(t, legacyKey, "john@dow.com")
+	if plain, err := e.Decrypt(legacyText); err != nil || plain != "john@dow.com" {
+		t.Errorf("error decrypting legacy text: %q, %v", plain, err)
+	}
+	legacyText = "k2." + encryptCFB(t, newKey, "john@dow.com")
+	if plain, err := e.Decrypt(legacyText); err != nil || plain != "john@dow.com" {
+		t.Errorf("error decrypting legacy text with key ID: %q, %v", plain, err)
+	}
+	if !IsLegacy(legacyText) {
+		t.Errorf("expected %q to be reported as legacy", legacyText)
+	}
+
+	e.AllowLegacy = false
+	if _, err := e.Decrypt(legacyText); !errors.Is(err, ErrLegacyCiphertext) {
+		t.Errorf("expected legacy text to be rejected but got %v", err)
+	}
+	encrypted, err := e.Encrypt("john@dow.com")
+	if err != nil {
+		t.Fatalf("error encrypting: %s", err)
+	}
+	if plain, err := e.Decrypt(encrypted); err != nil || plain != "john@dow.com" {
+		t.Errorf("error decrypting with legacy format disabled: %q, %v", plain, err)
+	}
+	if IsLegacy(encrypted) {
+		t.Errorf("expected %q not to be reported as legacy", encrypted)
+	}
+}
+
+func Test_TamperDetection(t *testing.T) {
+	e := newEncryption(t)
+	encrypted, err := e.EncryptWithAD("4242", []byte("customer:7"))
+	if err != nil {
+		t.Fatalf("error encrypting: %s", err)
+	}
+	if plain, err := e.DecryptWithAD(encrypted, []byte("customer:7")); err != nil || plain != "4242" {
+		t.Fatalf("error decrypting: %q, %v", plain, err)
+	}
+
+	if _, err = e.DecryptWithAD(encrypted, []byte("customer:8")); err == nil {
+		t.Error("expected error decrypting with wrong associated data")
+	}
+	if _, err = e.Decrypt(encrypted); err == nil {
+		t.Error("expected error decrypting without associated data")
+	}
+
+	header := "v2:k2."
+	sealed, err := base64.URLEncoding.DecodeString(strings.TrimPrefix(encrypted, header))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range sealed {
+		tampered := append([]byte{}, sealed...)
+		tampered[i] ^= 1
+		if _, err = e.DecryptWithAD(header+base64.URLEncoding.EncodeToString(tampered), []byte("customer:7")); err == nil {
+			t.Fatalf("expected error decrypting text with byte %d flipped", i)
+		}
+	}
+
+	// key ID is authenticated too, so switching to the legacy key must be detected
+	_, err = e.DecryptWithAD("v2:"+strings.TrimPrefix(encrypted, header), []byte("customer:7"))
+	if err == nil {
+		t.Error("expected error decrypting text with key ID removed")
+	}
+	if _, err = e.Decrypt("v2:k2.AAAA"); err == nil {
+		t.Error("expected error decrypting truncated text")
+	}
+}
@@ -0,0 +1,94 @@
+package keyring
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// LegacyKeyID identifies the key that signed tokens and ciphertexts without key ID were made with
+const LegacyKeyID = ""
+
+// Keyring holds secret keys by their IDs. Active key is used to sign and encrypt new data,
+// while all the keys are accepted to verify and decrypt, so that keys can be rotated without
+// invalidating links in flight and data already stored
+type Keyring struct {
+	activeID string
+	keys     map[string][]byte
+}
+
+// New creates keyring with the keys, the one identified by activeID being active
+func New(activeID string, keys map[string][]byte) (*Keyring, error) {
+	if _, ok := keys[activeID]; !ok {
+		return nil, fmt.Errorf("active key %q is not in the keyring", activeID)
+	}
+	for id := range keys {
+		if !validID(id) {
+			return nil, fmt.Errorf("invalid key ID %q; only letters, digits and hyphens are allowed", id)
+		}
+	}
+	return &Keyring{activeID: activeID, keys: keys}, nil
+}
+
+// Single creates keyring of the only legacy key, i.e. not embedding key ID into data
+func Single(secret []byte) *Keyring {
+	return &Keyring{activeID: LegacyKeyID, keys: map[string][]byte{LegacyKeyID: secret}}
+}
+
+// Parse loads keyring from configuration. Spec lists comma separated id:secret pairs;
+// activeID selects active key and defaults to the first key listed. Non-empty legacy secret
+// is accepted for data made before keys got IDs and is active when spec is empty
+func Parse(spec, activeID, legacy string) (*Keyring, error) {
+	keys := map[string][]byte{}
+	if legacy != "" {
+		keys[LegacyKeyID] = []byte(legacy)
+	}
+	first := LegacyKeyID
+	for i, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		id, secret, found := strings.Cut(pair, ":")
+		if !found || id == "" || secret == "" {
+			return nil, fmt.Errorf("malformed key #%d; expected id:secret", i+1)
+		}
+		if _, exists := keys[id]; exists {
+			return nil, fmt.Errorf("duplicate key ID %q", id)
+		}
+		keys[id] = []byte(secret)
+		if first == LegacyKeyID {
+			first = id
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no secret keys configured")
+	}
+	if activeID == "" {
+		activeID = first
+	}
+	return New(activeID, keys)
+}
+
+// Active returns ID and secret of the key new data must be signed or encrypted with
+func (k *Keyring) Active() (string, []byte) {
+	return k.activeID, k.keys[k.activeID]
+}
+
+// Get returns secret of the key by its ID
+func (k *Keyring) Get(id string) ([]byte, error) {
+	secret, ok := k.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", id)
+	}
+	return secret, nil
+}
+
+func validID(id string) bool {
+	for _, r := range id {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-') {
+			return false
+		}
+	}
+	return true
+}
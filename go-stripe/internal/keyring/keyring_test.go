@@ -0,0 +1,41 @@
+package keyring
+
+import "testing"
+
+func Test_Parse(t *testing.T) {
+	k, err := Parse("k2:second, k1:first", "", "legacy")
+	if err != nil {
+		t.Fatalf("error parsing keyring: %s", err)
+	}
+	if id, secret := k.Active(); id != "k2" || string(secret) != "second" {
+		t.Errorf("expected first listed key to be active but got %q", id)
+	}
+	for id, expected := range map[string]string{"k1": "first", LegacyKeyID: "legacy"} {
+		if secret, err := k.Get(id); err != nil || string(secret) != expected {
+			t.Errorf("bad key %q: %q, %v", id, secret, err)
+		}
+	}
+	if _, err = k.Get("k3"); err == nil {
+		t.Error("expected error for unknown key")
+	}
+
+	k, err = Parse("", "", "legacy")
+	if err != nil {
+		t.Fatalf("error parsing keyring: %s", err)
+	}
+	if id, _ := k.Active(); id != LegacyKeyID {
+		t.Errorf("expected legacy key to be active but got %q", id)
+	}
+
+	for _, bad := range []struct{ spec, active string }{
+		{"", ""},
+		{"k1", ""},
+		{"k1:a,k1:b", ""},
+		{"k.1:a", ""},
+		{"k1:a", "k2"},
+	} {
+		if _, err = Parse(bad.spec, bad.active, ""); err == nil {
+			t.Errorf("expected error for spec %q and active key %q", bad.spec, bad.active)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package lockout
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_ParseProxies(t *testing.T) {
+	proxies, err := ParseProxies(" 10.0.0.0/8, 192.168.1.1 ,::1")
+	if err != nil {
+		t.Fatalf("error parsing proxies: %s", err)
+	}
+	if len(proxies) != 3 {
+		t.Fatalf("expected 3 proxies but got %d", len(proxies))
+	}
+	if proxies, err = ParseProxies(""); err != nil || len(proxies) != 0 {
+		t.Errorf("expected no proxies but got %v, %v", proxies, err)
+	}
+	for _, bad := range []string{"proxy", "10.0.0.0/33", "10.0.0"} {
+		if _, err = ParseProxies(bad); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func Test_ClientIP(t *testing.T) {
+	proxies, err := ParseProxies("10.0.0.0/8,2001:db8::1")
+	if err != nil {
+		t.Fatalf("error parsing proxies: %s", err)
+	}
+	tests := []struct {
+		name, remoteAddr string
+		forwardedFor     []string
+		expected         string
+	}{
+		{"direct", "203.0.113.7:51000", nil, "203.0.113.7"},
+		{"spoofed header from untrusted client", "203.0.113.7:51000", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"trusted proxy", "10.0.0.2:443", []string{"203.0.113.7"}, "203.0.113.7"},
+		{"spoofed entry before proxy's one", "10.0.0.2:443", []string{"198.51.100.1, 203.0.113.7"}, "203.0.113.7"},
+		{"chain of trusted proxies", "10.0.0.2:443", []string{"198.51.100.1, 203.0.113.7, 10.0.0.3"}, "203.0.113.7"},
+		{"several headers", "10.0.0.2:443", []string{"198.51.100.1", "203.0.113.7:8080"}, "203.0.113.7"},
+		{"garbage entry", "10.0.0.2:443", []string{"203.0.113.7, garbage, 10.0.0.3"}, "10.0.0.3"},
+		{"proxy without header", "10.0.0.2:443", nil, "10.0.0.2"},
+		{"only trusted hops", "10.0.0.2:443", []string{"10.0.0.4, 10.0.0.3"}, "10.0.0.4"},
+		{"IPv6 proxy", "[2001:db8::1]:443", []string{"2001:db8::7"}, "2001:db8::7"},
+		{"no port", "203.0.113.7", []string{"198.51.100.1"}, "203.0.113.7"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for _, v := range tt.forwardedFor {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			if ip := proxies.ClientIP(r); ip != tt.expected {
+				t.Errorf("expected %s but got %s", tt.expected, ip)
+			}
+		})
+	}
+
+	// without trusted proxies the header is never read
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "10.0.0.2:443"
+	r.Header.Set("X-Forwarded-For", "203.0.113.7")
+	if ip := Proxies(nil).ClientIP(r); ip != "10.0.0.2" {
+		t.Errorf("expected remote address but got %s", ip)
+	}
+}
+
+// Test_ClientIPThrottleKey checks that client changing X-Forwarded-For with each attempt
+// still has all its failures counted under the same key
+func Test_ClientIPThrottleKey(t *testing.T) {
+	proxies, _ := ParseProxies("10.0.0.0/8")
+	keys := map[string]bool{}
+	for _, spoofed := range []string{"198.51.100.1", "198.51.100.2", "198.51.100.3"} {
+		for _, remoteAddr := range []string{"203.0.113.7:51000", "10.0.0.2:443"} {
+			r := httptest.NewRequest("POST", "/login", nil)
+			r.RemoteAddr = remoteAddr
+			if remoteAddr == "10.0.0.2:443" {
+				spoofed += ", 203.0.113.7"
+			}
+			r.Header.Set("X-Forwarded-For", spoofed)
+			keys[ipKey("login", proxies.ClientIP(r))] = true
+		}
+	}
+	if len(keys) != 1 {
+		t.Errorf("expected all attempts to share one throttle key but got %v", keys)
+	}
+}
@@ -0,0 +1,159 @@
+package lockout
+
+import (
+	"embed"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/mailer"
+	"github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/models"
+)
+
+//go:embed templates
+var emailTemplateFS embed.FS
+
+// DefaultAccountPolicy slows down guessing password of a single account and locks it
+// out for a while after too many failures
+var DefaultAccountPolicy = models.ThrottlePolicy{
+	FreeAttempts: 3,
+	BaseDelay:    time.Second,
+	MaxDelay:     5 * time.Minute,
+	LockAfter:    10,
+	LockDuration: 30 * time.Minute,
+	Window:       time.Hour,
+}
+
+// DefaultIPPolicy slows down a client trying many accounts from the same address
+var DefaultIPPolicy = models.ThrottlePolicy{
+	FreeAttempts: 10,
+	BaseDelay:    time.Second,
+	MaxDelay:     5 * time.Minute,
+	LockAfter:    100,
+	LockDuration: 30 * time.Minute,
+	Window:       time.Hour,
+}
+
+// ThrottledError is returned when the attempt is made before the delay imposed by previous failures passes
+type ThrottledError struct {
+	RetryAfter time.Duration
+}
+
+func (e *ThrottledError) Error() string {
+	return fmt.Sprintf("too many failed attempts; try again in %s", e.RetryAfter.Round(time.Second))
+}
+
+// Guard protects authentication from brute-force attacks. Failures are counted per account
+// and per client IP address in DB, so that all servers share the same state
+type Guard struct {
+	DB            *models.DBModel
+	AccountPolicy models.ThrottlePolicy
+	IPPolicy      models.ThrottlePolicy
+	Mailer        *mailer.Mailer // sends lockout notices; may be nil
+	From          string
+	ErrorLog      *log.Logger
+}
+
+// New creates guard with default policies
+func New(db *models.DBModel, m *mailer.Mailer, from string, errorLog *log.Logger) *Guard {
+	return &Guard{
+		DB:            db,
+		AccountPolicy: DefaultAccountPolicy,
+		IPPolicy:      DefaultIPPolicy,
+		Mailer:        m,
+		From:          from,
+		ErrorLog:      errorLog,
+	}
+}
+
+func accountKey(action, email string) string {
+	return models.ThrottleKey(action, "account", email)
+}
+
+func ipKey(action, ip string) string {
+	return models.ThrottleKey(action, "ip", ip)
+}
+
+// Check returns ThrottledError if the action is not allowed for the account or from the address yet
+func (g *Guard) Check(action, email, ip string) error {
+	throttles, err := g.DB.GetAuthThrottles(accountKey(action, email), ipKey(action, ip))
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	var retryAfter time.Duration
+	for _, t := range throttles {
+		if d := t.RetryAfter(now); d > retryAfter {
+			retryAfter = d
+		}
+	}
+	if retryAfter > 0 {
+		return &ThrottledError{RetryAfter: retryAfter}
+	}
+	return nil
+}
+
+// Fail counts failed attempt for the account and the address. Account locked out
+// from logging in is notified by email
+func (g *Guard) Fail(action, email, ip string) error {
+	// only login failures lock the account, otherwise anyone could lock it out
+	accountPolicy := g.AccountPolicy
+	if action != models.ThrottleLogin {
+		accountPolicy.LockAfter = 0
+	}
+	throttle, lockedNow, err := g.DB.RecordAuthFailure(accountKey(action, email), accountPolicy)
+	if err != nil {
+		return err
+	}
+	if _, _, err = g.DB.RecordAuthFailure(ipKey(action, ip), g.IPPolicy); err != nil {
+		return err
+	}
+	if lockedNow {
+		g.notify(email, throttle)
+	}
+	return nil
+}
+
+// Succeed forgets failures of the account, so that legitimate user starts from scratch
+func (g *Guard) Succeed(action, email string) error {
+	return g.DB.ClearAuthThrottles(accountKey(action, email))
+}
+
+// LockedUntil returns time the account is locked out from logging in until or nil if it is not locked
+func (g *Guard) LockedUntil(email string) (*time.Time, error) {
+	throttles, err := g.DB.GetAuthThrottles(accountKey(models.ThrottleLogin, email))
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range throttles {
+		if t.Locked && t.RetryAfter(time.Now()) > 0 {
+			return t.BlockedUntil, nil
+		}
+	}
+	return nil, nil
+}
+
+// Unlock lifts lockout of the account
+func (g *Guard) Unlock(email string) error {
+	return g.DB.ClearAuthThrottles(accountKey(models.ThrottleLogin, email))
+}
+
+// notify sends lockout notice in background not to delay the response
+func (g *Guard) notify(email string, throttle models.AuthThrottle) {
+	if g.Mailer == nil {
+		return
+	}
+	data := struct {
+		Failures    int
+		LockedUntil time.Time
+	}{
+		Failures:    throttle.Failures,
+		LockedUntil: *throttle.BlockedUntil,
+	}
+	m := g.Mailer.WithTemplates(emailTemplateFS)
+	go func() {
+		if err := m.Send(g.From, email, "Your account has been locked", "account-locked", data); err != nil && g.ErrorLog != nil {
+			g.ErrorLog.Println(err)
+		}
+	}()
+}
@@ -0,0 +1,79 @@
+package mailer
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"strings"
+	"time"
+
+	mail "github.com/xhit/go-simple-mail/v2"
+)
+
+// Mailer sends emails rendered from templates/<name>.html.tmpl and templates/<name>.plain.tmpl
+// pairs, that define "body" template each
+type Mailer struct {
+	Host      string
+	Port      int
+	Username  string
+	Password  string
+	Templates fs.FS
+}
+
+// WithTemplates returns copy of the mailer that renders templates from another file system
+func (m *Mailer) WithTemplates(templates fs.FS) *Mailer {
+	c := *m
+	c.Templates = templates
+	return &c
+}
+
+// Send renders template tmpl with data and sends it from one address to another
+func (m *Mailer) Send(from, to, subject, tmpl string, data any) error {
+	formattedMessage, err := m.render(fmt.Sprintf("templates/%s.html.tmpl", tmpl), data)
+	if err != nil {
+		return err
+	}
+	plainMessage, err := m.render(fmt.Sprintf("templates/%s.plain.tmpl", tmpl), data)
+	if err != nil {
+		return err
+	}
+
+	// send the mail
+	server := mail.NewSMTPClient()
+	server.Host = m.Host
+	server.Port = m.Port
+	if len(strings.Replace(m.Username, " ", "", -1)) > 0 {
+		server.Username = m.Username
+		server.Password = m.Password
+	}
+	server.Encryption = mail.EncryptionTLS
+	server.KeepAlive = false
+	server.ConnectTimeout = 10 * time.Second
+	server.SendTimeout = 10 * time.Second
+	smtpClient, err := server.Connect()
+	if err != nil {
+		return fmt.Errorf("error connecting to SMTP server: %w", err)
+	}
+	email := mail.NewMSG()
+	email.SetFrom(from).AddTo(to).SetSubject(subject).
+		SetBody(mail.TextHTML, formattedMessage).
+		AddAlternative(mail.TextPlain, plainMessage)
+
+	if err = email.Send(smtpClient); err != nil {
+		return fmt.Errorf("error sending mail: %w", err)
+	}
+	return nil
+}
+
+func (m *Mailer) render(templateToRender string, data any) (string, error) {
+	t, err := template.New("email").ParseFS(m.Templates, templateToRender)
+	if err != nil {
+		return "", fmt.Errorf("error parsing mail template: %w", err)
+	}
+	var tpl bytes.Buffer
+	if err = t.ExecuteTemplate(&tpl, "body", data); err != nil {
+		return "", fmt.Errorf("error rendering mail template: %w", err)
+	}
+	return tpl.String(), nil
+}
@@ -0,0 +1,131 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func Test_Origins(t *testing.T) {
+	got, err := Origins("http://localhost:4000/some/path", " https://Shop.Example.com, ,https://admin.example.com:8443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"http://localhost:4000", "https://shop.example.com", "https://admin.example.com:8443"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+
+	if _, err = Origins("localhost:4000"); err == nil {
+		t.Error("expected error for URL without scheme")
+	}
+}
+
+func Test_WebSocketOrigin(t *testing.T) {
+	for in, want := range map[string]string{
+		"http://localhost:4000":    "ws://localhost:4000",
+		"https://shop.example.com": "wss://shop.example.com",
+	} {
+		got, err := WebSocketOrigin(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("%s: expected %s, got %s", in, want, got)
+		}
+	}
+}
+
+func Test_Policy(t *testing.T) {
+	p := Policy{"script-src": {"'self'"}, "default-src": {"'none'"}}
+	p.Add("script-src", StripeScriptSources...).Add("script-src", "'self'")
+
+	want := "default-src 'none'; script-src 'self' https://js.stripe.com"
+	if got := p.String(); got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
+
+func Test_SecurityHeaders(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	tests := []struct {
+		name       string
+		opts       Options
+		header     string
+		notHeader  string
+		wantPolicy string
+		wantHSTS   bool
+	}{
+		{
+			name:       "enforced",
+			opts:       Options{Policy: APIPolicy(), HSTS: true},
+			header:     "Content-Security-Policy",
+			notHeader:  "Content-Security-Policy-Report-Only",
+			wantPolicy: "default-src 'none'; frame-ancestors 'none'",
+			wantHSTS:   true,
+		},
+		{
+			name:       "report only",
+			opts:       Options{Policy: APIPolicy(), ReportOnly: true, ReportURI: "/csp-report"},
+			header:     "Content-Security-Policy-Report-Only",
+			notHeader:  "Content-Security-Policy",
+			wantPolicy: "default-src 'none'; frame-ancestors 'none'; report-uri /csp-report",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			SecurityHeaders(tt.opts)(next).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+
+			h := rr.Header()
+			if got := h.Get(tt.header); got != tt.wantPolicy {
+				t.Errorf("expected %s %q, got %q", tt.header, tt.wantPolicy, got)
+			}
+			if got := h.Get(tt.notHeader); got != "" {
+				t.Errorf("expected no %s, got %q", tt.notHeader, got)
+			}
+			if got := h.Get("Strict-Transport-Security") != ""; got != tt.wantHSTS {
+				t.Errorf("expected HSTS %v, got %v", tt.wantHSTS, got)
+			}
+			if got := h.Get("X-Frame-Options"); got != "DENY" {
+				t.Errorf("expected X-Frame-Options DENY, got %q", got)
+			}
+		})
+	}
+}
+
+func Test_ScriptNonce(t *testing.T) {
+	var nonces []string
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nonces = append(nonces, Nonce(r))
+	})
+	policy := Policy{"script-src": {"'self'"}}
+	handler := SecurityHeaders(Options{Policy: policy, ScriptNonce: true})(next)
+
+	var headers []string
+	for i := 0; i < 2; i++ {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+		headers = append(headers, rr.Header().Get("Content-Security-Policy"))
+	}
+	for i, nonce := range nonces {
+		if nonce == "" {
+			t.Fatal("expected handler to get the nonce")
+		}
+		if want := fmt.Sprintf("script-src 'self' 'nonce-%s'", nonce); headers[i] != want {
+			t.Errorf("expected %q, got %q", want, headers[i])
+		}
+	}
+	if nonces[0] == nonces[1] {
+		t.Error("expected new nonce for every response")
+	}
+	if len(policy["script-src"]) != 1 {
+		t.Errorf("expected policy passed in to be left intact, got %v", policy)
+	}
+	if nonce := Nonce(httptest.NewRequest(http.MethodGet, "/", nil)); nonce != "" {
+		t.Errorf("expected no nonce outside the middleware, got %q", nonce)
+	}
+}
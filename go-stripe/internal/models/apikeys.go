@@ -0,0 +1,196 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// APIKeyPrefix starts every API key, so that keys can be told apart from user tokens
+const APIKeyPrefix = "wk_"
+
+// APIKey is a type for long-lived credentials of machine-to-machine integrations.
+// Key acts on behalf of the user it belongs to, limited by its scopes
+type APIKey struct {
+	DBEntity
+	UserID     int        `json:"user_id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	KeyHash    []byte     `json:"-"`
+	Scope      string     `json:"scope"`
+	Expiry     *time.Time `json:"expiry"`
+	AllowedIPs string     `json:"allowed_ips"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	User       User       `json:"user"`
+}
+
+// GenerateAPIKey generates new API key. It returns the key in plain text, that must be shown
+// to admin only once, and APIKey entity with its prefix and hash ready to be saved to DB
+func GenerateAPIKey(userID int, name, scope string, expiry *time.Time, allowedIPs string) (string, *APIKey, error) {
+	prefixBytes := make([]byte, 4)
+	if _, err := rand.Read(prefixBytes); err != nil {
+		return "", nil, fmt.Errorf("error generating API key: %w", err)
+	}
+	secretBytes := make([]byte, 20)
+	if _, err := rand.Read(secretBytes); err != nil {
+		return "", nil, fmt.Errorf("error generating API key: %w", err)
+	}
+	prefix := hex.EncodeToString(prefixBytes)
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secretBytes)
+	plainText := fmt.Sprintf("%s%s_%s", APIKeyPrefix, prefix, secret)
+	hash := sha256.Sum256([]byte(plainText))
+
+	return plainText, &APIKey{
+		UserID:     userID,
+		Name:       name,
+		Prefix:     prefix,
+		KeyHash:    hash[:],
+		Scope:      scope,
+		Expiry:     expiry,
+		AllowedIPs: allowedIPs,
+	}, nil
+}
+
+// IsAPIKey checks if plain text credential looks like an API key rather than a user token
+func IsAPIKey(plainText string) bool {
+	return strings.HasPrefix(plainText, APIKeyPrefix)
+}
+
+// apiKeyPrefix extracts the prefix key is looked up by
+func apiKeyPrefix(plainText string) (string, error) {
+	parts := strings.Split(strings.TrimPrefix(plainText, APIKeyPrefix), "_")
+	if !IsAPIKey(plainText) || len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", fmt.Errorf("malformed API key")
+	}
+	return parts[0], nil
+}
+
+// HasScope checks if the key grants the scope
+func (k *APIKey) HasScope(scope string) bool {
+	for _, s := range strings.Fields(k.Scope) {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Expired checks if the key has expiry date and it has passed
+func (k *APIKey) Expired() bool {
+	return k.Expiry != nil && !k.Expiry.After(time.Now())
+}
+
+// AllowsIP checks the address against key's allow-list of space or comma separated
+// addresses and CIDR ranges. Empty allow-list allows any address
+func (k *APIKey) AllowsIP(ip string) bool {
+	entries := strings.FieldsFunc(k.AllowedIPs, func(r rune) bool { return r == ',' || r == ' ' })
+	if len(entries) == 0 {
+		return true
+	}
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, e := range entries {
+		if strings.Contains(e, "/") {
+			if _, ipNet, err := net.ParseCIDR(e); err == nil && ipNet.Contains(addr) {
+				return true
+			}
+		} else if allowed := net.ParseIP(e); allowed != nil && allowed.Equal(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateAllowedIPs returns an error describing first malformed entry of the allow-list
+func ValidateAllowedIPs(allowedIPs string) error {
+	for _, e := range strings.FieldsFunc(allowedIPs, func(r rune) bool { return r == ',' || r == ' ' }) {
+		if strings.Contains(e, "/") {
+			if _, _, err := net.ParseCIDR(e); err != nil {
+				return fmt.Errorf("invalid CIDR range %q", e)
+			}
+		} else if net.ParseIP(e) == nil {
+			return fmt.Errorf("invalid IP address %q", e)
+		}
+	}
+	return nil
+}
+
+// InsertAPIKey saves new API key to DB and returns it's id
+func (m *DBModel) InsertAPIKey(k APIKey) (int, error) {
+	return insertEntity(&k, m)
+}
+
+// GetAllAPIKeys fetches all API keys with users they belong to
+func (m *DBModel) GetAllAPIKeys() ([]*APIKey, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	tx := m.DB.WithContext(ctx)
+
+	var keys []*APIKey
+	if err := tx.Joins("User").Order("api_keys.created_at desc").Find(&keys).Error; err != nil {
+		return nil, fmt.Errorf("error fetching API keys: %w", err)
+	}
+	for _, k := range keys {
+		k.User.Password = ""
+	}
+	return keys, nil
+}
+
+// GetUserForAPIKey fetches valid API key by its plain text value and the user it belongs to
+func (m *DBModel) GetUserForAPIKey(plainText string) (*User, *APIKey, error) {
+	prefix, err := apiKeyPrefix(plainText)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	tx := m.DB.WithContext(ctx)
+
+	var key APIKey
+	hash := sha256.Sum256([]byte(plainText))
+	err = tx.Joins("User").Where(&APIKey{Prefix: prefix}).First(&key).Error
+	if err != nil {
+		return nil, nil, fmt.Errorf("error getting API key from DB: %w", err)
+	}
+	if subtle.ConstantTimeCompare(key.KeyHash, hash[:]) != 1 {
+		return nil, nil, fmt.Errorf("error getting API key from DB: %w", gorm.ErrRecordNotFound)
+	}
+	if key.Expired() {
+		return nil, nil, fmt.Errorf("API key %q has expired", key.Name)
+	}
+
+	// do not write to DB on every request; once a minute is precise enough
+	now := time.Now()
+	if key.LastUsedAt == nil || key.LastUsedAt.Before(now.Add(-time.Minute)) {
+		if err = tx.Model(&APIKey{}).Where("id = ?", key.ID).Update("last_used_at", now).Error; err != nil {
+			return nil, nil, fmt.Errorf("error updating API key's last usage time: %w", err)
+		}
+	}
+
+	user := key.User
+	return &user, &key, nil
+}
+
+// GetAPIKey fetches API key from DB by id
+func (m *DBModel) GetAPIKey(id int) (APIKey, error) {
+	var key APIKey
+	err := getEntityById(id, m, &key)
+	return key, err
+}
+
+// DeleteAPIKey revokes API key
+func (m *DBModel) DeleteAPIKey(id int) error {
+	return deleteEntity(&APIKey{DBEntity: DBEntity{ID: id}}, m)
+}
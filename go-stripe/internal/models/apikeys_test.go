@@ -0,0 +1,48 @@
+package models
+
+import "testing"
+
+func Test_APIKeyAllowsIP(t *testing.T) {
+	var theTests = []struct {
+		allowedIPs string
+		ip         string
+		allowed    bool
+	}{
+		{"", "203.0.113.7", true},
+		{"203.0.113.7", "203.0.113.7", true},
+		{"203.0.113.7", "203.0.113.8", false},
+		{"10.0.0.0/8, 192.168.1.10", "10.20.30.40", true},
+		{"10.0.0.0/8,192.168.1.10", "192.168.1.10", true},
+		{"10.0.0.0/8 192.168.1.10", "192.168.1.11", false},
+		{"10.0.0.0/8", "not-an-ip", false},
+	}
+
+	for _, e := range theTests {
+		key := APIKey{AllowedIPs: e.allowedIPs}
+		if allowed := key.AllowsIP(e.ip); allowed != e.allowed {
+			t.Errorf("%q allowed by %q: expected %v but got %v", e.ip, e.allowedIPs, e.allowed, allowed)
+		}
+	}
+}
+
+func Test_APIKeyHasScope(t *testing.T) {
+	var theTests = []struct {
+		keyScope string
+		scope    string
+		has      bool
+	}{
+		{"reporting", ScopeReporting, true},
+		{"reporting", ScopeRefunds, false},
+		{"reporting refunds", ScopeRefunds, true},
+		{"", ScopeReporting, false},
+		// keys do not authenticate users, so authentication scope is never implied
+		{"reporting refunds", ScopeAuthentication, false},
+	}
+
+	for _, e := range theTests {
+		key := APIKey{Scope: e.keyScope}
+		if has := key.HasScope(e.scope); has != e.has {
+			t.Errorf("%q having %q: expected %v but got %v", e.keyScope, e.scope, e.has, has)
+		}
+	}
+}
@@ -0,0 +1,278 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Actions written to the audit log
+const (
+	AuditRefund             = "refund"
+	AuditCancelSubscription = "cancel-subscription"
+	AuditCreateUser         = "create-user"
+	AuditEditUser           = "edit-user"
+	AuditDeleteUser         = "delete-user"
+	AuditCreateAPIKey       = "create-api-key"
+	AuditRevokeAPIKey       = "revoke-api-key"
+	AuditResetTwoFactor     = "reset-two-factor"
+	AuditUnlockUser         = "unlock-user"
+	AuditRevokeSession      = "revoke-session"
+	AuditRetryOutbox        = "retry-outbox-message"
+	AuditRetryInvoiceJob    = "retry-invoice-job"
+)
+
+// Entities referenced by audit events
+const (
+	AuditEntityOrder   = "order"
+	AuditEntityUser    = "user"
+	AuditEntityKey     = "api-key"
+	AuditEntitySession = "session"
+	AuditEntityOutbox  = "outbox-message"
+	AuditEntityJob     = "invoice-job"
+)
+
+// AuditEvent is a type for privileged actions performed by admin users.
+// Audit events are never updated, so they do not embed DBEntity
+type AuditEvent struct {
+	ID        int       `json:"id" gorm:"primaryKey"`
+	CreatedAt time.Time `json:"created_at"`
+	UserID    int       `json:"user_id"`
+	Action    string    `json:"action"`
+	Entity    string    `json:"entity"`
+	EntityID  int       `json:"entity_id"`
+	Before    string    `json:"before"`
+	After     string    `json:"after"`
+	Diff      string    `json:"diff"`
+	IPAddress string    `json:"ip_address"`
+	User      User      `json:"user"`
+}
+
+// AuditFilter holds optional criteria for searching the audit log; zero values are ignored
+type AuditFilter struct {
+	UserID   int       `json:"user_id"`
+	Action   string    `json:"action"`
+	Entity   string    `json:"entity"`
+	EntityID int       `json:"entity_id"`
+	From     time.Time `json:"from"`
+	To       time.Time `json:"to"`
+}
+
+// redactedValue replaces values of fields encrypted at rest in the audit log, which is not encrypted
+const redactedValue = "[redacted]"
+
+type auditChange struct {
+	From any `json:"from"`
+	To   any `json:"to"`
+}
+
+// NewAuditEvent builds an audit event for action performed by user on entity, serializing
+// states before and after the action (either may be nil) and the difference between them
+func NewAuditEvent(userID int, action, entity string, entityID int, before, after any, ip string) (AuditEvent, error) {
+	event := AuditEvent{
+		UserID:    userID,
+		Action:    action,
+		Entity:    entity,
+		EntityID:  entityID,
+		IPAddress: ip,
+	}
+
+	beforeMap, err := toJsonMap(before)
+	if err != nil {
+		return event, fmt.Errorf("error serializing state before %q: %w", action, err)
+	}
+	afterMap, err := toJsonMap(after)
+	if err != nil {
+		return event, fmt.Errorf("error serializing state after %q: %w", action, err)
+	}
+	// the diff is taken before redaction, so that changes of encrypted fields are still seen
+	diff := jsonDiff(beforeMap, afterMap)
+	redactEncrypted(reflect.TypeOf(before), beforeMap)
+	redactEncrypted(reflect.TypeOf(after), afterMap)
+	for k := range diff {
+		diff[k] = auditChange{From: beforeMap[k], To: afterMap[k]}
+	}
+
+	if event.Before, err = marshalNotNil(beforeMap); err != nil {
+		return event, fmt.Errorf("error serializing state before %q: %w", action, err)
+	}
+	if event.After, err = marshalNotNil(afterMap); err != nil {
+		return event, fmt.Errorf("error serializing state after %q: %w", action, err)
+	}
+	if event.Diff, err = marshalNotNil(diff); err != nil {
+		return event, fmt.Errorf("error serializing changes of %q: %w", action, err)
+	}
+
+	return event, nil
+}
+
+// toJsonMap converts the value to generic map the way it would be seen by API clients
+func toJsonMap(v any) (map[string]any, error) {
+	if v == nil || (reflect.ValueOf(v).Kind() == reflect.Pointer && reflect.ValueOf(v).IsNil()) {
+		return nil, nil
+	}
+	out, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]any
+	if err = json.Unmarshal(out, &m); err != nil {
+		return nil, err
+	}
+	// password hashes must never get into the audit log
+	delete(m, "password")
+	return m, nil
+}
+
+// redactEncrypted replaces values of fields encrypted at rest (see encryptedSerializer) in JSON map
+// of the value of type t, including those of nested structs and slices
+func redactEncrypted(t reflect.Type, m map[string]any) {
+	for t != nil && t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct || m == nil {
+		return
+	}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" || !field.IsExported() {
+			continue
+		}
+		if field.Anonymous && name == "" {
+			redactEncrypted(field.Type, m)
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		value, ok := m[name]
+		if !ok {
+			continue
+		}
+		if strings.Contains(field.Tag.Get("gorm"), "serializer:"+encryptedSerializerName) {
+			m[name] = redactedValue
+			continue
+		}
+		switch v := value.(type) {
+		case map[string]any:
+			redactEncrypted(field.Type, v)
+		case []any:
+			elem := field.Type
+			for elem.Kind() == reflect.Pointer {
+				elem = elem.Elem()
+			}
+			if elem.Kind() != reflect.Slice && elem.Kind() != reflect.Array {
+				continue
+			}
+			for _, item := range v {
+				if itemMap, ok := item.(map[string]any); ok {
+					redactEncrypted(elem.Elem(), itemMap)
+				}
+			}
+		}
+	}
+}
+
+func marshalNotNil[V any](m map[string]V) (string, error) {
+	if m == nil {
+		return "", nil
+	}
+	out, err := json.Marshal(m)
+	return string(out), err
+}
+
+// jsonDiff returns top level fields that differ between before and after states
+func jsonDiff(before, after map[string]any) map[string]auditChange {
+	if before == nil && after == nil {
+		return nil
+	}
+	diff := map[string]auditChange{}
+	for k, v := range before {
+		if !reflect.DeepEqual(v, after[k]) {
+			diff[k] = auditChange{From: v, To: after[k]}
+		}
+	}
+	for k, v := range after {
+		if _, exists := before[k]; !exists {
+			diff[k] = auditChange{From: nil, To: v}
+		}
+	}
+	return diff
+}
+
+// InsertAuditEvent writes audit event to DB and returns it's id
+func (m *DBModel) InsertAuditEvent(event AuditEvent) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	event.CreatedAt = time.Now()
+	if err := m.DB.WithContext(ctx).Omit("User").Create(&event).Error; err != nil {
+		return 0, fmt.Errorf("error adding audit event: %w", err)
+	}
+	return event.ID, nil
+}
+
+// SearchAuditEvents fetches page of audit events matching the filter, newest first
+func (m *DBModel) SearchAuditEvents(filter AuditFilter, pageSize, page int) ([]*AuditEvent, int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	tx := m.DB.WithContext(ctx)
+
+	offset := (page - 1) * pageSize
+	var events []*AuditEvent
+	err := tx.
+		Scopes(filter.apply).
+		Clauses(clause.OrderBy{Columns: []clause.OrderByColumn{
+			{
+				Column: clause.Column{Table: "audit_events", Name: "created_at"},
+				Desc:   true,
+			},
+		}}).
+		Joins("User").
+		Offset(offset).Limit(pageSize).
+		Find(&events).Error
+	if err != nil {
+		return nil, 0, fmt.Errorf("error fetching audit events: %w", err)
+	}
+	for _, e := range events {
+		e.User.Password = ""
+	}
+
+	var count int64
+	err = tx.Model(&AuditEvent{}).Scopes(filter.apply).Count(&count).Error
+	if err != nil {
+		return nil, 0, fmt.Errorf("error getting audit events' count from DB: %w", err)
+	}
+
+	return events, int(count), nil
+}
+
+// apply adds filter's conditions to the query
+func (f AuditFilter) apply(tx *gorm.DB) *gorm.DB {
+	if f.UserID > 0 {
+		tx = tx.Where("audit_events.user_id = ?", f.UserID)
+	}
+	if f.Action != "" {
+		tx = tx.Where("audit_events.action = ?", f.Action)
+	}
+	if f.Entity != "" {
+		tx = tx.Where("audit_events.entity = ?", f.Entity)
+	}
+	if f.EntityID > 0 {
+		tx = tx.Where("audit_events.entity_id = ?", f.EntityID)
+	}
+	if !f.From.IsZero() {
+		tx = tx.Where("audit_events.created_at >= ?", f.From)
+	}
+	if !f.To.IsZero() {
+		tx = tx.Where("audit_events.created_at < ?", f.To)
+	}
+	return tx
+}
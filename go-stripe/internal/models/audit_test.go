@@ -0,0 +1,93 @@
+package models
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func Test_NewAuditEvent(t *testing.T) {
+	before := User{DBEntity: DBEntity{ID: 7}, FirstName: "John", LastName: "Dow", Email: "john@dow.com", Password: "old_hash"}
+	after := before
+	after.Email = "john@smith.com"
+	after.Password = "new_hash"
+
+	event, err := NewAuditEvent(1, AuditEditUser, AuditEntityUser, 7, before, &after, "127.0.0.1")
+	if err != nil {
+		t.Fatalf("error creating audit event: %s", err)
+	}
+
+	var diff map[string]auditChange
+	if err = json.Unmarshal([]byte(event.Diff), &diff); err != nil {
+		t.Fatalf("error parsing diff %q: %s", event.Diff, err)
+	}
+	if len(diff) != 1 {
+		t.Errorf("expected only email to be changed but got %v", diff)
+	}
+	if diff["email"].From != redactedValue || diff["email"].To != redactedValue {
+		t.Errorf("expected email change to be redacted but got %v", diff["email"])
+	}
+	if _, exists := diff["password"]; exists {
+		t.Error("password must not be written to audit log")
+	}
+
+	event, err = NewAuditEvent(1, AuditDeleteUser, AuditEntityUser, 7, before, nil, "127.0.0.1")
+	if err != nil {
+		t.Fatalf("error creating audit event: %s", err)
+	}
+	if event.After != "" {
+		t.Errorf("expected empty after state but got %q", event.After)
+	}
+	diff = nil
+	if err = json.Unmarshal([]byte(event.Diff), &diff); err != nil {
+		t.Fatalf("error parsing diff %q: %s", event.Diff, err)
+	}
+	if diff["first_name"].From != "John" || diff["first_name"].To != nil {
+		t.Errorf("bad first name change: %v", diff["first_name"])
+	}
+}
+
+// Test_NewAuditEventRedactsPII checks that fields encrypted at rest, including those of nested
+// entities, do not get into the audit log in plain text
+func Test_NewAuditEventRedactsPII(t *testing.T) {
+	before := Order{
+		DBEntity:    DBEntity{ID: 3},
+		StatusID:    1,
+		Amount:      1000,
+		Transaction: Transaction{LastFour: "4242", ExpiryMonth: 11, ExpiryYear: 2031},
+		Customer:    Customer{FirstName: "Jane", LastName: "Roe", Email: "jane@roe.com"},
+	}
+	after := before
+	after.StatusID = 2
+	after.Customer.Email = "jane@doe.com"
+
+	token := Token{UserID: 7, Name: "John Dow", Email: "john@dow.com", Device: "curl"}
+	for _, e := range []struct{ before, after any }{{before, &after}, {nil, token}, {&token, nil}} {
+		event, err := NewAuditEvent(1, AuditRefund, AuditEntityOrder, 3, e.before, e.after, "127.0.0.1")
+		if err != nil {
+			t.Fatalf("error creating audit event: %s", err)
+		}
+		for _, pii := range []string{"4242", "2031", "Jane", "Roe", "jane@roe.com", "jane@doe.com", "John Dow", "john@dow.com"} {
+			for name, state := range map[string]string{"before": event.Before, "after": event.After, "diff": event.Diff} {
+				if strings.Contains(state, pii) {
+					t.Errorf("%q must not be in %s state %s", pii, name, state)
+				}
+			}
+		}
+	}
+
+	event, err := NewAuditEvent(1, AuditRefund, AuditEntityOrder, 3, before, &after, "127.0.0.1")
+	if err != nil {
+		t.Fatalf("error creating audit event: %s", err)
+	}
+	var diff map[string]auditChange
+	if err = json.Unmarshal([]byte(event.Diff), &diff); err != nil {
+		t.Fatalf("error parsing diff %q: %s", event.Diff, err)
+	}
+	if _, changed := diff["customer"]; !changed {
+		t.Errorf("expected change of customer's email to be seen in %v", diff)
+	}
+	if !strings.Contains(event.After, `"amount":1000`) {
+		t.Errorf("expected data not encrypted at rest to be kept in %s", event.After)
+	}
+}
@@ -46,14 +46,9 @@ func modelCopy(dest, src any) error {
 				dElem.Field(i).SetBool(sElem.Field(i).Bool())
 			case reflect.String:
 				dElem.Field(i).SetString(sElem.Field(i).String())
-			case reflect.Int:
-			case reflect.Int8:
-			case reflect.Int16:
-			case reflect.Int32:
-			case reflect.Int64:
+			case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
 				dElem.Field(i).SetInt(sElem.Field(i).Int())
-			case reflect.Float32:
-			case reflect.Float64:
+			case reflect.Float32, reflect.Float64:
 				dElem.Field(i).SetFloat(sElem.Field(i).Float())
 			}
 		}
@@ -22,6 +22,7 @@ func Test_CopyUser(t *testing.T) {
 			LastName:  "Smith",
 			Password:  "new_usr_pwd",
 			Email:     "alex@smith.com",
+			RoleID:    4,
 		},
 			dest: User{
 				DBEntity: DBEntity{
@@ -33,6 +34,7 @@ func Test_CopyUser(t *testing.T) {
 				LastName:  "Dow",
 				Password:  "old_pwd",
 				Email:     "john@dow.com",
+				RoleID:    1,
 			},
 			result: User{
 				DBEntity: DBEntity{
@@ -44,6 +46,7 @@ func Test_CopyUser(t *testing.T) {
 				LastName:  "Smith",
 				Password:  "old_pwd",
 				Email:     "alex@smith.com",
+				RoleID:    4,
 			},
 		},
 	}
@@ -68,6 +71,9 @@ func Test_CopyUser(t *testing.T) {
 		if e.dest.Password != e.result.Password {
 			t.Errorf("bad copying: expected %v but got %v", e.result.Password, e.dest.Password)
 		}
+		if e.dest.RoleID != e.result.RoleID {
+			t.Errorf("bad copying: expected %v but got %v", e.result.RoleID, e.dest.RoleID)
+		}
 		if e.dest.CreatedAt != e.result.CreatedAt {
 			t.Errorf("bad copying: expected %v but got %v", e.result.CreatedAt, e.dest.CreatedAt)
 		}
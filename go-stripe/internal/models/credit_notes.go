@@ -0,0 +1,111 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// CreditNote is a type for credit notes of money returned on invoiced charge. Amount is the amount
+// returned. They are numbered per year without gaps in their own series, so they are never deleted
+type CreditNote struct {
+	DBEntity
+	InvoiceID int        `json:"invoice_id"`
+	OrderID   int        `json:"order_id"`
+	Number    string     `json:"number"`
+	Year      int        `json:"year"`
+	Sequence  int        `json:"sequence"`
+	Reason    string     `json:"reason"`
+	Currency  string     `json:"currency"`
+	Amount    int        `json:"amount"`
+	PDFPath   string     `json:"pdf_path" gorm:"column:pdf_path"`
+	IssuedAt  time.Time  `json:"issued_at"`
+	SentAt    *time.Time `json:"sent_at"`
+}
+
+const creditNoteSequences = "credit_note_sequences"
+
+// FormatCreditNoteNumber formats number of the credit note issued in the year
+func FormatCreditNoteNumber(year, sequence int) string {
+	return fmt.Sprintf("CN-%d-%06d", year, sequence)
+}
+
+// CreditNoteDocumentKey returns the key PDF of the credit note is kept by in document storage
+func CreditNoteDocumentKey(number string) string {
+	return fmt.Sprintf("credit-notes/%s.pdf", number)
+}
+
+// FindOrCreateCreditNote returns credit note of the order if it has been issued already, or issues
+// it with the next number of the year it is issued in. Reports if credit note has been created
+func (m *DBModel) FindOrCreateCreditNote(note CreditNote) (CreditNote, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	created := false
+	year := note.IssuedAt.Year()
+	err := m.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		seq, err := lockSequence(tx, creditNoteSequences, year)
+		if err != nil {
+			return err
+		}
+
+		var existing CreditNote
+		err = tx.Where("order_id = ?", note.OrderID).First(&existing).Error
+		if err == nil {
+			note = existing
+			return nil
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		if note.Sequence, err = nextNumber(tx, creditNoteSequences, seq); err != nil {
+			return err
+		}
+		note.Year = year
+		note.Number = FormatCreditNoteNumber(year, note.Sequence)
+		note.SetCreated()
+		created = true
+		return tx.Create(&note).Error
+	})
+	if err != nil {
+		return CreditNote{}, false, fmt.Errorf("error issuing credit note for order %d: %w", note.OrderID, err)
+	}
+	return note, created, nil
+}
+
+// SetCreditNotePDF records the key PDF of the credit note is stored by
+func (m *DBModel) SetCreditNotePDF(id int, path string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	tx := m.DB.WithContext(ctx)
+
+	err := tx.Model(&CreditNote{}).Where("id = ?", id).Updates(map[string]any{
+		"pdf_path":   path,
+		"updated_at": time.Now(),
+	}).Error
+	if err != nil {
+		return fmt.Errorf("error saving credit note PDF path: %w", err)
+	}
+	return nil
+}
+
+// MarkCreditNoteSent records the time credit note has been sent to customer
+func (m *DBModel) MarkCreditNoteSent(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	tx := m.DB.WithContext(ctx)
+
+	now := time.Now()
+	err := tx.Model(&CreditNote{}).Where("id = ?", id).Updates(map[string]any{
+		"sent_at":    now,
+		"updated_at": now,
+	}).Error
+	if err != nil {
+		return fmt.Errorf("error marking credit note sent: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package models
+
+import (
+	"os"
+	"testing"
+
+	"github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/driver"
+	"github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/keyring"
+)
+
+// testDB connects to scratch DB migrated with soda, which WIDGETS_TEST_DSN names the way WIDGETS_DSN
+// names DB of the apps. Tests using it write to the DB, so they are skipped unless it is set
+func testDB(t *testing.T) *DBModel {
+	t.Helper()
+	dsn := os.Getenv("WIDGETS_TEST_DSN")
+	if dsn == "" {
+		t.Skip("WIDGETS_TEST_DSN is not set")
+	}
+	keys := keyring.Single([]byte("abcdefghijklmnopqrstuvwxyz012345"))
+	if err := ConfigureFieldEncryption(keys, []byte("test-index-key"), false); err != nil {
+		t.Fatal(err)
+	}
+	db, err := driver.OpenDB(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &DBModel{DB: db}
+}
+
+// testOrder inserts order of the widget paid by a new transaction and returns ids of both
+func testOrder(t *testing.T, m *DBModel, widgetID int) (int, int) {
+	t.Helper()
+	customerID, err := m.InsertCustomer(Customer{FirstName: "Jane", LastName: "Doe", Email: "jane@example.com",
+		EmailIndex: EmailIndex("jane@example.com")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	txnID := testTransaction(t, m, nil)
+	orderID, err := m.InsertOrder(Order{WidgetID: widgetID, TransactionID: txnID, CustomerID: customerID, StatusID: 1,
+		Quantity: 1, Amount: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return orderID, txnID
+}
+
+// testTransaction inserts cleared charge, which renews the order if it is given, and returns its id
+func testTransaction(t *testing.T, m *DBModel, orderID *int) int {
+	t.Helper()
+	txnID, err := m.InsertTransaction(Transaction{Amount: 1000, Currency: "usd", LastFour: "4242", ExpiryMonth: 12,
+		ExpiryYear: 2030, TransactionStatusID: 2, OrderID: orderID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return txnID
+}
@@ -0,0 +1,235 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Kinds of invoice jobs
+const (
+	InvoiceJobKindInvoice    = "invoice"
+	InvoiceJobKindCreditNote = "credit-note"
+)
+
+// Statuses of invoice jobs
+const (
+	InvoiceJobQueued    = "queued"
+	InvoiceJobRunning   = "running"
+	InvoiceJobSucceeded = "succeeded"
+	InvoiceJobFailed    = "failed"
+)
+
+// InvoiceJob is a type for documents the invoicing microservice has accepted to issue and send.
+// Jobs are kept in DB, so that accepted ones are not lost if the service restarts; running
+// job is locked until LockedUntil and is taken over by another worker once the lock expires.
+// Payload holds personal data, so it is encrypted at rest
+type InvoiceJob struct {
+	ID            int        `json:"id" gorm:"primaryKey"`
+	Kind          string     `json:"kind"`
+	Reference     string     `json:"reference"`
+	Payload       string     `json:"-" gorm:"serializer:encrypted"`
+	Status        string     `json:"status"`
+	Attempts      int        `json:"attempts"`
+	NextAttemptAt time.Time  `json:"next_attempt_at"`
+	LockedUntil   *time.Time `json:"-"`
+	LastError     string     `json:"last_error"`
+	Result        string     `json:"result"`
+	FinishedAt    *time.Time `json:"finished_at"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"-"`
+}
+
+// NewInvoiceJob makes job of the kind due right away
+func NewInvoiceJob(kind, reference string, payload any) (InvoiceJob, error) {
+	out, err := json.Marshal(payload)
+	if err != nil {
+		return InvoiceJob{}, fmt.Errorf("error marshalling %s job: %w", kind, err)
+	}
+	return InvoiceJob{
+		Kind:          kind,
+		Reference:     reference,
+		Payload:       string(out),
+		Status:        InvoiceJobQueued,
+		NextAttemptAt: time.Now(),
+	}, nil
+}
+
+// InsertInvoiceJobs inserts jobs in one transaction, so that batch is accepted as a whole,
+// and returns their ids
+func (m *DBModel) InsertInvoiceJobs(jobs []InvoiceJob) ([]int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		for i := range jobs {
+			if err := tx.Create(&jobs[i]).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error adding invoice jobs: %w", err)
+	}
+	ids := make([]int, 0, len(jobs))
+	for _, job := range jobs {
+		ids = append(ids, job.ID)
+	}
+	return ids, nil
+}
+
+// GetInvoiceJob fetches job by id
+func (m *DBModel) GetInvoiceJob(id int) (InvoiceJob, error) {
+	var job InvoiceJob
+	err := getEntityById(id, m, &job)
+	return job, err
+}
+
+// ClaimInvoiceJobs fetches up to limit jobs due to run, including running ones whose lock
+// has expired, and locks them for lease, so that other workers skip them meanwhile
+func (m *DBModel) ClaimInvoiceJobs(limit int, lease time.Duration) ([]*InvoiceJob, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var jobs []*InvoiceJob
+	err := m.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		err := claimableInvoiceJobs(tx, now, limit).Find(&jobs).Error
+		if err != nil || len(jobs) == 0 {
+			return err
+		}
+		ids := make([]int, 0, len(jobs))
+		for _, job := range jobs {
+			ids = append(ids, job.ID)
+		}
+		return tx.Model(&InvoiceJob{}).Where("id in ?", ids).Updates(map[string]any{
+			"status":       InvoiceJobRunning,
+			"locked_until": now.Add(lease),
+			"updated_at":   now,
+		}).Error
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error claiming invoice jobs: %w", err)
+	}
+	return jobs, nil
+}
+
+// claimableInvoiceJobs selects up to limit jobs due to run by the time, locking them and skipping ones
+// locked by other workers
+func claimableInvoiceJobs(tx *gorm.DB, now time.Time, limit int) *gorm.DB {
+	return tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+		Where("(status = ? and next_attempt_at <= ?) or (status = ? and locked_until < ?)",
+			InvoiceJobQueued, now, InvoiceJobRunning, now).
+		Order("next_attempt_at").Limit(limit)
+}
+
+// CompleteInvoiceJob records successful run of the job
+func (m *DBModel) CompleteInvoiceJob(id int, result string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	tx := m.DB.WithContext(ctx)
+
+	now := time.Now()
+	err := tx.Model(&InvoiceJob{}).Where("id = ?", id).Updates(map[string]any{
+		"status":       InvoiceJobSucceeded,
+		"attempts":     gorm.Expr("attempts + 1"),
+		"locked_until": nil,
+		"last_error":   "",
+		"result":       result,
+		"finished_at":  now,
+		"updated_at":   now,
+	}).Error
+	if err != nil {
+		return fmt.Errorf("error completing invoice job: %w", err)
+	}
+	return nil
+}
+
+// FailInvoiceJob records failed run of the job and schedules the next one; the job fails
+// for good if there is no next attempt
+func (m *DBModel) FailInvoiceJob(id int, runErr error, nextAttemptAt *time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	tx := m.DB.WithContext(ctx)
+
+	now := time.Now()
+	values := map[string]any{
+		"attempts":     gorm.Expr("attempts + 1"),
+		"locked_until": nil,
+		"last_error":   runErr.Error(),
+		"updated_at":   now,
+	}
+	if nextAttemptAt != nil {
+		values["status"] = InvoiceJobQueued
+		values["next_attempt_at"] = *nextAttemptAt
+	} else {
+		values["status"] = InvoiceJobFailed
+		values["finished_at"] = now
+	}
+	if err := tx.Model(&InvoiceJob{}).Where("id = ?", id).Updates(values).Error; err != nil {
+		return fmt.Errorf("error failing invoice job: %w", err)
+	}
+	return nil
+}
+
+// PostponeInvoiceJob records that the job could not run yet and schedules the next attempt;
+// unlike failure, it does not count as attempt
+func (m *DBModel) PostponeInvoiceJob(id int, reason error, nextAttemptAt time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	tx := m.DB.WithContext(ctx)
+
+	err := tx.Model(&InvoiceJob{}).Where("id = ?", id).Updates(map[string]any{
+		"status":          InvoiceJobQueued,
+		"locked_until":    nil,
+		"last_error":      reason.Error(),
+		"next_attempt_at": nextAttemptAt,
+		"updated_at":      time.Now(),
+	}).Error
+	if err != nil {
+		return fmt.Errorf("error postponing invoice job: %w", err)
+	}
+	return nil
+}
+
+// GetFailedInvoiceJobs fetches jobs that have failed for good, latest first
+func (m *DBModel) GetFailedInvoiceJobs() ([]*InvoiceJob, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	tx := m.DB.WithContext(ctx)
+
+	var jobs []*InvoiceJob
+	err := tx.Where("status = ?", InvoiceJobFailed).Order("finished_at desc").Find(&jobs).Error
+	if err != nil {
+		return nil, fmt.Errorf("error fetching failed invoice jobs: %w", err)
+	}
+	return jobs, nil
+}
+
+// RetryInvoiceJob queues failed job to run right away with all of its attempts again
+func (m *DBModel) RetryInvoiceJob(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	tx := m.DB.WithContext(ctx)
+
+	now := time.Now()
+	result := tx.Model(&InvoiceJob{}).Where("id = ? and status = ?", id, InvoiceJobFailed).Updates(map[string]any{
+		"status":          InvoiceJobQueued,
+		"attempts":        0,
+		"next_attempt_at": now,
+		"finished_at":     nil,
+		"updated_at":      now,
+	})
+	if result.Error != nil {
+		return fmt.Errorf("error retrying invoice job: %w", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("error retrying invoice job: %w", gorm.ErrRecordNotFound)
+	}
+	return nil
+}
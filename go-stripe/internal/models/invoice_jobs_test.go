@@ -0,0 +1,135 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+)
+
+func Test_ClaimableInvoiceJobs(t *testing.T) {
+	// statements are built, but not run
+	db, err := gorm.Open(mysql.New(mysql.Config{DSN: "user@tcp(127.0.0.1:3306)/widgets", SkipInitializeWithVersion: true}),
+		&gorm.Config{DryRun: true, DisableAutomaticPing: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2023, 5, 20, 10, 0, 0, 0, time.UTC)
+
+	var jobs []*InvoiceJob
+	stmt := claimableInvoiceJobs(db, now, 3).Find(&jobs).Statement
+	expected := "SELECT * FROM `invoice_jobs` WHERE (status = ? and next_attempt_at <= ?) or (status = ? and locked_until < ?) " +
+		"ORDER BY next_attempt_at LIMIT 3 FOR UPDATE SKIP LOCKED"
+	if sql := stmt.SQL.String(); sql != expected {
+		t.Errorf("expected query\n%s\nbut got\n%s", expected, sql)
+	}
+	// due queued jobs and running jobs whose lease has expired are claimed
+	vars := []any{InvoiceJobQueued, now, InvoiceJobRunning, now}
+	if len(stmt.Vars) != len(vars) {
+		t.Fatalf("expected %d query parameters but got %v", len(vars), stmt.Vars)
+	}
+	for i, v := range vars {
+		if stmt.Vars[i] != v {
+			t.Errorf("parameter %d: expected %v but got %v", i+1, v, stmt.Vars[i])
+		}
+	}
+}
+
+// insertTestJobs empties the queue and adds n jobs due right away
+func insertTestJobs(t *testing.T, m *DBModel, n int) []int {
+	t.Helper()
+	if err := m.DB.Exec("delete from invoice_jobs").Error; err != nil {
+		t.Fatal(err)
+	}
+	var jobs []InvoiceJob
+	for i := 0; i < n; i++ {
+		job, err := NewInvoiceJob(InvoiceJobKindInvoice, fmt.Sprintf("order:%d", i+1), map[string]int{"id": i + 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		jobs = append(jobs, job)
+	}
+	ids, err := m.InsertInvoiceJobs(jobs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ids
+}
+
+func Test_ClaimInvoiceJobs(t *testing.T) {
+	m := testDB(t)
+	insertTestJobs(t, m, 3)
+
+	// claimed jobs are skipped while their lease lasts
+	for _, expected := range []int{2, 1, 0} {
+		jobs, err := m.ClaimInvoiceJobs(2, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(jobs) != expected {
+			t.Errorf("expected %d jobs to be claimed but got %d", expected, len(jobs))
+		}
+	}
+
+	// job of worker that stopped before recording the outcome is taken over once its lease expires
+	ids := insertTestJobs(t, m, 1)
+	if jobs, err := m.ClaimInvoiceJobs(1, -time.Second); err != nil || len(jobs) != 1 {
+		t.Fatalf("expected job to be claimed, got %d jobs and error %v", len(jobs), err)
+	}
+	jobs, err := m.ClaimInvoiceJobs(1, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 || jobs[0].ID != ids[0] {
+		t.Errorf("expected job %d with expired lease to be claimed again, got %d jobs", ids[0], len(jobs))
+	}
+}
+
+func Test_FailAndRetryInvoiceJob(t *testing.T) {
+	m := testDB(t)
+	id := insertTestJobs(t, m, 1)[0]
+	status := func(expected string, attempts int) {
+		t.Helper()
+		job, err := m.GetInvoiceJob(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.Status != expected || job.Attempts != attempts {
+			t.Errorf("expected %s job after %d attempts but got %s after %d", expected, attempts, job.Status, job.Attempts)
+		}
+	}
+
+	next := time.Now().Add(-time.Second)
+	if err := m.PostponeInvoiceJob(id, errors.New("invoice has not been issued yet"), next); err != nil {
+		t.Fatal(err)
+	}
+	status(InvoiceJobQueued, 0)
+	if err := m.FailInvoiceJob(id, errors.New("mail server is down"), &next); err != nil {
+		t.Fatal(err)
+	}
+	status(InvoiceJobQueued, 1)
+	if err := m.FailInvoiceJob(id, errors.New("mail server is down"), nil); err != nil {
+		t.Fatal(err)
+	}
+	status(InvoiceJobFailed, 2)
+
+	failed, err := m.GetFailedInvoiceJobs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failed) != 1 || failed[0].ID != id || failed[0].LastError != "mail server is down" {
+		t.Fatalf("expected failed job %d to be listed, got %+v", id, failed)
+	}
+
+	// retried job has all of its attempts again; only failed jobs are retried
+	if err = m.RetryInvoiceJob(id); err != nil {
+		t.Fatal(err)
+	}
+	status(InvoiceJobQueued, 0)
+	if err = m.RetryInvoiceJob(id); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Errorf("expected queued job not to be retried, got %v", err)
+	}
+}
@@ -0,0 +1,208 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Invoice is a type for invoices issued for charges of orders: one-off orders are invoiced once,
+// subscriptions once per billing period. PDFPath and XMLPath are the keys of its PDF and of its
+// UBL e-invoice in document storage. Brand and Locale are those of invoice's template; credit
+// notes reversing it are rendered with them too.
+// Invoices are numbered per year without gaps, as accounting requires, so they are never deleted
+type Invoice struct {
+	DBEntity
+	OrderID       int        `json:"order_id"`
+	TransactionID *int       `json:"transaction_id"`
+	Number        string     `json:"number"`
+	Year          int        `json:"year"`
+	Sequence      int        `json:"sequence"`
+	Currency      string     `json:"currency"`
+	Subtotal      int        `json:"subtotal"`
+	Discount      int        `json:"discount"`
+	Tax           int        `json:"tax"`
+	Total         int        `json:"total"`
+	PDFPath       string     `json:"pdf_path" gorm:"column:pdf_path"`
+	XMLPath       string     `json:"xml_path" gorm:"column:xml_path"`
+	Brand         string     `json:"brand"`
+	Locale        string     `json:"locale"`
+	IssuedAt      time.Time  `json:"issued_at"`
+	DueAt         *time.Time `json:"due_at"`
+	PeriodStart   *time.Time `json:"period_start"`
+	PeriodEnd     *time.Time `json:"period_end"`
+	SentAt        *time.Time `json:"sent_at"`
+}
+
+// InvoiceSequence is a type for the last invoice number issued in the year
+type InvoiceSequence struct {
+	ID         int `gorm:"primaryKey"`
+	Year       int
+	LastNumber int
+}
+
+// TableName overrides table name used by InvoiceSequence
+func (InvoiceSequence) TableName() string {
+	return "invoice_sequences"
+}
+
+// lockSequence locks sequence row of the year in the table until transaction ends,
+// creating the row if it is the first number of the year
+func lockSequence(tx *gorm.DB, table string, year int) (InvoiceSequence, error) {
+	if err := tx.Table(table).Clauses(clause.OnConflict{DoNothing: true}).Create(&InvoiceSequence{Year: year}).Error; err != nil {
+		return InvoiceSequence{}, err
+	}
+	var seq InvoiceSequence
+	err := tx.Table(table).Clauses(clause.Locking{Strength: "UPDATE"}).Where("year = ?", year).First(&seq).Error
+	return seq, err
+}
+
+// nextNumber takes the next number of locked sequence
+func nextNumber(tx *gorm.DB, table string, seq InvoiceSequence) (int, error) {
+	seq.LastNumber++
+	if err := tx.Table(table).Where("id = ?", seq.ID).Update("last_number", seq.LastNumber).Error; err != nil {
+		return 0, err
+	}
+	return seq.LastNumber, nil
+}
+
+// FormatInvoiceNumber formats number of the invoice issued in the year
+func FormatInvoiceNumber(year, sequence int) string {
+	return fmt.Sprintf("%d-%06d", year, sequence)
+}
+
+// InvoiceDocumentKey returns the key PDF of the invoice is kept by in document storage
+func InvoiceDocumentKey(number string) string {
+	return fmt.Sprintf("invoices/%s.pdf", number)
+}
+
+// InvoiceXMLKey returns the key UBL e-invoice is kept by in document storage
+func InvoiceXMLKey(number string) string {
+	return fmt.Sprintf("invoices/%s.xml", number)
+}
+
+// FindOrCreateInvoice returns invoice of the charge if it has been issued already, or issues
+// it with the next number of the year it is issued in. Reports if invoice has been created
+func (m *DBModel) FindOrCreateInvoice(inv Invoice) (Invoice, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	created := false
+	year := inv.IssuedAt.Year()
+	err := m.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// sequence row is locked first, so that concurrent requests for the same order
+		// are serialized and number taken by failed transaction is rolled back with it
+		seq, err := lockSequence(tx, InvoiceSequence{}.TableName(), year)
+		if err != nil {
+			return err
+		}
+
+		// charge is invoiced once; requests made before charges were recorded only have the order
+		var existing Invoice
+		query := tx.Where("order_id = ?", inv.OrderID)
+		if inv.TransactionID != nil {
+			query = tx.Where("transaction_id = ?", *inv.TransactionID)
+		}
+		err = query.First(&existing).Error
+		if err == nil {
+			inv = existing
+			return nil
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		if inv.Sequence, err = nextNumber(tx, InvoiceSequence{}.TableName(), seq); err != nil {
+			return err
+		}
+		inv.Year = year
+		inv.Number = FormatInvoiceNumber(year, inv.Sequence)
+		inv.SetCreated()
+		created = true
+		return tx.Create(&inv).Error
+	})
+	if err != nil {
+		return Invoice{}, false, fmt.Errorf("error issuing invoice for order %d: %w", inv.OrderID, err)
+	}
+	return inv, created, nil
+}
+
+// SetInvoicePDF records the key PDF of the invoice is stored by
+func (m *DBModel) SetInvoicePDF(id int, path string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	tx := m.DB.WithContext(ctx)
+
+	err := tx.Model(&Invoice{}).Where("id = ?", id).Updates(map[string]any{
+		"pdf_path":   path,
+		"updated_at": time.Now(),
+	}).Error
+	if err != nil {
+		return fmt.Errorf("error saving invoice PDF path: %w", err)
+	}
+	return nil
+}
+
+// SetInvoiceXML records the key UBL e-invoice of the invoice is stored by
+func (m *DBModel) SetInvoiceXML(id int, path string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	tx := m.DB.WithContext(ctx)
+
+	err := tx.Model(&Invoice{}).Where("id = ?", id).Updates(map[string]any{
+		"xml_path":   path,
+		"updated_at": time.Now(),
+	}).Error
+	if err != nil {
+		return fmt.Errorf("error saving invoice XML path: %w", err)
+	}
+	return nil
+}
+
+// MarkInvoiceSent records the time invoice has been sent to customer
+func (m *DBModel) MarkInvoiceSent(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	tx := m.DB.WithContext(ctx)
+
+	now := time.Now()
+	err := tx.Model(&Invoice{}).Where("id = ?", id).Updates(map[string]any{
+		"sent_at":    now,
+		"updated_at": now,
+	}).Error
+	if err != nil {
+		return fmt.Errorf("error marking invoice sent: %w", err)
+	}
+	return nil
+}
+
+// GetInvoiceByOrderID returns the latest invoice issued for the order
+func (m *DBModel) GetInvoiceByOrderID(orderID int) (Invoice, error) {
+	return getInvoiceBy(m, "order_id = ?", orderID)
+}
+
+// GetInvoiceByTransactionID returns invoice of the charge
+func (m *DBModel) GetInvoiceByTransactionID(transactionID int) (Invoice, error) {
+	return getInvoiceBy(m, "transaction_id = ?", transactionID)
+}
+
+// GetInvoiceByNumber returns invoice by its number
+func (m *DBModel) GetInvoiceByNumber(number string) (Invoice, error) {
+	return getInvoiceBy(m, "number = ?", number)
+}
+
+func getInvoiceBy(m *DBModel, query string, value any) (Invoice, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	tx := m.DB.WithContext(ctx)
+
+	var inv Invoice
+	if err := tx.Where(query, value).Order("issued_at desc").Order("id desc").First(&inv).Error; err != nil {
+		return inv, fmt.Errorf("error getting invoice: %w", err)
+	}
+	return inv, nil
+}
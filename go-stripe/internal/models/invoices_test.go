@@ -0,0 +1,109 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+// clearYears deletes credit notes, invoices and sequences of the years, so that numbering of
+// documents issued in them starts over
+func clearYears(t *testing.T, m *DBModel, years ...int) {
+	t.Helper()
+	for _, table := range []string{"credit_notes", "invoices", creditNoteSequences, InvoiceSequence{}.TableName()} {
+		if err := m.DB.Exec("delete from "+table+" where year in ?", years).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func Test_FormatNumbers(t *testing.T) {
+	if n := FormatInvoiceNumber(2023, 7); n != "2023-000007" {
+		t.Errorf("expected invoice number 2023-000007 but got %s", n)
+	}
+	if n := FormatCreditNoteNumber(2024, 123456); n != "CN-2024-123456" {
+		t.Errorf("expected credit note number CN-2024-123456 but got %s", n)
+	}
+}
+
+func Test_FindOrCreateInvoice(t *testing.T) {
+	m := testDB(t)
+	// years no real document is issued in
+	const year, nextYear = 1999, 2000
+	clearYears(t, m, year, nextYear)
+	may := time.Date(year, 5, 19, 10, 0, 0, 0, time.UTC)
+	order1, txn1 := testOrder(t, m, 1)
+	order2, txn2 := testOrder(t, m, 2)
+	renewal := testTransaction(t, m, &order2)
+	order3, txn3 := testOrder(t, m, 1)
+	order4, txn4 := testOrder(t, m, 1)
+
+	// number taken by failed transaction is given to the next invoice
+	if _, created, err := m.FindOrCreateInvoice(Invoice{OrderID: 0, IssuedAt: may}); err == nil || created {
+		t.Fatalf("expected invoice of unknown order to fail, got created %v and error %v", created, err)
+	}
+
+	tests := []struct {
+		name    string
+		invoice Invoice
+		number  string
+		created bool
+	}{
+		{"first of the year", Invoice{OrderID: order1, TransactionID: &txn1, IssuedAt: may}, "1999-000001", true},
+		{"next order", Invoice{OrderID: order2, TransactionID: &txn2, IssuedAt: may}, "1999-000002", true},
+		{"repeated charge", Invoice{OrderID: order1, TransactionID: &txn1, IssuedAt: may.Add(time.Hour)}, "1999-000001", false},
+		{"repeated order without charge", Invoice{OrderID: order1, IssuedAt: may}, "1999-000001", false},
+		{"renewal of the order", Invoice{OrderID: order2, TransactionID: &renewal, IssuedAt: may}, "1999-000003", true},
+		{"first of the new year", Invoice{OrderID: order3, TransactionID: &txn3, IssuedAt: time.Date(nextYear, 1, 1, 0, 0, 0, 0, time.UTC)}, "2000-000001", true},
+		{"late invoice of the old year", Invoice{OrderID: order4, TransactionID: &txn4, IssuedAt: time.Date(year, 12, 31, 23, 0, 0, 0, time.UTC)}, "1999-000004", true},
+	}
+	for _, tt := range tests {
+		inv, created, err := m.FindOrCreateInvoice(tt.invoice)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if inv.Number != tt.number || created != tt.created {
+			t.Errorf("%s: expected %s created %v but got %s created %v", tt.name, tt.number, tt.created, inv.Number, created)
+		}
+	}
+}
+
+func Test_FindOrCreateCreditNote(t *testing.T) {
+	m := testDB(t)
+	const year, nextYear = 1999, 2000
+	clearYears(t, m, year, nextYear)
+	may := time.Date(year, 5, 19, 10, 0, 0, 0, time.UTC)
+	var orders, invoices []int
+	for i := 0; i < 3; i++ {
+		orderID, txnID := testOrder(t, m, 1)
+		inv, _, err := m.FindOrCreateInvoice(Invoice{OrderID: orderID, TransactionID: &txnID, IssuedAt: may})
+		if err != nil {
+			t.Fatal(err)
+		}
+		orders, invoices = append(orders, orderID), append(invoices, inv.ID)
+	}
+
+	if _, created, err := m.FindOrCreateCreditNote(CreditNote{InvoiceID: 0, OrderID: orders[0], IssuedAt: may}); err == nil || created {
+		t.Fatalf("expected credit note of unknown invoice to fail, got created %v and error %v", created, err)
+	}
+
+	tests := []struct {
+		name    string
+		note    CreditNote
+		number  string
+		created bool
+	}{
+		{"first of the year", CreditNote{InvoiceID: invoices[0], OrderID: orders[0], IssuedAt: may}, "CN-1999-000001", true},
+		{"repeated order", CreditNote{InvoiceID: invoices[0], OrderID: orders[0], IssuedAt: may}, "CN-1999-000001", false},
+		{"next order", CreditNote{InvoiceID: invoices[1], OrderID: orders[1], IssuedAt: may}, "CN-1999-000002", true},
+		{"first of the new year", CreditNote{InvoiceID: invoices[2], OrderID: orders[2], IssuedAt: time.Date(nextYear, 1, 1, 0, 0, 0, 0, time.UTC)}, "CN-2000-000001", true},
+	}
+	for _, tt := range tests {
+		note, created, err := m.FindOrCreateCreditNote(tt.note)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if note.Number != tt.number || created != tt.created {
+			t.Errorf("%s: expected %s created %v but got %s created %v", tt.name, tt.number, tt.created, note.Number, created)
+		}
+	}
+}
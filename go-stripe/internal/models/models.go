@@ -1,11 +1,12 @@
 package models
 
 import (
+	"bytes"
 	"context"
 	"crypto/sha256"
+	"errors"
 	"fmt"
 	"reflect"
-	"strings"
 	"time"
 
 	"golang.org/x/crypto/bcrypt"
@@ -54,7 +55,8 @@ func (e *DBEntity) SetUpdated() {
 	e.UpdatedAt = time.Now()
 }
 
-// Widget is the type for all widgets
+// Widget is the type for all widgets. Brand names templates its invoices are rendered with;
+// widgets without one are invoiced with the default brand of invoicing microservice
 type Widget struct {
 	DBEntity
 	Name           string `json:"name"`
@@ -64,20 +66,24 @@ type Widget struct {
 	Image          string `json:"image"`
 	IsRecurring    bool   `json:"is_recurring"`
 	PlanID         string `json:"plan_id"`
+	Brand          string `json:"brand"`
 }
 
-// Order is the type for all orders
+// Order is the type for all orders. CurrentPeriodEnd is the end of paid period of subscription;
+// it is nil for one-off orders. Locale is customer's preferred one documents are issued in
 type Order struct {
 	DBEntity
-	WidgetID      int         `json:"widget_id"`
-	TransactionID int         `json:"transaction_id"`
-	CustomerID    int         `json:"customer_id"`
-	StatusID      int         `json:"status_id"`
-	Quantity      int         `json:"quantity"`
-	Amount        int         `json:"amount"`
-	Widget        Widget      `json:"widget"`
-	Transaction   Transaction `json:"transaction"`
-	Customer      Customer    `json:"customer"`
+	WidgetID         int         `json:"widget_id"`
+	TransactionID    int         `json:"transaction_id"`
+	CustomerID       int         `json:"customer_id"`
+	StatusID         int         `json:"status_id"`
+	Quantity         int         `json:"quantity"`
+	Amount           int         `json:"amount"`
+	CurrentPeriodEnd *time.Time  `json:"current_period_end"`
+	Locale           string      `json:"locale"`
+	Widget           Widget      `json:"widget"`
+	Transaction      Transaction `json:"transaction" gorm:"foreignKey:TransactionID"`
+	Customer         Customer    `json:"customer"`
 }
 
 // Status is a type for order statuses
@@ -92,18 +98,23 @@ type TransactionStatus struct {
 	Name int `json:"name"`
 }
 
-// Transactionis a type for transactions
+// Transactionis a type for transactions. OrderID, StripeInvoiceID and the period are set
+// on charges renewing subscription
 type Transaction struct {
 	DBEntity
-	Amount              int    `json:"amount"`
-	Currency            string `json:"currency"`
-	LastFour            string `json:"last_four"`
-	ExpiryMonth         int    `json:"expiry_month"`
-	ExpiryYear          int    `json:"expiry_year"`
-	PaymentIntent       string `json:"payment_intent"`
-	PaymentMethod       string `json:"payment_method"`
-	BankReturnCode      string `json:"bank_return_code"`
-	TransactionStatusID int    `json:"transaction_status_id"`
+	Amount              int        `json:"amount"`
+	Currency            string     `json:"currency"`
+	LastFour            string     `json:"last_four" gorm:"serializer:encrypted"`
+	ExpiryMonth         int        `json:"expiry_month" gorm:"serializer:encrypted"`
+	ExpiryYear          int        `json:"expiry_year" gorm:"serializer:encrypted"`
+	PaymentIntent       string     `json:"payment_intent"`
+	PaymentMethod       string     `json:"payment_method"`
+	BankReturnCode      string     `json:"bank_return_code"`
+	TransactionStatusID int        `json:"transaction_status_id"`
+	OrderID             *int       `json:"order_id"`
+	StripeInvoiceID     *string    `json:"-"`
+	PeriodStart         *time.Time `json:"period_start"`
+	PeriodEnd           *time.Time `json:"period_end"`
 }
 
 // User is a type for users
@@ -111,26 +122,41 @@ type User struct {
 	DBEntity
 	FirstName string `json:"first_name"`
 	LastName  string `json:"last_name"`
-	Email     string `json:"email"`
-	Password  string `model-copy:"ignore" json:"password"`
-}
-
-// Token is a type for saving tokens (SToken) to DB
+	// Email is encrypted at rest and looked up by EmailIndex
+	Email      string `json:"email" gorm:"serializer:encrypted"`
+	EmailIndex string `model-copy:"ignore" json:"-"`
+	Password   string `model-copy:"ignore" json:"password"`
+	RoleID     int    `json:"role_id" gorm:"default:1"`
+	// TOTPSecret is encrypted with the application's secret key
+	TOTPSecret  string `model-copy:"ignore" json:"-" gorm:"column:totp_secret"`
+	TOTPEnabled bool   `model-copy:"ignore" json:"totp_enabled" gorm:"column:totp_enabled"`
+	// TOTPLastStep is the time step of the last accepted TOTP code; codes of it and earlier are replays
+	TOTPLastStep int64 `model-copy:"ignore" json:"-" gorm:"column:totp_last_step"`
+}
+
+// Token is a type for saving tokens (SToken) to DB. Name and email of the user
+// are personal data and are encrypted at rest
 type Token struct {
 	DBEntity
-	UserID    int
-	Name      string
-	Email     string
-	Expiry    time.Time
-	TokenHash []byte
-}
-
-// Customer is a type for customers
+	UserID     int        `json:"user_id"`
+	Name       string     `json:"name" gorm:"serializer:encrypted"`
+	Email      string     `json:"email" gorm:"serializer:encrypted"`
+	Device     string     `json:"device"`
+	Scope      string     `json:"scope"`
+	Expiry     time.Time  `json:"expiry"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	TokenHash  []byte     `json:"-"`
+	Current    bool       `json:"current" gorm:"-"`
+}
+
+// Customer is a type for customers. Personal data is encrypted at rest
+// and customers are looked up by EmailIndex
 type Customer struct {
 	DBEntity
-	FirstName string `json:"first_name"`
-	LastName  string `json:"last_name"`
-	Email     string `json:"email"`
+	FirstName  string `json:"first_name" gorm:"serializer:encrypted"`
+	LastName   string `json:"last_name" gorm:"serializer:encrypted"`
+	Email      string `json:"email" gorm:"serializer:encrypted"`
+	EmailIndex string `model-copy:"ignore" json:"-"`
 }
 
 // GetWidget fetches Widget entity from DB by id
@@ -203,16 +229,38 @@ func (m *DBModel) InsertCustomer(customer Customer) (int, error) {
 	return insertEntity(&customer, m)
 }
 
-func (m *DBModel) UpdatePasswordForUser(u User, hash string) error {
+// FindOrInsertCustomer returns id of existing customer with the same email, updating
+// the name if it has changed, or inserts new customer and returns it's id
+func (m *DBModel) FindOrInsertCustomer(customer Customer) (int, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
-
 	tx := m.DB.WithContext(ctx)
-	u.Password = hash
-	u.UpdatedAt = time.Now()
-	err := tx.Save(&u).Error
 
-	return err
+	var existing Customer
+	err := tx.Scopes(byEmail(customer.Email)).Order("id").First(&existing).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return m.InsertCustomer(customer)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error searching customer by email: %w", err)
+	}
+	if existing.FirstName != customer.FirstName || existing.LastName != customer.LastName {
+		customer.ID = existing.ID
+		if err = updateEntity(&customer, m); err != nil {
+			return 0, err
+		}
+	}
+	return existing.ID, nil
+}
+
+func (m *DBModel) UpdatePasswordForUser(u User, hash string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	// update only the password, as u may be partially filled in
+	return m.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		return updatePassword(tx, u.ID, hash)
+	})
 }
 
 func (m *DBModel) UpdateOrderStatus(id, statusID int) error {
@@ -237,7 +285,7 @@ func (m *DBModel) GetUserByEmail(email string) (User, error) {
 
 	tx := m.DB.WithContext(ctx)
 	user := User{}
-	result := tx.Where(&User{Email: strings.ToLower(email)}).First(&user)
+	result := tx.Scopes(byEmail(email)).First(&user)
 	if result.Error != nil {
 		return user, fmt.Errorf("error searching user by email: %w", result.Error)
 	}
@@ -259,42 +307,111 @@ func (m *DBModel) Authenticate(email, password string) (int, error) {
 	return u.ID, nil
 }
 
-func (m *DBModel) GetUserForToken(token string) (*User, error) {
+// GetUserForToken fetches valid token by its plain text value and the user it belongs to
+func (m *DBModel) GetUserForToken(token string) (*User, *Token, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
 	tx := m.DB.WithContext(ctx)
-	var user User
+	var t Token
 	tokenHash := sha256.Sum256([]byte(token))
-	err := tx.Joins("join tokens t on t.user_id = users.id").
-		Where("t.token_hash = ? and t.expiry > ?", tokenHash[:], time.Now()).
-		First(&user).Error
+	err := tx.Where("token_hash = ? and expiry > ?", tokenHash[:], time.Now()).First(&t).Error
+	if err != nil {
+		return nil, nil, fmt.Errorf("error getting token from DB: %w", err)
+	}
+	var user User
+	if err = tx.First(&user, t.UserID).Error; err != nil {
+		return nil, nil, fmt.Errorf("error getting user by token from DB: %w", err)
+	}
+
+	// do not write to DB on every request; once a minute is precise enough
+	now := time.Now()
+	err = tx.Model(&Token{}).
+		Where("token_hash = ? and (last_used_at is null or last_used_at < ?)", tokenHash[:], now.Add(-time.Minute)).
+		Update("last_used_at", now).Error
 	if err != nil {
-		return nil, fmt.Errorf("error getting user by token from DB: %w", err)
+		return nil, nil, fmt.Errorf("error updating token's last usage time: %w", err)
 	}
-	return &user, nil
+	return &user, &t, nil
 }
 
-func (m *DBModel) InsertToken(t *SToken, u User) (int, error) {
+// InsertToken saves new token issued to user on device. Tokens issued earlier on other devices
+// stay valid; only expired ones are cleaned up
+func (m *DBModel) InsertToken(t *SToken, u User, device string) (int, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 	tx := m.DB.WithContext(ctx)
 
-	// Delete all existing tokens for the user first
-	err := tx.Where(&Token{UserID: u.ID}).Delete(&Token{}).Error
+	err := tx.Where("user_id = ? and expiry <= ?", u.ID, time.Now()).Delete(&Token{}).Error
 	if err != nil {
-		return 0, fmt.Errorf("error deleting old tokens: %w", err)
+		return 0, fmt.Errorf("error deleting expired tokens: %w", err)
 	}
 
-	token := Token{
+	token := newToken(t, u, device)
+	return insertEntity(&token, m)
+}
+
+// newToken makes token entity to save from token issued to user on device
+func newToken(t *SToken, u User, device string) Token {
+	return Token{
 		UserID:    u.ID,
 		Name:      fmt.Sprintf("%s %s", u.FirstName, u.LastName),
 		Email:     u.Email,
+		Device:    device,
+		Scope:     t.Scope,
 		Expiry:    t.Expiry,
 		TokenHash: t.Hash,
 	}
+}
 
-	return insertEntity(&token, m)
+// GetTokensForUser fetches all valid tokens of the user, most recently used first;
+// the token passed in currentToken is marked as current
+func (m *DBModel) GetTokensForUser(userID int, currentToken string) ([]*Token, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	tx := m.DB.WithContext(ctx)
+
+	var tokens []*Token
+	err := tx.Where("user_id = ? and expiry > ?", userID, time.Now()).
+		Order("last_used_at desc").Order("created_at desc").
+		Find(&tokens).Error
+	if err != nil {
+		return nil, fmt.Errorf("error fetching user's tokens: %w", err)
+	}
+	currentHash := sha256.Sum256([]byte(currentToken))
+	for _, t := range tokens {
+		t.Current = bytes.Equal(t.TokenHash, currentHash[:])
+	}
+	return tokens, nil
+}
+
+// DeleteToken revokes token by its plain text value
+func (m *DBModel) DeleteToken(token string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	tx := m.DB.WithContext(ctx)
+
+	tokenHash := sha256.Sum256([]byte(token))
+	if err := tx.Where("token_hash = ?", tokenHash[:]).Delete(&Token{}).Error; err != nil {
+		return fmt.Errorf("error deleting token: %w", err)
+	}
+	return nil
+}
+
+// DeleteTokenForUser revokes token identified by id if it belongs to the user
+func (m *DBModel) DeleteTokenForUser(userID, tokenID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	tx := m.DB.WithContext(ctx)
+
+	result := tx.Where("id = ? and user_id = ?", tokenID, userID).Delete(&Token{})
+	if result.Error != nil {
+		return fmt.Errorf("error deleting token: %w", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("error deleting token: %w", gorm.ErrRecordNotFound)
+	}
+	return nil
 }
 
 func (m *DBModel) GetAllOrders(pageSize, pageNo int) ([]*Order, int, error) {
@@ -396,8 +513,12 @@ func (m *DBModel) DeleteUser(u User) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 	tx := m.DB.WithContext(ctx)
-	err := tx.Where(&Token{UserID: u.ID}).Delete(&Token{}).Error
+	// sessions go first, as deleting tokens deletes sessions' index rows too
+	err := destroyUserSessions(tx, u.ID)
 	if err != nil {
+		return fmt.Errorf("error destroying user session(s): %w", err)
+	}
+	if err = tx.Where(&Token{UserID: u.ID}).Delete(&Token{}).Error; err != nil {
 		return fmt.Errorf("error deleting user token(s): %w", err)
 	}
 
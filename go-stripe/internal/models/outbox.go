@@ -0,0 +1,217 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Outbox topics; each of them is delivered by its own handler
+const (
+	OutboxTopicInvoice    = "invoice"
+	OutboxTopicCreditNote = "credit-note"
+)
+
+// OutboxMessage is a type for messages to other services that are written in the same
+// transaction as data they are about and delivered later, so that none of them is lost
+// if the service is down. Payload may hold personal data, so it is encrypted at rest
+type OutboxMessage struct {
+	ID            int        `json:"id" gorm:"primaryKey"`
+	Topic         string     `json:"topic"`
+	Reference     string     `json:"reference"`
+	Payload       string     `json:"-" gorm:"serializer:encrypted"`
+	Attempts      int        `json:"attempts"`
+	NextAttemptAt time.Time  `json:"next_attempt_at"`
+	LockedUntil   *time.Time `json:"-"`
+	LastError     string     `json:"last_error"`
+	DeliveredAt   *time.Time `json:"delivered_at"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"-"`
+}
+
+// TableName overrides table name used by OutboxMessage
+func (OutboxMessage) TableName() string {
+	return "outbox"
+}
+
+// newOutboxMessage makes message due for delivery right away
+func newOutboxMessage(topic, reference string, payload any) (OutboxMessage, error) {
+	out, err := json.Marshal(payload)
+	if err != nil {
+		return OutboxMessage{}, fmt.Errorf("error marshalling %s message: %w", topic, err)
+	}
+	return OutboxMessage{
+		Topic:         topic,
+		Reference:     reference,
+		Payload:       string(out),
+		NextAttemptAt: time.Now(),
+	}, nil
+}
+
+// InsertOrderWithMessage inserts new order and a message on the topic in one transaction and
+// returns order's id. Payload of the message is made by the function, as it needs the id
+func (m *DBModel) InsertOrderWithMessage(order Order, topic string, payload func(orderID int) any) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	order.SetCreated()
+	err := m.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&order).Error; err != nil {
+			return err
+		}
+		msg, err := newOutboxMessage(topic, fmt.Sprintf("%s:%d", AuditEntityOrder, order.ID), payload(order.ID))
+		if err != nil {
+			return err
+		}
+		return tx.Create(&msg).Error
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error adding order: %w", err)
+	}
+	return order.ID, nil
+}
+
+// UpdateOrderStatusWithMessage sets status of the order and inserts a message on the topic about it
+// in one transaction
+func (m *DBModel) UpdateOrderStatusWithMessage(id, statusID int, topic string, payload any) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		res := tx.Model(&Order{}).Where("id = ?", id).Updates(map[string]any{
+			"status_id":  statusID,
+			"updated_at": time.Now(),
+		})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		msg, err := newOutboxMessage(topic, fmt.Sprintf("%s:%d", AuditEntityOrder, id), payload)
+		if err != nil {
+			return err
+		}
+		return tx.Create(&msg).Error
+	})
+	if err != nil {
+		return fmt.Errorf("error updating status of order %d: %w", id, err)
+	}
+	return nil
+}
+
+// ClaimOutboxMessages fetches up to limit messages due for delivery and locks them for lease,
+// so that other dispatchers skip them meanwhile
+func (m *DBModel) ClaimOutboxMessages(limit int, lease time.Duration) ([]*OutboxMessage, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var msgs []*OutboxMessage
+	err := m.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("delivered_at is null and next_attempt_at <= ?", now).
+			Where("locked_until is null or locked_until < ?", now).
+			Order("next_attempt_at").Limit(limit).
+			Find(&msgs).Error
+		if err != nil || len(msgs) == 0 {
+			return err
+		}
+		ids := make([]int, 0, len(msgs))
+		for _, msg := range msgs {
+			ids = append(ids, msg.ID)
+		}
+		return tx.Model(&OutboxMessage{}).Where("id in ?", ids).Update("locked_until", now.Add(lease)).Error
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error claiming outbox messages: %w", err)
+	}
+	return msgs, nil
+}
+
+// MarkOutboxMessageDelivered records successful delivery of the message
+func (m *DBModel) MarkOutboxMessageDelivered(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	tx := m.DB.WithContext(ctx)
+
+	now := time.Now()
+	err := tx.Model(&OutboxMessage{}).Where("id = ?", id).Updates(map[string]any{
+		"attempts":     gorm.Expr("attempts + 1"),
+		"delivered_at": now,
+		"locked_until": nil,
+		"last_error":   "",
+		"updated_at":   now,
+	}).Error
+	if err != nil {
+		return fmt.Errorf("error marking outbox message delivered: %w", err)
+	}
+	return nil
+}
+
+// MarkOutboxMessageFailed records failed delivery attempt and schedules the next one
+func (m *DBModel) MarkOutboxMessageFailed(id int, deliveryErr error, nextAttemptAt time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	tx := m.DB.WithContext(ctx)
+
+	err := tx.Model(&OutboxMessage{}).Where("id = ?", id).Updates(map[string]any{
+		"attempts":        gorm.Expr("attempts + 1"),
+		"next_attempt_at": nextAttemptAt,
+		"locked_until":    nil,
+		"last_error":      deliveryErr.Error(),
+		"updated_at":      time.Now(),
+	}).Error
+	if err != nil {
+		return fmt.Errorf("error marking outbox message failed: %w", err)
+	}
+	return nil
+}
+
+// GetUndeliveredOutboxMessages fetches messages that have not been delivered yet, ones failed
+// most times first
+func (m *DBModel) GetUndeliveredOutboxMessages() ([]*OutboxMessage, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	tx := m.DB.WithContext(ctx)
+
+	var msgs []*OutboxMessage
+	err := tx.Where("delivered_at is null").
+		Order("attempts desc").Order("created_at").
+		Find(&msgs).Error
+	if err != nil {
+		return nil, fmt.Errorf("error fetching undelivered outbox messages: %w", err)
+	}
+	return msgs, nil
+}
+
+// GetOutboxMessage fetches message by id
+func (m *DBModel) GetOutboxMessage(id int) (OutboxMessage, error) {
+	var msg OutboxMessage
+	err := getEntityById(id, m, &msg)
+	return msg, err
+}
+
+// RetryOutboxMessage makes undelivered message due for delivery right away
+func (m *DBModel) RetryOutboxMessage(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	tx := m.DB.WithContext(ctx)
+
+	now := time.Now()
+	result := tx.Model(&OutboxMessage{}).Where("id = ? and delivered_at is null", id).Updates(map[string]any{
+		"next_attempt_at": now,
+		"updated_at":      now,
+	})
+	if result.Error != nil {
+		return fmt.Errorf("error retrying outbox message: %w", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("error retrying outbox message: %w", gorm.ErrRecordNotFound)
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package models
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ScopePasswordReset marks tokens sent in password reset links
+const ScopePasswordReset = "password-reset"
+
+// ErrInvalidResetToken is returned for unknown, used or expired password reset tokens
+var ErrInvalidResetToken = errors.New("password reset link is invalid or has expired")
+
+// PasswordReset is a type for one-time tokens of password reset links. Only hash of the token is stored
+type PasswordReset struct {
+	DBEntity
+	UserID    int
+	TokenHash []byte
+	Expiry    time.Time
+}
+
+// CreatePasswordReset generates one-time password reset token for the user that lasts for ttl
+// and returns it in plain text. Tokens requested earlier are invalidated
+func (m *DBModel) CreatePasswordReset(userID int, ttl time.Duration) (string, error) {
+	token, err := GenerateToken(userID, ttl, ScopePasswordReset)
+	if err != nil {
+		return "", err
+	}
+	reset := PasswordReset{UserID: userID, TokenHash: token.Hash, Expiry: token.Expiry}
+	reset.SetCreated()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err = m.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", userID).Delete(&PasswordReset{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&reset).Error
+	})
+	if err != nil {
+		return "", fmt.Errorf("error saving password reset token: %w", err)
+	}
+	return token.PlainText, nil
+}
+
+// GetUserForPasswordReset fetches the user valid password reset token is bound to
+func (m *DBModel) GetUserForPasswordReset(token string) (User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	tx := m.DB.WithContext(ctx)
+
+	var reset PasswordReset
+	if err := findPasswordReset(tx, token).First(&reset).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return User{}, ErrInvalidResetToken
+		}
+		return User{}, fmt.Errorf("error getting password reset token: %w", err)
+	}
+	var user User
+	if err := tx.First(&user, reset.UserID).Error; err != nil {
+		return User{}, fmt.Errorf("error getting user by password reset token: %w", err)
+	}
+	return user, nil
+}
+
+// ResetPassword sets new password hash for the user valid token is bound to and uses the token up.
+// It returns the user whose password has been changed
+func (m *DBModel) ResetPassword(token, hash string) (User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var user User
+	err := m.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// lock the token, so that it can not be used twice concurrently
+		var reset PasswordReset
+		err := findPasswordReset(tx, token).Clauses(clause.Locking{Strength: "UPDATE"}).First(&reset).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrInvalidResetToken
+		}
+		if err != nil {
+			return err
+		}
+		if err = tx.First(&user, reset.UserID).Error; err != nil {
+			return err
+		}
+		return updatePassword(tx, user.ID, hash)
+	})
+	if errors.Is(err, ErrInvalidResetToken) {
+		return User{}, err
+	}
+	if err != nil {
+		return User{}, fmt.Errorf("error resetting password: %w", err)
+	}
+	return user, nil
+}
+
+func findPasswordReset(tx *gorm.DB, token string) *gorm.DB {
+	tokenHash := sha256.Sum256([]byte(token))
+	return tx.Where("token_hash = ? and expiry > ?", tokenHash[:], time.Now())
+}
+
+// updatePassword sets new password hash and invalidates all password reset tokens of the user
+func updatePassword(tx *gorm.DB, userID int, hash string) error {
+	err := tx.Model(&User{}).Where("id = ?", userID).
+		Updates(map[string]any{"password": hash, "updated_at": time.Now()}).Error
+	if err != nil {
+		return err
+	}
+	return tx.Where("user_id = ?", userID).Delete(&PasswordReset{}).Error
+}
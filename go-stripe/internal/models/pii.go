@@ -0,0 +1,217 @@
+package models
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/encryption"
+	"github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/keyring"
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+)
+
+// encryptedSerializerName is used in gorm tags of fields encrypted at rest
+const encryptedSerializerName = "encrypted"
+
+// encryptedPrefix starts every value written by the serializer; values without it
+// have been stored before field-level encryption and are read as is
+const encryptedPrefix = "v2:"
+
+// blindIndexKey is used to compute blind indexes of encrypted emails. Unlike encryption keys
+// it can not be rotated without recomputing all the indexes
+var blindIndexKey []byte
+
+// allowLegacyCiphertext enables decryption of secrets stored in legacy AES-CFB format
+var allowLegacyCiphertext bool
+
+func init() {
+	// schema must be parsable before encryption is configured, i.e. in tests
+	schema.RegisterSerializer(encryptedSerializerName, encryptedSerializer{})
+}
+
+// ConfigureFieldEncryption sets keys personal data is encrypted at rest with and the key of
+// blind indexes it is looked up by. Legacy ciphertexts should stop being allowed once
+// EncryptPersonalData has re-encrypted them. It must be called once on start up before DB is accessed
+func ConfigureFieldEncryption(keys *keyring.Keyring, indexKey []byte, allowLegacy bool) error {
+	if len(indexKey) == 0 {
+		return errors.New("blind index key is required for field-level encryption")
+	}
+	blindIndexKey = indexKey
+	allowLegacyCiphertext = allowLegacy
+	schema.RegisterSerializer(encryptedSerializerName, encryptedSerializer{
+		encryptor: &encryption.Encryption{Keys: keys},
+	})
+	return nil
+}
+
+// EmailIndex returns blind index of the email, that allows to look up encrypted emails
+func EmailIndex(email string) string {
+	mac := hmac.New(sha256.New, blindIndexKey)
+	mac.Write([]byte(strings.ToLower(strings.TrimSpace(email))))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// encryptedSerializer encrypts string and integer fields with AES-GCM. Ciphertext is bound
+// to table and column, so that it can not be copied to another field unnoticed
+type encryptedSerializer struct {
+	encryptor *encryption.Encryption
+}
+
+func fieldAD(field *schema.Field) []byte {
+	return []byte(fmt.Sprintf("%s.%s", field.Schema.Table, field.DBName))
+}
+
+// Scan implements serializer interface
+func (s encryptedSerializer) Scan(ctx context.Context, field *schema.Field, dst reflect.Value, dbValue any) error {
+	var value string
+	switch v := dbValue.(type) {
+	case nil:
+	case []byte:
+		value = string(v)
+	case string:
+		value = v
+	case int64:
+		value = strconv.FormatInt(v, 10)
+	default:
+		return fmt.Errorf("unsupported value of encrypted field %s: %#v", field.Name, dbValue)
+	}
+
+	if strings.HasPrefix(value, encryptedPrefix) {
+		if s.encryptor == nil {
+			return errors.New("field-level encryption is not configured")
+		}
+		plain, err := s.encryptor.DecryptWithAD(value, fieldAD(field))
+		if err != nil {
+			return fmt.Errorf("error decrypting field %s: %w", field.Name, err)
+		}
+		value = plain
+	}
+
+	fieldValue := field.ReflectValueOf(ctx, dst)
+	switch fieldValue.Kind() {
+	case reflect.String:
+		fieldValue.SetString(value)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n := int64(0)
+		if value != "" {
+			var err error
+			if n, err = strconv.ParseInt(value, 10, 64); err != nil {
+				return fmt.Errorf("error parsing encrypted field %s: %w", field.Name, err)
+			}
+		}
+		fieldValue.SetInt(n)
+	default:
+		return fmt.Errorf("unsupported type of encrypted field %s: %s", field.Name, fieldValue.Type())
+	}
+	return nil
+}
+
+// Value implements serializer interface
+func (s encryptedSerializer) Value(ctx context.Context, field *schema.Field, dst reflect.Value, fieldValue any) (any, error) {
+	if s.encryptor == nil {
+		return nil, errors.New("field-level encryption is not configured")
+	}
+	value := fmt.Sprint(fieldValue)
+	if value == "" {
+		return "", nil
+	}
+	encrypted, err := s.encryptor.EncryptWithAD(value, fieldAD(field))
+	if err != nil {
+		return nil, fmt.Errorf("error encrypting field %s: %w", field.Name, err)
+	}
+	return encrypted, nil
+}
+
+// BeforeSave keeps blind index of user's email up to date
+func (u *User) BeforeSave(tx *gorm.DB) error {
+	// user may be used as a model of partial update without email
+	if u.Email != "" {
+		u.EmailIndex = EmailIndex(u.Email)
+	}
+	return nil
+}
+
+// BeforeSave keeps blind index of customer's email up to date
+func (c *Customer) BeforeSave(tx *gorm.DB) error {
+	if c.Email != "" {
+		c.EmailIndex = EmailIndex(c.Email)
+	}
+	return nil
+}
+
+// byEmail scopes query to records with the email. Records saved before field-level encryption
+// have no blind index and are matched by plain text email
+func byEmail(email string) func(tx *gorm.DB) *gorm.DB {
+	return func(tx *gorm.DB) *gorm.DB {
+		conditions := tx.Session(&gorm.Session{NewDB: true}).
+			Where("email_index = ?", EmailIndex(email)).
+			Or("email_index = '' and email = ?", strings.ToLower(strings.TrimSpace(email)))
+		return tx.Where(conditions)
+	}
+}
+
+// EncryptPersonalData re-saves records stored before field-level encryption, so that their
+// personal data gets encrypted and emails get blind indexes, and re-encrypts TOTP secrets
+// stored in legacy format
+func (m *DBModel) EncryptPersonalData(keys *keyring.Keyring) (int, error) {
+	total := 0
+	for _, entity := range []any{&User{}, &Customer{}, &Transaction{}, &Token{}} {
+		n, err := m.encryptTable(entity)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	n, err := m.reencryptTOTPSecrets(keys)
+	return total + n, err
+}
+
+// reencryptTOTPSecrets re-encrypts legacy TOTP secrets, which can be read regardless of
+// whether legacy ciphertexts are allowed, as this is the way to get rid of them
+func (m *DBModel) reencryptTOTPSecrets(keys *keyring.Keyring) (int, error) {
+	var users []User
+	err := m.DB.Select("id", "totp_secret").
+		Where("totp_secret <> '' and totp_secret not like ?", encryptedPrefix+"%").
+		Find(&users).Error
+	if err != nil {
+		return 0, fmt.Errorf("error reading legacy TOTP secrets: %w", err)
+	}
+	encryptor := encryption.Encryption{Keys: keys, AllowLegacy: true}
+	for i, u := range users {
+		secret, err := encryptor.Decrypt(u.TOTPSecret)
+		if err != nil {
+			return i, fmt.Errorf("error decrypting TOTP secret of user %d: %w", u.ID, err)
+		}
+		encrypted, err := encryptor.EncryptWithAD(secret, totpSecretAD(u.ID))
+		if err != nil {
+			return i, err
+		}
+		if err = m.DB.Model(&User{}).Where("id = ?", u.ID).Update("totp_secret", encrypted).Error; err != nil {
+			return i, fmt.Errorf("error saving TOTP secret of user %d: %w", u.ID, err)
+		}
+	}
+	return len(users), nil
+}
+
+func (m *DBModel) encryptTable(model any) (int, error) {
+	typeName := reflect.TypeOf(model).String()
+	records := reflect.New(reflect.SliceOf(reflect.TypeOf(model).Elem())).Interface()
+	// no timeout, as tables may be large
+	if err := m.DB.Find(records).Error; err != nil {
+		return 0, fmt.Errorf("error reading %s for encryption: %w", typeName, err)
+	}
+	slice := reflect.ValueOf(records).Elem()
+	for i := 0; i < slice.Len(); i++ {
+		if err := m.DB.Save(slice.Index(i).Addr().Interface()).Error; err != nil {
+			return i, fmt.Errorf("error encrypting %s: %w", typeName, err)
+		}
+	}
+	return slice.Len(), nil
+}
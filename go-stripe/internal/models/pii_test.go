@@ -0,0 +1,65 @@
+package models
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/encryption"
+	"github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/keyring"
+	"gorm.io/gorm/schema"
+)
+
+func Test_EncryptedSerializer(t *testing.T) {
+	ctx := context.Background()
+	s := encryptedSerializer{encryptor: &encryption.Encryption{
+		Keys: keyring.Single([]byte("abcdefghijklmnopqrstuvwxyz012345")),
+	}}
+	txnSchema, err := schema.Parse(&Transaction{}, &sync.Map{}, schema.NamingStrategy{})
+	if err != nil {
+		t.Fatalf("error parsing schema: %s", err)
+	}
+
+	for name, value := range map[string]any{"LastFour": "4242", "ExpiryYear": 2030} {
+		field := txnSchema.LookUpField(name)
+		var txn Transaction
+		dbValue, err := s.Value(ctx, field, reflect.ValueOf(&txn).Elem(), value)
+		if err != nil {
+			t.Fatalf("error encrypting %s: %s", name, err)
+		}
+		if !strings.HasPrefix(dbValue.(string), encryptedPrefix) {
+			t.Errorf("expected %s to be encrypted but got %q", name, dbValue)
+		}
+		if err = s.Scan(ctx, field, reflect.ValueOf(&txn).Elem(), []byte(dbValue.(string))); err != nil {
+			t.Fatalf("error decrypting %s: %s", name, err)
+		}
+		if got := field.ReflectValueOf(ctx, reflect.ValueOf(&txn).Elem()).Interface(); got != value {
+			t.Errorf("expected %s to be %v but got %v", name, value, got)
+		}
+
+		// ciphertext is bound to the column
+		other := txnSchema.LookUpField("ExpiryMonth")
+		if name != other.Name {
+			if err = s.Scan(ctx, other, reflect.ValueOf(&txn).Elem(), dbValue); err == nil {
+				t.Errorf("expected error reading %s ciphertext as %s", name, other.Name)
+			}
+		}
+	}
+
+	// data stored before encryption is read as is
+	var txn Transaction
+	if err = s.Scan(ctx, txnSchema.LookUpField("ExpiryMonth"), reflect.ValueOf(&txn).Elem(), int64(12)); err != nil || txn.ExpiryMonth != 12 {
+		t.Errorf("error reading legacy value: %d, %v", txn.ExpiryMonth, err)
+	}
+}
+
+func Test_EmailIndex(t *testing.T) {
+	if EmailIndex("John@Dow.com ") != EmailIndex("john@dow.com") {
+		t.Error("expected email index to be case insensitive")
+	}
+	if EmailIndex("john@dow.com") == EmailIndex("jane@dow.com") {
+		t.Error("expected different emails to have different indexes")
+	}
+}
@@ -0,0 +1,108 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// renewalTolerance is how much period reported by Stripe may differ from the one recorded locally;
+// renewal starting earlier than that before the end of paid period has been recorded already
+const renewalTolerance = time.Hour
+
+// ErrRenewalRecorded is returned when renewal of the period has been recorded already
+var ErrRenewalRecorded = errors.New("renewal has already been recorded")
+
+// GetOrderBySubscription fetches order of the subscription by its Stripe id, which is kept as
+// payment intent of order's first transaction
+func (m *DBModel) GetOrderBySubscription(subscriptionID string) (Order, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	tx := m.DB.WithContext(ctx)
+
+	var order Order
+	err := tx.Joins("Transaction").Where("Transaction.payment_intent = ?", subscriptionID).First(&order).Error
+	if err != nil {
+		return order, fmt.Errorf("error getting order of subscription %q: %w", subscriptionID, err)
+	}
+	return m.GetOrder(order.ID)
+}
+
+// GetDueSubscriptions fetches ids of active subscriptions whose paid period has ended by the time
+func (m *DBModel) GetDueSubscriptions(by time.Time) ([]int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	tx := m.DB.WithContext(ctx)
+
+	var ids []int
+	err := tx.Model(&Order{}).
+		InnerJoins("Widget", tx.Where(&Widget{IsRecurring: true}, "is_recurring")).
+		Where("orders.status_id = ? and orders.current_period_end <= ?", 1, by).
+		Order("orders.current_period_end").
+		Pluck("orders.id", &ids).Error
+	if err != nil {
+		return nil, fmt.Errorf("error getting subscriptions due for renewal: %w", err)
+	}
+	return ids, nil
+}
+
+// InsertRenewal records charge renewing subscription of the order for the transaction's period,
+// extends paid period of the order and inserts a message on the topic in one transaction.
+// Payload of the message is made by the function, as it needs id of the transaction.
+// Returns ErrRenewalRecorded if the period or Stripe invoice has been recorded already
+func (m *DBModel) InsertRenewal(orderID int, txn Transaction, topic string, payload func(txnID int) any) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	if txn.PeriodStart == nil || txn.PeriodEnd == nil {
+		return 0, errors.New("error recording renewal: period is required")
+	}
+	txn.OrderID = &orderID
+	txn.SetCreated()
+	err := m.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// order is locked, so that Stripe events and scheduler do not record the same period twice
+		var order Order
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&order, orderID).Error; err != nil {
+			return err
+		}
+		if order.CurrentPeriodEnd != nil && txn.PeriodStart.Before(order.CurrentPeriodEnd.Add(-renewalTolerance)) {
+			return ErrRenewalRecorded
+		}
+		if txn.StripeInvoiceID != nil {
+			var count int64
+			if err := tx.Model(&Transaction{}).Where("stripe_invoice_id = ?", *txn.StripeInvoiceID).Count(&count).Error; err != nil {
+				return err
+			}
+			if count > 0 {
+				return ErrRenewalRecorded
+			}
+		}
+
+		if err := tx.Create(&txn).Error; err != nil {
+			return err
+		}
+		err := tx.Model(&Order{}).Where("id = ?", orderID).Updates(map[string]any{
+			"current_period_end": *txn.PeriodEnd,
+			"updated_at":         time.Now(),
+		}).Error
+		if err != nil {
+			return err
+		}
+		msg, err := newOutboxMessage(topic, fmt.Sprintf("%s:%d", AuditEntityOrder, orderID), payload(txn.ID))
+		if err != nil {
+			return err
+		}
+		return tx.Create(&msg).Error
+	})
+	if errors.Is(err, ErrRenewalRecorded) {
+		return 0, err
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error recording renewal of order %d: %w", orderID, err)
+	}
+	return txn.ID, nil
+}
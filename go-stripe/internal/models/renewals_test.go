@@ -0,0 +1,61 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func Test_InsertRenewal(t *testing.T) {
+	m := testDB(t)
+	periodEnd := time.Date(2023, 5, 1, 0, 0, 0, 0, time.UTC)
+	orderID, _ := testOrder(t, m, 1)
+	if err := m.DB.Model(&Order{}).Where("id = ?", orderID).Update("current_period_end", periodEnd).Error; err != nil {
+		t.Fatal(err)
+	}
+	// Stripe invoice ids are made unique to the order, as scratch DB keeps renewals of earlier runs
+	renewal := func(stripeInvoiceID string, start time.Time) Transaction {
+		stripeInvoiceID = fmt.Sprintf("%s_%d", stripeInvoiceID, orderID)
+		end := start.AddDate(0, 1, 0)
+		return Transaction{Amount: 1200, Currency: "usd", TransactionStatusID: 2, StripeInvoiceID: &stripeInvoiceID,
+			PeriodStart: &start, PeriodEnd: &end}
+	}
+	payload := func(txnID int) any { return map[string]int{"transaction_id": txnID} }
+
+	txnID, err := m.InsertRenewal(orderID, renewal("in_2", periodEnd), OutboxTopicInvoice, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	order, err := m.GetOrder(orderID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if order.CurrentPeriodEnd == nil || !order.CurrentPeriodEnd.Equal(periodEnd.AddDate(0, 1, 0)) {
+		t.Errorf("expected paid period to end %v but got %v", periodEnd.AddDate(0, 1, 0), order.CurrentPeriodEnd)
+	}
+	var txn Transaction
+	if err := m.DB.First(&txn, txnID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if txn.OrderID == nil || *txn.OrderID != orderID || txn.Amount != 1200 {
+		t.Errorf("unexpected renewal %+v", txn)
+	}
+
+	// webhook and scheduler may both report the renewal, in any order and more than once
+	tests := []struct {
+		name string
+		txn  Transaction
+	}{
+		{"same Stripe invoice", renewal("in_2", periodEnd.AddDate(0, 1, 0))},
+		{"recorded period", renewal("in_3", periodEnd)},
+		{"earlier period", renewal("in_1", periodEnd.AddDate(0, -1, 0))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := m.InsertRenewal(orderID, tt.txn, OutboxTopicInvoice, payload); !errors.Is(err, ErrRenewalRecorded) {
+				t.Errorf("expected ErrRenewalRecorded but got %v", err)
+			}
+		})
+	}
+}
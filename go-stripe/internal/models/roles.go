@@ -0,0 +1,86 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm/clause"
+)
+
+// Permissions checked by both the API and the web front-end
+const (
+	PermViewSales          = "view-sales"
+	PermRefund             = "refund"
+	PermCancelSubscription = "cancel-subscription"
+	PermVirtualTerminal    = "virtual-terminal"
+	PermViewUsers          = "view-users"
+	PermManageUsers        = "manage-users"
+	PermViewAuditLog       = "view-audit-log"
+	PermManageAPIKeys      = "manage-api-keys"
+	PermManageSessions     = "manage-sessions"
+	PermManageOutbox       = "manage-outbox"
+)
+
+// Role is a type for named sets of permissions assigned to users
+type Role struct {
+	DBEntity
+	Name        string        `json:"name"`
+	Permissions []*Permission `json:"permissions" gorm:"many2many:role_permissions"`
+}
+
+// Permission is a type for actions that may be granted to roles
+type Permission struct {
+	DBEntity
+	Name string `json:"name"`
+}
+
+// GetAllRoles fetches all roles with their permissions from DB
+func (m *DBModel) GetAllRoles() ([]*Role, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	tx := m.DB.WithContext(ctx)
+
+	var roles []*Role
+	err := tx.Preload("Permissions").
+		Clauses(clause.OrderBy{Columns: []clause.OrderByColumn{
+			{Column: clause.Column{Table: "roles", Name: "id"}},
+		}}).
+		Find(&roles).Error
+	if err != nil {
+		return nil, fmt.Errorf("error fetching roles: %w", err)
+	}
+	return roles, nil
+}
+
+// GetPermissionsForUser fetches names of all permissions granted to the user by the user's role
+func (m *DBModel) GetPermissionsForUser(userID int) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	tx := m.DB.WithContext(ctx)
+
+	var names []string
+	err := tx.Model(&Permission{}).
+		Joins("join role_permissions rp on rp.permission_id = permissions.id").
+		Joins("join users u on u.role_id = rp.role_id").
+		Where("u.id = ?", userID).
+		Pluck("permissions.name", &names).Error
+	if err != nil {
+		return nil, fmt.Errorf("error fetching permissions for user: %w", err)
+	}
+	return names, nil
+}
+
+// HasPermission checks if the user's role grants the permission
+func (m *DBModel) HasPermission(userID int, permission string) (bool, error) {
+	perms, err := m.GetPermissionsForUser(userID)
+	if err != nil {
+		return false, err
+	}
+	for _, p := range perms {
+		if p == permission {
+			return true, nil
+		}
+	}
+	return false, nil
+}
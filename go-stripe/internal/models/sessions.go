@@ -0,0 +1,167 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// UserSession is a type for web sessions of logged in users. Session data itself is kept
+// by session manager in sessions table; this one indexes sessions by user and links them
+// to API tokens issued on login, so that both are revoked together
+//
+// It does not embed DBEntity because administrators are shown when sessions were started,
+// while DBEntity hides its timestamps from JSON
+type UserSession struct {
+	ID           int        `json:"id" gorm:"primaryKey"`
+	UserID       int        `json:"user_id"`
+	SessionToken string     `json:"-"`
+	TokenID      *int       `json:"-"`
+	IPAddress    string     `json:"ip_address"`
+	UserAgent    string     `json:"user_agent"`
+	LastSeenAt   *time.Time `json:"last_seen_at"`
+	CreatedAt    time.Time  `json:"created_at"`
+	UpdatedAt    time.Time  `json:"-"`
+	User         User       `json:"user"`
+}
+
+// StartUserSession registers session of the user logged in to the web front-end and issues
+// API token for it that lasts for ttl. Deleting the token (i.e. logging out via API) ends the session
+func (m *DBModel) StartUserSession(u User, sessionToken, ip, userAgent string, ttl time.Duration) (*SToken, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	if len(userAgent) > 255 {
+		userAgent = userAgent[:255]
+	}
+	t, err := GenerateToken(u.ID, ttl, ScopeAuthentication)
+	if err != nil {
+		return nil, err
+	}
+	err = m.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		token := newToken(t, u, userAgent)
+		if err := tx.Create(&token).Error; err != nil {
+			return err
+		}
+		now := time.Now()
+		s := UserSession{
+			UserID:       u.ID,
+			SessionToken: sessionToken,
+			TokenID:      &token.ID,
+			IPAddress:    ip,
+			UserAgent:    userAgent,
+			LastSeenAt:   &now,
+		}
+		return tx.Create(&s).Error
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error starting user session: %w", err)
+	}
+	return t, nil
+}
+
+// TouchUserSession reports if the session has not been revoked and updates last time
+// it was seen; it writes to DB at most once a minute
+func (m *DBModel) TouchUserSession(token string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	tx := m.DB.WithContext(ctx)
+
+	var s UserSession
+	err := tx.Where("session_token = ?", token).First(&s).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("error fetching user session: %w", err)
+	}
+	now := time.Now()
+	if s.LastSeenAt != nil && s.LastSeenAt.After(now.Add(-time.Minute)) {
+		return true, nil
+	}
+	if err = tx.Model(&s).Update("last_seen_at", now).Error; err != nil {
+		return true, fmt.Errorf("error updating session's last seen time: %w", err)
+	}
+	return true, nil
+}
+
+// GetActiveUserSessions fetches sessions that have not expired yet with users they belong to
+func (m *DBModel) GetActiveUserSessions() ([]*UserSession, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	tx := m.DB.WithContext(ctx)
+
+	var sessions []*UserSession
+	err := tx.Joins("User").
+		// session manager stores expiry in UTC
+		Joins("join sessions on sessions.token = user_sessions.session_token and sessions.expiry > utc_timestamp(6)").
+		Order("user_sessions.last_seen_at desc").
+		Find(&sessions).Error
+	if err != nil {
+		return nil, fmt.Errorf("error fetching user sessions: %w", err)
+	}
+	for _, s := range sessions {
+		s.User.Password = ""
+	}
+	return sessions, nil
+}
+
+// GetUserSession fetches session by id
+func (m *DBModel) GetUserSession(id int) (UserSession, error) {
+	var s UserSession
+	err := getEntityById(id, m, &s)
+	return s, err
+}
+
+// EndUserSession removes session by its token along with API token issued for it, i.e. on logout
+func (m *DBModel) EndUserSession(token string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Exec("delete from tokens where id in (select token_id from user_sessions where session_token = ?)", token).Error
+		if err != nil {
+			return err
+		}
+		return tx.Where("session_token = ?", token).Delete(&UserSession{}).Error
+	})
+	if err != nil {
+		return fmt.Errorf("error deleting user session: %w", err)
+	}
+	return nil
+}
+
+// RevokeUserSession destroys session by id along with API token issued for it,
+// so that its user gets logged out of the web front-end
+func (m *DBModel) RevokeUserSession(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Exec("delete from sessions where token in (select session_token from user_sessions where id = ?)", id).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Exec("delete from tokens where id in (select token_id from user_sessions where id = ?)", id).Error
+		if err != nil {
+			return err
+		}
+		return tx.Delete(&UserSession{}, id).Error
+	})
+	if err != nil {
+		return fmt.Errorf("error revoking user session: %w", err)
+	}
+	return nil
+}
+
+// destroyUserSessions destroys all web sessions of the user
+func destroyUserSessions(tx *gorm.DB, userID int) error {
+	err := tx.Exec("delete from sessions where token in (select session_token from user_sessions where user_id = ?)", userID).Error
+	if err != nil {
+		return err
+	}
+	return tx.Where("user_id = ?", userID).Delete(&UserSession{}).Error
+}
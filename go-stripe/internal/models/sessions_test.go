@@ -0,0 +1,29 @@
+package models
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_UserSessionJSON(t *testing.T) {
+	started := time.Date(2023, 5, 11, 12, 0, 0, 0, time.UTC)
+	s := UserSession{ID: 7, UserID: 1, SessionToken: "secret", CreatedAt: started, UpdatedAt: started.Add(time.Hour)}
+	out, err := json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]any
+	if err = json.Unmarshal(out, &fields); err != nil {
+		t.Fatal(err)
+	}
+	if fields["id"] != float64(7) || fields["created_at"] != "2023-05-11T12:00:00Z" {
+		t.Errorf("expected id and start of the session in %s", out)
+	}
+	for _, hidden := range []string{"session_token", "SessionToken", "UpdatedAt", "updated_at", "secret"} {
+		if strings.Contains(string(out), hidden) {
+			t.Errorf("%s must not be in %s", hidden, out)
+		}
+	}
+}
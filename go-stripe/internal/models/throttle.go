@@ -0,0 +1,139 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Actions failures are counted for separately
+const (
+	ThrottleLogin         = "login"
+	ThrottlePasswordReset = "password-reset"
+)
+
+// ThrottleKey builds key of failure counter for the action by kind of subject
+// (i.e. account or IP address) and its value
+func ThrottleKey(action, kind, value string) string {
+	return fmt.Sprintf("%s:%s:%s", action, kind, strings.ToLower(strings.TrimSpace(value)))
+}
+
+// ThrottlePolicy defines how fast delay between attempts grows with the number of failures
+// and when the subject gets locked out
+type ThrottlePolicy struct {
+	FreeAttempts int           // failures allowed without any delay
+	BaseDelay    time.Duration // delay after the first failure beyond free ones; doubled by each next one
+	MaxDelay     time.Duration
+	LockAfter    int // number of failures that locks the subject out; zero to never lock
+	LockDuration time.Duration
+	Window       time.Duration // failures are forgotten after this time without new ones
+}
+
+// AuthThrottle is a type for failure counters of authentication attempts
+type AuthThrottle struct {
+	DBEntity
+	ThrottleKey   string     `json:"-"`
+	Failures      int        `json:"failures"`
+	LastFailureAt *time.Time `json:"last_failure_at"`
+	BlockedUntil  *time.Time `json:"blocked_until"`
+	Locked        bool       `json:"locked"`
+}
+
+// RetryAfter returns time left until next attempt is allowed or zero if it is allowed now
+func (t *AuthThrottle) RetryAfter(now time.Time) time.Duration {
+	if t.BlockedUntil == nil || !t.BlockedUntil.After(now) {
+		return 0
+	}
+	return t.BlockedUntil.Sub(now)
+}
+
+// fail counts one more failure according to the policy. It returns true if the subject
+// has been locked out by this failure
+func (p ThrottlePolicy) fail(t *AuthThrottle, now time.Time) bool {
+	blocked := t.RetryAfter(now) > 0
+	if !blocked && (t.Locked || (t.LastFailureAt != nil && now.Sub(*t.LastFailureAt) > p.Window)) {
+		// lockout is over or failures are too old to be taken into account
+		t.Failures = 0
+		t.Locked = false
+	}
+	wasLocked := t.Locked
+	t.Failures++
+	t.LastFailureAt = &now
+
+	if p.LockAfter > 0 && t.Failures >= p.LockAfter {
+		until := now.Add(p.LockDuration)
+		t.Locked = true
+		t.BlockedUntil = &until
+		return !wasLocked
+	}
+	if t.Failures > p.FreeAttempts {
+		delay := p.MaxDelay
+		if shift := t.Failures - p.FreeAttempts - 1; shift < 32 && p.BaseDelay<<shift < p.MaxDelay {
+			delay = p.BaseDelay << shift
+		}
+		until := now.Add(delay)
+		if t.BlockedUntil == nil || until.After(*t.BlockedUntil) {
+			t.BlockedUntil = &until
+		}
+	}
+	return false
+}
+
+// GetAuthThrottles fetches existing failure counters by their keys
+func (m *DBModel) GetAuthThrottles(keys ...string) ([]AuthThrottle, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	tx := m.DB.WithContext(ctx)
+
+	var throttles []AuthThrottle
+	if err := tx.Where("throttle_key in ?", keys).Find(&throttles).Error; err != nil {
+		return nil, fmt.Errorf("error fetching authentication throttles: %w", err)
+	}
+	return throttles, nil
+}
+
+// RecordAuthFailure counts authentication failure for the key according to the policy.
+// It returns updated counter and true if the subject has been locked out by this failure
+func (m *DBModel) RecordAuthFailure(key string, policy ThrottlePolicy) (AuthThrottle, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var throttle AuthThrottle
+	var lockedNow bool
+	err := m.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// make sure the counter exists and lock it, so that concurrent failures are all counted
+		newThrottle := AuthThrottle{ThrottleKey: key}
+		newThrottle.SetCreated()
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&newThrottle).Error; err != nil {
+			return err
+		}
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("throttle_key = ?", key).First(&throttle).Error
+		if err != nil {
+			return err
+		}
+		lockedNow = policy.fail(&throttle, time.Now())
+		throttle.SetUpdated()
+		return tx.Save(&throttle).Error
+	})
+	if err != nil {
+		return throttle, false, fmt.Errorf("error recording authentication failure: %w", err)
+	}
+	return throttle, lockedNow, nil
+}
+
+// ClearAuthThrottles forgets failures counted for the keys
+func (m *DBModel) ClearAuthThrottles(keys ...string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	tx := m.DB.WithContext(ctx)
+
+	if err := tx.Where("throttle_key in ?", keys).Delete(&AuthThrottle{}).Error; err != nil {
+		return fmt.Errorf("error clearing authentication throttles: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_ThrottlePolicyFail(t *testing.T) {
+	policy := ThrottlePolicy{
+		FreeAttempts: 2,
+		BaseDelay:    time.Second,
+		MaxDelay:     5 * time.Second,
+		LockAfter:    7,
+		LockDuration: time.Hour,
+		Window:       24 * time.Hour,
+	}
+	now := time.Now()
+	var throttle AuthThrottle
+
+	// delays after each failure: none for free attempts, then doubled up to max
+	delays := []time.Duration{0, 0, time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second}
+	for i, expected := range delays {
+		if locked := policy.fail(&throttle, now); locked {
+			t.Fatalf("failure %d must not lock the account", i+1)
+		}
+		if retryAfter := throttle.RetryAfter(now); retryAfter != expected {
+			t.Errorf("failure %d: expected delay %s but got %s", i+1, expected, retryAfter)
+		}
+	}
+
+	if locked := policy.fail(&throttle, now); !locked {
+		t.Fatal("expected account to be locked")
+	}
+	if retryAfter := throttle.RetryAfter(now); retryAfter != time.Hour {
+		t.Errorf("expected lock for an hour but got %s", retryAfter)
+	}
+	if locked := policy.fail(&throttle, now); locked {
+		t.Error("locked account must not be reported as locked again")
+	}
+
+	// after the lockout counting starts from scratch
+	later := now.Add(2 * time.Hour)
+	policy.fail(&throttle, later)
+	if throttle.Locked || throttle.Failures != 1 || throttle.RetryAfter(later) != 0 {
+		t.Errorf("expected fresh counter after lockout but got %+v", throttle)
+	}
+}
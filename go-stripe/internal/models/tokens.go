@@ -5,24 +5,32 @@ import (
 	"crypto/sha256"
 	"encoding/base32"
 	"fmt"
+	"strings"
 	"time"
 )
 
+// Token scopes. Tokens obtained by logging in have authentication scope that grants access
+// to everything user's role permits; other scopes are for tokens issued to integrations
 const (
 	ScopeAuthentication = "authentication"
+	ScopeReporting      = "reporting"
+	ScopeRefunds        = "refunds"
 )
 
+// IssuableScopes lists scopes that users may request for tokens they issue
+var IssuableScopes = []string{ScopeReporting, ScopeRefunds}
+
 // SToken is a type for authentication tokens
 type SToken struct {
 	PlainText string    `json:"token"`
 	UserID    int64     `json:"-"`
 	Hash      []byte    `json:"-"`
 	Expiry    time.Time `json:"expiry"`
-	Scope     string    `json:"-"`
+	Scope     string    `json:"scope"`
 }
 
 // GenerateToken generates token for user identified by userID that lasts for ttl
-// and returns it or possibly an error
+// and returns it or possibly an error. Scope may hold several space separated scopes
 func GenerateToken(userID int, ttl time.Duration, scope string) (*SToken, error) {
 	token := &SToken{
 		UserID: int64(userID),
@@ -40,3 +48,23 @@ func GenerateToken(userID int, ttl time.Duration, scope string) (*SToken, error)
 	token.Hash = hash[:]
 	return token, nil
 }
+
+// IsIssuableScope checks if users may request tokens with the scope
+func IsIssuableScope(scope string) bool {
+	for _, s := range IssuableScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// HasScope checks if token grants the scope; authentication scope grants them all
+func (t *Token) HasScope(scope string) bool {
+	for _, s := range strings.Fields(t.Scope) {
+		if s == scope || s == ScopeAuthentication {
+			return true
+		}
+	}
+	return false
+}
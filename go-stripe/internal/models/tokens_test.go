@@ -0,0 +1,27 @@
+package models
+
+import "testing"
+
+func Test_TokenHasScope(t *testing.T) {
+	var theTests = []struct {
+		tokenScope string
+		scope      string
+		has        bool
+	}{
+		{"authentication", ScopeAuthentication, true},
+		{"authentication", ScopeReporting, true},
+		{"authentication", ScopeRefunds, true},
+		{"reporting", ScopeReporting, true},
+		{"reporting", ScopeRefunds, false},
+		{"reporting", ScopeAuthentication, false},
+		{"reporting refunds", ScopeRefunds, true},
+		{"", ScopeReporting, false},
+	}
+
+	for _, e := range theTests {
+		token := Token{Scope: e.tokenScope}
+		if has := token.HasScope(e.scope); has != e.has {
+			t.Errorf("%q having %q: expected %v but got %v", e.tokenScope, e.scope, e.has, has)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/encryption"
+	"github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/keyring"
+	"github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/totp"
+	"gorm.io/gorm"
+)
+
+const recoveryCodesCount = 10
+
+var ErrTwoFactorEnabled = errors.New("two-factor authentication is already enabled")
+var ErrTwoFactorNotStarted = errors.New("two-factor authentication enrollment has not been started")
+
+// RecoveryCode is a type for single-use codes replacing TOTP code when authenticator app is lost
+type RecoveryCode struct {
+	DBEntity
+	UserID   int
+	CodeHash []byte
+	UsedAt   *time.Time
+}
+
+// StartTwoFactorEnrollment generates new TOTP secret for the user and saves it encrypted with active key.
+// Two-factor authentication is not enabled until user confirms it with a valid code
+func (m *DBModel) StartTwoFactorEnrollment(u User, keys *keyring.Keyring) (string, error) {
+	if u.TOTPEnabled {
+		return "", ErrTwoFactorEnabled
+	}
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return "", err
+	}
+	encryptor := encryption.Encryption{Keys: keys, AllowLegacy: allowLegacyCiphertext}
+	encrypted, err := encryptor.EncryptWithAD(secret, totpSecretAD(u.ID))
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	tx := m.DB.WithContext(ctx)
+	err = tx.Model(&User{}).Where("id = ?", u.ID).
+		Updates(map[string]any{"totp_secret": encrypted, "totp_enabled": false, "totp_last_step": 0, "updated_at": time.Now()}).Error
+	if err != nil {
+		return "", fmt.Errorf("error saving TOTP secret: %w", err)
+	}
+	return secret, nil
+}
+
+// EnableTwoFactor enables two-factor authentication if code matches the secret saved on enrollment
+// and returns new recovery codes in plain text. Ok is false when the code does not match
+func (m *DBModel) EnableTwoFactor(u User, code string, keys *keyring.Keyring) (codes []string, ok bool, err error) {
+	if u.TOTPEnabled {
+		return nil, false, ErrTwoFactorEnabled
+	}
+	if u.TOTPSecret == "" {
+		return nil, false, ErrTwoFactorNotStarted
+	}
+	ok, err = m.acceptTOTP(u, code, keys)
+	if err != nil || !ok {
+		return nil, ok, err
+	}
+
+	codes = make([]string, recoveryCodesCount)
+	entities := make([]RecoveryCode, recoveryCodesCount)
+	for i := range codes {
+		rndBytes := make([]byte, 5)
+		if _, err = rand.Read(rndBytes); err != nil {
+			return nil, false, fmt.Errorf("error generating recovery code: %w", err)
+		}
+		plain := strings.ToLower(base32.StdEncoding.EncodeToString(rndBytes))
+		codes[i] = fmt.Sprintf("%s-%s", plain[:4], plain[4:])
+		entities[i] = RecoveryCode{UserID: u.ID, CodeHash: recoveryCodeHash(codes[i])}
+		entities[i].SetCreated()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err = m.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", u.ID).Delete(&RecoveryCode{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Create(&entities).Error; err != nil {
+			return err
+		}
+		return tx.Model(&User{}).Where("id = ?", u.ID).
+			Updates(map[string]any{"totp_enabled": true, "updated_at": time.Now()}).Error
+	})
+	if err != nil {
+		return nil, false, fmt.Errorf("error enabling two-factor authentication: %w", err)
+	}
+	return codes, true, nil
+}
+
+// VerifySecondFactor checks TOTP code or, failing that, unused recovery code of the user.
+// Matching recovery code is used up
+func (m *DBModel) VerifySecondFactor(u User, code string, keys *keyring.Keyring) (bool, error) {
+	if !u.TOTPEnabled {
+		return true, nil
+	}
+	ok, err := m.acceptTOTP(u, code, keys)
+	if err != nil || ok {
+		return ok, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result := m.DB.WithContext(ctx).Model(&RecoveryCode{}).
+		Where("user_id = ? and code_hash = ? and used_at is null", u.ID, recoveryCodeHash(code)).
+		Updates(map[string]any{"used_at": time.Now(), "updated_at": time.Now()})
+	if result.Error != nil {
+		return false, fmt.Errorf("error checking recovery code: %w", result.Error)
+	}
+	return result.RowsAffected > 0, nil
+}
+
+// ResetTwoFactor disables two-factor authentication of the user and removes the recovery codes
+func (m *DBModel) ResetTwoFactor(userID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", userID).Delete(&RecoveryCode{}).Error; err != nil {
+			return err
+		}
+		return tx.Model(&User{}).Where("id = ?", userID).
+			Updates(map[string]any{"totp_secret": "", "totp_enabled": false, "totp_last_step": 0, "updated_at": time.Now()}).Error
+	})
+	if err != nil {
+		return fmt.Errorf("error resetting two-factor authentication: %w", err)
+	}
+	return nil
+}
+
+// acceptTOTP checks TOTP code of the user and records its time step, so that neither the code
+// nor an earlier one can be used again, i.e. by someone who has seen it typed
+func (m *DBModel) acceptTOTP(u User, code string, keys *keyring.Keyring) (bool, error) {
+	step, ok, err := checkTOTP(u, code, keys, time.Now())
+	if err != nil || !ok {
+		return false, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	// the condition lets only one of concurrent requests with the same code through
+	result := m.DB.WithContext(ctx).Model(&User{}).
+		Where("id = ? and totp_last_step < ?", u.ID, step).
+		Updates(map[string]any{"totp_last_step": step, "updated_at": time.Now()})
+	if result.Error != nil {
+		return false, fmt.Errorf("error saving TOTP time step: %w", result.Error)
+	}
+	return result.RowsAffected > 0, nil
+}
+
+// checkTOTP validates the code against the secret of the user and returns its time step.
+// Codes of steps up to the last accepted one are rejected as replays
+func checkTOTP(u User, code string, keys *keyring.Keyring, now time.Time) (int64, bool, error) {
+	encryptor := encryption.Encryption{Keys: keys, AllowLegacy: allowLegacyCiphertext}
+	secret, err := encryptor.DecryptWithAD(u.TOTPSecret, totpSecretAD(u.ID))
+	if err != nil {
+		return 0, false, err
+	}
+	step, ok, err := totp.Verify(code, secret, now)
+	if err != nil || !ok || step <= u.TOTPLastStep {
+		return 0, false, err
+	}
+	return step, true, nil
+}
+
+// totpSecretAD binds encrypted secret to the user, so that it can not be copied to another one
+func totpSecretAD(userID int) []byte {
+	return []byte(fmt.Sprintf("totp-secret:%d", userID))
+}
+
+func recoveryCodeHash(code string) []byte {
+	normalized := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	hash := sha256.Sum256([]byte(normalized))
+	return hash[:]
+}
@@ -0,0 +1,44 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/encryption"
+	"github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/keyring"
+	"github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/totp"
+)
+
+func Test_CheckTOTPRejectsReplay(t *testing.T) {
+	keys := keyring.Single([]byte("abcdefghijklmnopqrstuvwxyz012345"))
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := User{DBEntity: DBEntity{ID: 1}, TOTPEnabled: true}
+	u.TOTPSecret, err = (&encryption.Encryption{Keys: keys}).EncryptWithAD(secret, totpSecretAD(u.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	code, _ := totp.GenerateCode(secret, now)
+
+	step, ok, err := checkTOTP(u, code, keys, now)
+	if err != nil || !ok {
+		t.Fatalf("expected fresh code to be accepted but got %v, %v", ok, err)
+	}
+
+	// accepting the code records its step
+	u.TOTPLastStep = step
+	if _, ok, _ = checkTOTP(u, code, keys, now); ok {
+		t.Error("code must not be accepted twice")
+	}
+	previous, _ := totp.GenerateCode(secret, now.Add(-30*time.Second))
+	if _, ok, _ = checkTOTP(u, previous, keys, now); ok {
+		t.Error("code older than the accepted one must be rejected")
+	}
+	next, _ := totp.GenerateCode(secret, now.Add(30*time.Second))
+	if nextStep, ok, _ := checkTOTP(u, next, keys, now.Add(30*time.Second)); !ok || nextStep != step+1 {
+		t.Errorf("expected code of the next step to be accepted but got %v for step %d", ok, nextStep)
+	}
+}
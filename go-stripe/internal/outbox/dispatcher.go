@@ -0,0 +1,147 @@
+// Package outbox delivers messages written to the outbox table to other services.
+// Messages are delivered at least once: failed deliveries are retried with exponential
+// backoff until they succeed or an administrator fixes the cause and retries them
+package outbox
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/models"
+)
+
+// Handler delivers payload of a message
+type Handler func(ctx context.Context, payload []byte) error
+
+// Dispatcher polls the outbox and delivers due messages with handlers of their topics.
+// Several dispatchers may share the outbox, as messages are locked while being delivered
+type Dispatcher struct {
+	DB       *models.DBModel
+	Handlers map[string]Handler
+	// Interval between polls of the outbox
+	Interval time.Duration
+	// BatchSize is the number of messages delivered per poll
+	BatchSize int
+	// BaseDelay is the delay before the first retry; it doubles with every failure up to MaxDelay
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// Timeout of single delivery; messages stay locked for twice as long
+	Timeout  time.Duration
+	InfoLog  *log.Logger
+	ErrorLog *log.Logger
+}
+
+// New returns dispatcher with default settings
+func New(db *models.DBModel, handlers map[string]Handler, infoLog, errorLog *log.Logger) *Dispatcher {
+	return &Dispatcher{
+		DB:        db,
+		Handlers:  handlers,
+		Interval:  5 * time.Second,
+		BatchSize: 10,
+		BaseDelay: 30 * time.Second,
+		MaxDelay:  time.Hour,
+		Timeout:   30 * time.Second,
+		InfoLog:   infoLog,
+		ErrorLog:  errorLog,
+	}
+}
+
+// Run polls the outbox until the context is done
+func (d *Dispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(d.Interval)
+	defer ticker.Stop()
+	for {
+		d.dispatch(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// dispatch delivers up to a batch of due messages. They are claimed one at a time, so that
+// lease of each one covers its own delivery only and other dispatchers take over the rest
+func (d *Dispatcher) dispatch(ctx context.Context) {
+	for i := 0; i < d.BatchSize && ctx.Err() == nil; i++ {
+		msgs, err := d.DB.ClaimOutboxMessages(1, 2*d.Timeout)
+		if err != nil {
+			d.ErrorLog.Println(err)
+			return
+		}
+		if len(msgs) == 0 {
+			return
+		}
+		d.dispatchMessage(ctx, msgs[0])
+	}
+}
+
+// dispatchMessage delivers claimed message and records the outcome
+func (d *Dispatcher) dispatchMessage(ctx context.Context, msg *models.OutboxMessage) {
+	err := d.deliver(ctx, msg)
+	if err != nil {
+		next := time.Now().Add(Backoff(msg.Attempts+1, d.BaseDelay, d.MaxDelay))
+		d.ErrorLog.Printf("error delivering %s message %d (attempt %d), next attempt at %s: %s\n",
+			msg.Topic, msg.ID, msg.Attempts+1, next.Format(time.RFC3339), err)
+		if err = d.DB.MarkOutboxMessageFailed(msg.ID, err, next); err != nil {
+			d.ErrorLog.Println(err)
+		}
+		return
+	}
+	d.InfoLog.Printf("Delivered %s message %d (%s)\n", msg.Topic, msg.ID, msg.Reference)
+	if err = d.DB.MarkOutboxMessageDelivered(msg.ID); err != nil {
+		d.ErrorLog.Println(err)
+	}
+}
+
+func (d *Dispatcher) deliver(ctx context.Context, msg *models.OutboxMessage) error {
+	handler, ok := d.Handlers[msg.Topic]
+	if !ok {
+		return fmt.Errorf("no handler for topic %q", msg.Topic)
+	}
+	ctx, cancel := context.WithTimeout(ctx, d.Timeout)
+	defer cancel()
+	return handler(ctx, []byte(msg.Payload))
+}
+
+// Backoff returns delay before the next attempt after the given number of failed ones
+func Backoff(attempts int, base, max time.Duration) time.Duration {
+	delay := base
+	for i := 1; i < attempts; i++ {
+		delay *= 2
+		if delay >= max {
+			return max
+		}
+	}
+	if delay > max {
+		return max
+	}
+	return delay
+}
+
+// PostJSON returns handler that posts payload to the URL; responses with status other than 2xx
+// are delivery failures
+func PostJSON(client *http.Client, url string) Handler {
+	return func(ctx context.Context, payload []byte) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+		if err != nil {
+			return fmt.Errorf("error creating request: %w", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := client.Do(req)
+		if err != nil {
+			return fmt.Errorf("error calling %s: %w", url, err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+			return fmt.Errorf("error calling %s: %s: %s", url, resp.Status, bytes.TrimSpace(body))
+		}
+		return nil
+	}
+}
@@ -0,0 +1,57 @@
+package outbox
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_Backoff(t *testing.T) {
+	base, max := 30*time.Second, time.Hour
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{7, 32 * time.Minute},
+		{8, time.Hour},
+		{100, time.Hour},
+	}
+	for _, tt := range tests {
+		if got := Backoff(tt.attempts, base, max); got != tt.want {
+			t.Errorf("attempts %d: expected %s, got %s", tt.attempts, tt.want, got)
+		}
+	}
+}
+
+func Test_PostJSON(t *testing.T) {
+	status := http.StatusOK
+	var body string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		body = string(b)
+		w.WriteHeader(status)
+		w.Write([]byte(`{"error": true, "message": "service is down"}`))
+	}))
+	defer srv.Close()
+
+	handler := PostJSON(srv.Client(), srv.URL)
+	if err := handler(context.Background(), []byte(`{"id": 1}`)); err != nil {
+		t.Fatalf("expected delivery, got %s", err)
+	}
+	if body != `{"id": 1}` {
+		t.Errorf("expected payload to be posted, got %q", body)
+	}
+
+	status = http.StatusServiceUnavailable
+	err := handler(context.Background(), []byte(`{"id": 1}`))
+	if err == nil || !strings.Contains(err.Error(), "service is down") {
+		t.Errorf("expected failure with response body, got %v", err)
+	}
+}
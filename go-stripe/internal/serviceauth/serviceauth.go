@@ -0,0 +1,194 @@
+// Package serviceauth authenticates requests between our own services. Requests are signed
+// with HMAC-SHA256 of timestamp, nonce, method, URI and body using a shared secret; the verifier
+// rejects stale requests and ones it has already seen, so that captured requests can not be replayed
+package serviceauth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/keyring"
+)
+
+// Headers carrying signature and data it is computed of besides the request itself
+const (
+	HeaderKeyID     = "X-Service-Key-Id"
+	HeaderTimestamp = "X-Service-Timestamp"
+	HeaderNonce     = "X-Service-Nonce"
+	HeaderSignature = "X-Service-Signature"
+)
+
+// maxBodyBytes limits size of bodies read to be verified
+const maxBodyBytes = 1048576
+
+var (
+	ErrMissingSignature = errors.New("request is not signed")
+	ErrInvalidSignature = errors.New("invalid request signature")
+	ErrStaleRequest     = errors.New("request timestamp is out of allowed window")
+	ErrReplayedRequest  = errors.New("request has already been received")
+)
+
+// signature computes HMAC of the request's parts
+func signature(secret []byte, timestamp, nonce, method, uri string, body []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n", timestamp, nonce, method, uri)
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// Signer signs outgoing requests with the active key of the keyring
+type Signer struct {
+	Keys *keyring.Keyring
+}
+
+// Sign adds signature headers to the request; body must be the same as request's body
+func (s *Signer) Sign(req *http.Request, body []byte) error {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("error generating nonce: %w", err)
+	}
+	keyID, secret := s.Keys.Active()
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	nonceHex := hex.EncodeToString(nonce)
+
+	req.Header.Set(HeaderKeyID, keyID)
+	req.Header.Set(HeaderTimestamp, timestamp)
+	req.Header.Set(HeaderNonce, nonceHex)
+	req.Header.Set(HeaderSignature, hex.EncodeToString(
+		signature(secret, timestamp, nonceHex, req.Method, req.URL.RequestURI(), body)))
+	return nil
+}
+
+// Transport returns round tripper that signs every request before sending it with base
+// (http.DefaultTransport if nil), so that clients using it sign requests automatically
+func (s *Signer) Transport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return roundTripper{signer: s, base: base}
+}
+
+type roundTripper struct {
+	signer *Signer
+	base   http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper
+func (rt roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error reading request body: %w", err)
+		}
+	}
+	// round trippers must not modify the request they are given
+	signed := req.Clone(req.Context())
+	signed.Body = io.NopCloser(bytes.NewReader(body))
+	if err := rt.signer.Sign(signed, body); err != nil {
+		return nil, err
+	}
+	return rt.base.RoundTrip(signed)
+}
+
+// Verifier checks signatures of incoming requests. It remembers nonces for as long as
+// requests carrying them are accepted, so it must be shared by all handlers
+type Verifier struct {
+	Keys *keyring.Keyring
+	// MaxSkew is how far request's timestamp may be from verifier's clock
+	MaxSkew time.Duration
+
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+// NewVerifier returns verifier accepting requests signed with any key of the keyring
+func NewVerifier(keys *keyring.Keyring, maxSkew time.Duration) *Verifier {
+	return &Verifier{Keys: keys, MaxSkew: maxSkew, seen: map[string]time.Time{}}
+}
+
+// Verify checks signature of the request with the body already read from it
+func (v *Verifier) Verify(r *http.Request, body []byte, now time.Time) error {
+	timestamp := r.Header.Get(HeaderTimestamp)
+	nonce := r.Header.Get(HeaderNonce)
+	sig := r.Header.Get(HeaderSignature)
+	if timestamp == "" || nonce == "" || sig == "" {
+		return ErrMissingSignature
+	}
+	secret, err := v.Keys.Get(r.Header.Get(HeaderKeyID))
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	got, err := hex.DecodeString(sig)
+	if err != nil || !hmac.Equal(got, signature(secret, timestamp, nonce, r.Method, r.URL.RequestURI(), body)) {
+		return ErrInvalidSignature
+	}
+
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	sent := time.Unix(ts, 0)
+	if sent.Before(now.Add(-v.MaxSkew)) || sent.After(now.Add(v.MaxSkew)) {
+		return ErrStaleRequest
+	}
+	return v.remember(nonce, sent.Add(v.MaxSkew), now)
+}
+
+// remember records the nonce until the time requests carrying it get stale
+func (v *Verifier) remember(nonce string, until, now time.Time) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	for n, expiry := range v.seen {
+		if expiry.Before(now) {
+			delete(v.seen, n)
+		}
+	}
+	if _, ok := v.seen[nonce]; ok {
+		return ErrReplayedRequest
+	}
+	v.seen[nonce] = until
+	return nil
+}
+
+// Middleware rejects requests that are not signed, are signed with unknown key or wrong
+// signature, are stale or replayed
+func (v *Verifier) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodyBytes))
+		if err != nil {
+			unauthorized(w, fmt.Errorf("error reading request body: %w", err))
+			return
+		}
+		if err = v.Verify(r, body, time.Now()); err != nil {
+			unauthorized(w, err)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		next.ServeHTTP(w, r)
+	})
+}
+
+func unauthorized(w http.ResponseWriter, err error) {
+	out, _ := json.Marshal(struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}{true, err.Error()})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnauthorized)
+	w.Write(out)
+}
@@ -0,0 +1,120 @@
+package serviceauth
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/keyring"
+)
+
+func testKeys(t *testing.T) *keyring.Keyring {
+	keys, err := keyring.Parse("k2:new-secret,k1:old-secret", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func signedRequest(t *testing.T, keys *keyring.Keyring, body string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/invoice/create-and-send", strings.NewReader(body))
+	signer := Signer{Keys: keys}
+	if err := signer.Sign(req, []byte(body)); err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+func Test_Verify(t *testing.T) {
+	keys := testKeys(t)
+	body := `{"id": 1}`
+	now := time.Now()
+
+	tests := []struct {
+		name   string
+		modify func(r *http.Request) (*http.Request, string, time.Time)
+		want   error
+	}{
+		{"valid", func(r *http.Request) (*http.Request, string, time.Time) { return r, body, now }, nil},
+		{"unsigned", func(r *http.Request) (*http.Request, string, time.Time) {
+			r.Header.Del(HeaderSignature)
+			return r, body, now
+		}, ErrMissingSignature},
+		{"tampered body", func(r *http.Request) (*http.Request, string, time.Time) {
+			return r, `{"id": 2}`, now
+		}, ErrInvalidSignature},
+		{"unknown key", func(r *http.Request) (*http.Request, string, time.Time) {
+			r.Header.Set(HeaderKeyID, "k3")
+			return r, body, now
+		}, ErrInvalidSignature},
+		{"stale", func(r *http.Request) (*http.Request, string, time.Time) {
+			return r, body, now.Add(10 * time.Minute)
+		}, ErrStaleRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := NewVerifier(keys, 5*time.Minute)
+			r, b, at := tt.modify(signedRequest(t, keys, body))
+			if err := v.Verify(r, []byte(b), at); !errors.Is(err, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func Test_VerifyRejectsReplay(t *testing.T) {
+	keys := testKeys(t)
+	v := NewVerifier(keys, 5*time.Minute)
+	body := `{"id": 1}`
+	req := signedRequest(t, keys, body)
+
+	if err := v.Verify(req, []byte(body), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Verify(req, []byte(body), time.Now()); !errors.Is(err, ErrReplayedRequest) {
+		t.Errorf("expected %v, got %v", ErrReplayedRequest, err)
+	}
+	// the same payload signed again is a new request
+	if err := v.Verify(signedRequest(t, keys, body), []byte(body), time.Now()); err != nil {
+		t.Errorf("expected request to be accepted, got %v", err)
+	}
+}
+
+func Test_TransportAndMiddleware(t *testing.T) {
+	keys := testKeys(t)
+	var received string
+	handler := NewVerifier(keys, 5*time.Minute).Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		received = string(b)
+	}))
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	// callers signing with the old key keep working during rotation
+	oldKeys, err := keyring.Parse("k2:new-secret,k1:old-secret", "k1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: (&Signer{Keys: oldKeys}).Transport(nil)}
+	resp, err := client.Post(srv.URL+"/invoice/create-and-send", "application/json", strings.NewReader(`{"id": 1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || received != `{"id": 1}` {
+		t.Errorf("expected signed request to pass with body, got %s and %q", resp.Status, received)
+	}
+
+	resp, err = http.Post(srv.URL+"/invoice/create-and-send", "application/json", strings.NewReader(`{"id": 1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected unsigned request to be rejected, got %s", resp.Status)
+	}
+}
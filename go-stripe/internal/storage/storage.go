@@ -0,0 +1,119 @@
+// Package storage keeps documents, i.e. invoice PDFs, where all the services can read them:
+// in a local directory shared by services running on one host, or in S3-compatible object storage
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Storage kinds
+const (
+	KindLocal = "local"
+	KindS3    = "s3"
+)
+
+// ErrNotFound is returned when there is no document by the key
+var ErrNotFound = errors.New("document not found")
+
+// Store saves and reads documents by keys; keys are slash separated relative paths
+type Store interface {
+	Put(ctx context.Context, key string, data []byte, contentType string) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+}
+
+// Config selects and configures store
+type Config struct {
+	Kind string
+	// Dir is root directory of local store
+	Dir string
+	// Endpoint, i.e. https://s3.eu-central-1.amazonaws.com or http://localhost:9000, Region,
+	// Bucket and credentials configure S3 store
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+}
+
+// New returns store selected by configuration
+func New(cfg Config) (Store, error) {
+	switch cfg.Kind {
+	case KindLocal, "":
+		if cfg.Dir == "" {
+			return nil, errors.New("directory of local storage is required")
+		}
+		return &Local{Dir: cfg.Dir}, nil
+	case KindS3:
+		if cfg.Endpoint == "" || cfg.Bucket == "" || cfg.AccessKey == "" || cfg.SecretKey == "" {
+			return nil, errors.New("endpoint, bucket and credentials of S3 storage are required")
+		}
+		region := cfg.Region
+		if region == "" {
+			region = "us-east-1"
+		}
+		return &S3{
+			Endpoint:  cfg.Endpoint,
+			Region:    region,
+			Bucket:    cfg.Bucket,
+			AccessKey: cfg.AccessKey,
+			SecretKey: cfg.SecretKey,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown storage kind %q", cfg.Kind)
+	}
+}
+
+// Local keeps documents in a directory
+type Local struct {
+	Dir string
+}
+
+// path resolves key to a file path; keys must not point outside of the directory
+func (s *Local) path(key string) (string, error) {
+	p := filepath.FromSlash(key)
+	if !filepath.IsLocal(p) {
+		return "", fmt.Errorf("invalid document key %q", key)
+	}
+	return filepath.Join(s.Dir, p), nil
+}
+
+// Put implements Store
+func (s *Local) Put(ctx context.Context, key string, data []byte, contentType string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return fmt.Errorf("error creating directory for %q: %w", key, err)
+	}
+	// written to temporary file first, so that readers never get partial document
+	tmp := p + ".tmp"
+	if err = os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("error writing %q: %w", key, err)
+	}
+	if err = os.Rename(tmp, p); err != nil {
+		return fmt.Errorf("error writing %q: %w", key, err)
+	}
+	return nil
+}
+
+// Get implements Store
+func (s *Local) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("error reading %q: %w", key, ErrNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading %q: %w", key, err)
+	}
+	return f, nil
+}
@@ -0,0 +1,92 @@
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	digits = 6
+	period = 30 * time.Second
+	// skew is the number of periods before and after current one accepted to allow for clock drift
+	skew = 1
+)
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateSecret generates random base32 encoded secret shared with authenticator app
+func GenerateSecret() (string, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return "", fmt.Errorf("error generating TOTP secret: %w", err)
+	}
+	return encoding.EncodeToString(secret), nil
+}
+
+// ProvisioningURI builds otpauth:// URI that authenticator apps read from QR code
+func ProvisioningURI(secret, issuer, account string) string {
+	label := url.PathEscape(fmt.Sprintf("%s:%s", issuer, account))
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", issuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprintf("%d", digits))
+	params.Set("period", fmt.Sprintf("%d", int(period.Seconds())))
+	return fmt.Sprintf("otpauth://totp/%s?%s", label, params.Encode())
+}
+
+// GenerateCode generates the code for the moment t
+func GenerateCode(secret string, t time.Time) (string, error) {
+	return codeForCounter(secret, uint64(t.Unix()/int64(period.Seconds())))
+}
+
+// Validate checks the code against the moment t allowing for clock drift
+func Validate(code, secret string, t time.Time) (bool, error) {
+	_, ok, err := Verify(code, secret, t)
+	return ok, err
+}
+
+// Verify checks the code like Validate and returns the time step it has been generated for,
+// so that a code can be rejected once a code of the same or later step has been accepted
+func Verify(code, secret string, t time.Time) (step int64, ok bool, err error) {
+	code = strings.TrimSpace(code)
+	if len(code) != digits {
+		return 0, false, nil
+	}
+	counter := t.Unix() / int64(period.Seconds())
+	for i := -skew; i <= skew; i++ {
+		expected, err := codeForCounter(secret, uint64(counter+int64(i)))
+		if err != nil {
+			return 0, false, err
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return counter + int64(i), true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+// codeForCounter implements HOTP algorithm (RFC 4226)
+func codeForCounter(secret string, counter uint64) (string, error) {
+	key, err := encoding.DecodeString(strings.ToUpper(strings.TrimRight(secret, "=")))
+	if err != nil {
+		return "", fmt.Errorf("error decoding TOTP secret: %w", err)
+	}
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, counter)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", digits, value%1000000), nil
+}
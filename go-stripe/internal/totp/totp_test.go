@@ -0,0 +1,58 @@
+package totp
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+)
+
+// test vectors from RFC 6238 for SHA1 truncated to 6 digits
+func Test_GenerateCode(t *testing.T) {
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+	var theTests = []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+
+	for _, e := range theTests {
+		code, err := GenerateCode(secret, time.Unix(e.unix, 0))
+		if err != nil {
+			t.Fatalf("error generating code: %s", err)
+		}
+		if code != e.code {
+			t.Errorf("bad code for %d: expected %s but got %s", e.unix, e.code, code)
+		}
+	}
+}
+
+func Test_Validate(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatalf("error generating secret: %s", err)
+	}
+	now := time.Now()
+	code, _ := GenerateCode(secret, now)
+
+	if ok, _ := Validate(code, secret, now.Add(30*time.Second)); !ok {
+		t.Error("code from previous period must be accepted")
+	}
+	if ok, _ := Validate(code, secret, now.Add(2*time.Minute)); ok {
+		t.Error("outdated code must be rejected")
+	}
+	if step, ok, _ := Verify(code, secret, now.Add(30*time.Second)); !ok || step != now.Unix()/30 {
+		t.Errorf("expected code to match step %d but got %d", now.Unix()/30, step)
+	}
+	if ok, _ := Validate("12345", secret, now); ok {
+		t.Error("code of wrong length must be rejected")
+	}
+	if uri := ProvisioningURI(secret, "Widgets", "admin@example.com"); !strings.Contains(uri, "secret="+secret) {
+		t.Errorf("secret missing from provisioning URI %q", uri)
+	}
+}
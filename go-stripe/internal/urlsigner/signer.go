@@ -2,43 +2,69 @@ package urlsigner
 
 import (
 	"fmt"
+	"net/url"
 	"strings"
 	"time"
 
+	"github.com/AlexL70/IntermediateWebAppWithGo/go-stripe/internal/keyring"
 	goalone "github.com/bwmarrin/go-alone"
 )
 
+// keyIDParam is query parameter carrying ID of the key URL has been signed with
+const keyIDParam = "kid"
+
 type Signer struct {
-	Secret []byte
+	Keys *keyring.Keyring
 }
 
+// GenerateTokenFromString signs URL with active key, adding ID of the key to URL's query
 func (s *Signer) GenerateTokenFromString(data string) string {
-	var urlToSign string
-
-	crypt := goalone.New(s.Secret, goalone.Timestamp)
-	if strings.Contains(data, "?") {
-		urlToSign = fmt.Sprintf("%s&hash=", data)
-	} else {
-		urlToSign = fmt.Sprintf("%s?hash=", data)
+	keyID, secret := s.Keys.Active()
+	if keyID != keyring.LegacyKeyID {
+		data = appendParam(data, fmt.Sprintf("%s=%s", keyIDParam, url.QueryEscape(keyID)))
 	}
+	urlToSign := appendParam(data, "hash=")
 
+	crypt := goalone.New(secret, goalone.Timestamp)
 	tokenBytes := crypt.Sign([]byte(urlToSign))
 	token := string(tokenBytes)
 	return token
 }
 
 func (s *Signer) VerifyToken(token string) bool {
-	crypt := goalone.New(s.Secret, goalone.Timestamp)
-	_, err := crypt.Unsign([]byte(token))
+	crypt, err := s.signerFor(token)
 	if err != nil {
-		fmt.Println(fmt.Errorf("error unsigning token: %w", err))
 		return false
 	}
-	return true
+	_, err = crypt.Unsign([]byte(token))
+	return err == nil
 }
 
 func (s *Signer) Expired(token string, minutesUntilExpire int) bool {
-	crypt := goalone.New(s.Secret, goalone.Timestamp)
+	crypt, err := s.signerFor(token)
+	if err != nil {
+		return true
+	}
 	ts := crypt.Parse([]byte(token))
 	return time.Since(ts.Timestamp) > time.Duration(minutesUntilExpire)*time.Minute
 }
+
+// signerFor selects the key token has been signed with by key ID in its query
+func (s *Signer) signerFor(token string) (*goalone.Sword, error) {
+	keyID := keyring.LegacyKeyID
+	if u, err := url.Parse(token); err == nil {
+		keyID = u.Query().Get(keyIDParam)
+	}
+	secret, err := s.Keys.Get(keyID)
+	if err != nil {
+		return nil, fmt.Errorf("error verifying token: %w", err)
+	}
+	return goalone.New(secret, goalone.Timestamp), nil
+}
+
+func appendParam(u, param string) string {
+	if strings.Contains(u, "?") {
+		return fmt.Sprintf("%s&%s", u, param)
+	}
+	return fmt.Sprintf("%s?%s", u, param)
+}
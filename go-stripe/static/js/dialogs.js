@@ -0,0 +1,60 @@
+// Dialog shows alerts and confirmations in Bootstrap modals. Everything is set as text,
+// so that data shown in dialogs can not inject markup
+const Dialog = {
+    // fire shows dialog and resolves to {isConfirmed} once it is closed. Options are either
+    // the text or {title, text, code, showCancelButton, confirmButtonText}; code is shown
+    // preformatted, i.e. secrets to copy
+    fire(options) {
+        if (typeof options === "string") {
+            options = {text: options};
+        }
+        return new Promise(function(resolve) {
+            let confirmed = false;
+            let modal = dialogElement("div", "modal fade");
+            modal.tabIndex = -1;
+            let content = dialogElement("div", "modal-content");
+            modal.appendChild(dialogElement("div", "modal-dialog modal-dialog-centered")).appendChild(content);
+
+            if (options.title) {
+                content.appendChild(dialogElement("div", "modal-header"))
+                    .appendChild(dialogElement("h5", "modal-title", options.title));
+            }
+            let body = content.appendChild(dialogElement("div", "modal-body"));
+            if (options.text) {
+                body.appendChild(dialogElement("p", "mb-0", options.text));
+            }
+            if (options.code) {
+                body.appendChild(dialogElement("pre", "mt-2 mb-0")).appendChild(dialogElement("code", "", options.code));
+            }
+
+            let footer = content.appendChild(dialogElement("div", "modal-footer"));
+            if (options.showCancelButton) {
+                let cancel = footer.appendChild(dialogElement("button", "btn btn-secondary", options.cancelButtonText || "Cancel"));
+                cancel.type = "button";
+                cancel.setAttribute("data-bs-dismiss", "modal");
+            }
+            let confirm = footer.appendChild(dialogElement("button", "btn btn-primary", options.confirmButtonText || "OK"));
+            confirm.type = "button";
+            confirm.addEventListener("click", function() {
+                confirmed = true;
+                bootstrap.Modal.getInstance(modal).hide();
+            });
+
+            modal.addEventListener("hidden.bs.modal", function() {
+                modal.remove();
+                resolve({isConfirmed: confirmed});
+            });
+            document.body.appendChild(modal);
+            new bootstrap.Modal(modal).show();
+        });
+    },
+};
+
+function dialogElement(tag, className, text) {
+    let el = document.createElement(tag);
+    el.className = className;
+    if (text !== undefined) {
+        el.textContent = text;
+    }
+    return el;
+}